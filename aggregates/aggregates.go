@@ -9,10 +9,10 @@ import (
 )
 
 type User struct {
-	Username   string `json:"username"`
-	Email      string `json:"email"`
-	LoginCount int32  `json:"login_count"`
-	Version    uint64 `json:"version"`
+	Username   string `json:"username" redis:"username"`
+	Email      string `json:"email" redis:"email"`
+	LoginCount int32  `json:"login_count" redis:"login_count"`
+	Version    uint64 `json:"version" redis:"version"`
 }
 
 func (ua User) Apply(re esdb.RecordedEvent) (User, error) {
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+type DailyActiveUsers struct {
+	Day         time.Time `json:"day"`
+	ActiveUsers int64     `json:"active_users"`
+}
+
+type DailyLogins struct {
+	Day    time.Time `json:"day"`
+	Logins int64     `json:"logins"`
+}
+
+type InactiveUser struct {
+	Username  string     `json:"username"`
+	LastLogin *time.Time `json:"last_login"`
+}
+
+/*
+Count a login for the given day and update the first and last login timestamps.
+
+The version is the event number of the login event, logins with a version
+lower than or equal to the stored one were already counted and are skipped.
+*/
+func RecordLogin(ctx context.Context, db Querier, username string, version uint64, loggedInAt time.Time) (bool, error) {
+	var storedVersion uint64
+	row := db.QueryRowContext(ctx, "SELECT version FROM user_login_stats WHERE username = ? FOR UPDATE", username)
+	err := row.Scan(&storedVersion)
+	if err == nil && version <= storedVersion {
+		return false, nil
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, fmt.Errorf("failed to get the login stats of %s: %w", username, err)
+	}
+
+	loggedInAt = loggedInAt.UTC()
+
+	_, err = db.ExecContext(ctx,
+		"INSERT INTO user_logins_daily (username, day, count) VALUES (?, ?, 1) ON DUPLICATE KEY UPDATE count=count+1",
+		username, loggedInAt.Format(time.DateOnly),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to count the login of %s: %w", username, err)
+	}
+
+	_, err = db.ExecContext(ctx,
+		"INSERT INTO user_login_stats (username, first_login, last_login, version) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE last_login=VALUES(last_login), version=VALUES(version)",
+		username, loggedInAt, loggedInAt, version,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to update the login stats of %s: %w", username, err)
+	}
+
+	return true, nil
+}
+
+// Returns the number of distinct users that logged in for every day in the range (inclusive)
+func GetDailyActiveUsers(ctx context.Context, db Querier, from, to time.Time) ([]DailyActiveUsers, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT day, COUNT(*) FROM user_logins_daily WHERE day BETWEEN ? AND ? GROUP BY day ORDER BY day",
+		from.Format(time.DateOnly), to.Format(time.DateOnly),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select daily active users: %w", err)
+	}
+	defer rows.Close()
+
+	res := []DailyActiveUsers{}
+	for rows.Next() {
+		var dau DailyActiveUsers
+		if err := rows.Scan(&dau.Day, &dau.ActiveUsers); err != nil {
+			return nil, fmt.Errorf("failed to scan the row: %w", err)
+		}
+		res = append(res, dau)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err(): %w", err)
+	}
+
+	return res, nil
+}
+
+// Returns the number of logins of the user for every day in the range (inclusive)
+func GetUserLogins(ctx context.Context, db Querier, username string, from, to time.Time) ([]DailyLogins, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT day, count FROM user_logins_daily WHERE username = ? AND day BETWEEN ? AND ? ORDER BY day",
+		username, from.Format(time.DateOnly), to.Format(time.DateOnly),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select logins of %s: %w", username, err)
+	}
+	defer rows.Close()
+
+	res := []DailyLogins{}
+	for rows.Next() {
+		var dl DailyLogins
+		if err := rows.Scan(&dl.Day, &dl.Logins); err != nil {
+			return nil, fmt.Errorf("failed to scan the row: %w", err)
+		}
+		res = append(res, dl)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err(): %w", err)
+	}
+
+	return res, nil
+}
+
+// Returns the users that didn't log in since the given time, including the ones that never logged in
+func GetInactiveUsers(ctx context.Context, db Querier, since time.Time) ([]InactiveUser, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT u.username, s.last_login FROM users u LEFT JOIN user_login_stats s ON s.username = u.username WHERE s.last_login IS NULL OR s.last_login < ? ORDER BY u.username",
+		since.UTC(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select inactive users: %w", err)
+	}
+	defer rows.Close()
+
+	res := []InactiveUser{}
+	for rows.Next() {
+		var iu InactiveUser
+		if err := rows.Scan(&iu.Username, &iu.LastLogin); err != nil {
+			return nil, fmt.Errorf("failed to scan the row: %w", err)
+		}
+		res = append(res, iu)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err(): %w", err)
+	}
+
+	return res, nil
+}
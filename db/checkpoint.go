@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"sync"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+)
+
+/*
+ProjectionCheckpoint is the position up to which the read model of a projection
+is visible to readers, readers can wait for it to reach a position.
+
+The nil checkpoint never advances and never makes anyone wait.
+*/
+type ProjectionCheckpoint struct {
+	mu       sync.Mutex
+	position esdb.Position
+	advanced chan struct{}
+}
+
+func NewProjectionCheckpoint() *ProjectionCheckpoint {
+	return &ProjectionCheckpoint{
+		advanced: make(chan struct{}),
+	}
+}
+
+// Moves the checkpoint forward, positions behind the current one are ignored
+func (c *ProjectionCheckpoint) Advance(position esdb.Position) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if position.Commit <= c.position.Commit {
+		return
+	}
+
+	c.position = position
+	close(c.advanced)
+	c.advanced = make(chan struct{})
+}
+
+func (c *ProjectionCheckpoint) Position() esdb.Position {
+	if c == nil {
+		return esdb.Position{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.position
+}
+
+// Blocks until the checkpoint reaches the commit position or the context is done
+func (c *ProjectionCheckpoint) Wait(ctx context.Context, commit uint64) error {
+	if c == nil {
+		return nil
+	}
+
+	for {
+		c.mu.Lock()
+		reached := c.position.Commit >= commit
+		advanced := c.advanced
+		c.mu.Unlock()
+
+		if reached {
+			return nil
+		}
+
+		select {
+		case <-advanced:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
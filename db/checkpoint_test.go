@@ -0,0 +1,40 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+)
+
+func TestProjectionCheckpointWait(t *testing.T) {
+	checkpoint := db.NewProjectionCheckpoint()
+
+	go func() {
+		for commit := uint64(1); commit <= 10; commit++ {
+			time.Sleep(10 * time.Millisecond)
+			checkpoint.Advance(esdb.Position{Commit: commit, Prepare: commit})
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := checkpoint.Wait(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if commit := checkpoint.Position().Commit; commit < 5 {
+		t.Fatalf("wait returned before the checkpoint reached the position: %d", commit)
+	}
+
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer shortCancel()
+
+	if err := checkpoint.Wait(shortCtx, 100); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait to time out, got: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package db_test
 
 import (
+	"database/sql"
 	"log"
 	"os"
 	"testing"
@@ -8,25 +9,52 @@ import (
 	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
 	"github.com/MatejaMaric/esdb-playground/tests"
 	"github.com/ory/dockertest/v3"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/errgroup"
 )
 
-var TestEsdbClient *esdb.Client
+var (
+	TestEsdbClient  *esdb.Client
+	TestRedisClient *redis.Client
+	TestSqlClient   *sql.DB
+)
 
 func TestMain(m *testing.M) {
 	pool := tests.SetupDockertestPool()
 
-	var resourceEventStoreDB *dockertest.Resource
-	var err error
+	var resourceRedis, resourceEventStoreDB, resourceMariaDB *dockertest.Resource
+
+	eg := &errgroup.Group{}
+
+	eg.Go(func() error {
+		var err error
+		TestRedisClient, resourceRedis, err = tests.SpawnTestRedis(pool)
+		return err
+	})
+
+	eg.Go(func() error {
+		var err error
+		TestEsdbClient, resourceEventStoreDB, err = tests.SpawnTestEventStoreDB(pool)
+		return err
+	})
+
+	eg.Go(func() error {
+		var err error
+		TestSqlClient, resourceMariaDB, err = tests.SpawnTestMariaDB(pool)
+		if err != nil {
+			return err
+		}
+		return tests.CreateSchema(TestSqlClient, "../initdb.d/base.sql")
+	})
 
-	TestEsdbClient, resourceEventStoreDB, err = tests.SpawnTestEventStoreDB(pool)
-	if err != nil {
+	if err := eg.Wait(); err != nil {
 		log.Fatal(err)
 	}
 
 	code := m.Run()
 
 	// You can't defer this because os.Exit doesn't care for defer
-	tests.PurgeResources(pool, resourceEventStoreDB)
+	tests.PurgeResources(pool, resourceRedis, resourceEventStoreDB, resourceMariaDB)
 
 	os.Exit(code)
 }
@@ -26,6 +26,12 @@ func ConnectToEventStoreDB() (*esdb.Client, error) {
 	return esdb.NewClient(esdbConf)
 }
 
+// Reports whether the (possibly wrapped) error is an EventStoreDB error with the given code
+func IsErrorCode(err error, code esdb.ErrorCode) bool {
+	var esdbErr *esdb.Error
+	return errors.As(err, &esdbErr) && esdbErr.Code() == code
+}
+
 func AppendEvent(
 	ctx context.Context,
 	esdbClient *esdb.Client,
@@ -87,38 +93,95 @@ func HandleReadStream(ctx context.Context, esdbClient *esdb.Client, streamName s
 	return nil
 }
 
-func HandleAllStream(ctx context.Context, esdbClient *esdb.Client, opts esdb.SubscribeToAllOptions, handler func(esdb.RecordedEvent) error) error {
-	stream, err := esdbClient.SubscribeToAll(ctx, opts)
+/*
+Read $all from the start up to the latest event of the given stream type, calling the handler for every event of the type.
+
+ReadAll can't be filtered, so the events are read with a subscription filtered by EventStoreDB on the streams
+starting with the stream type followed by a dash, which stops once it handles the latest event.
+*/
+func HandleReadAllOfType(ctx context.Context, esdbClient *esdb.Client, streamType events.Stream, handler func(esdb.RecordedEvent) error) error {
+	prefix := string(streamType) + "-"
+
+	latest, err := GetLatestEventForStreamType(ctx, esdbClient, events.Stream(prefix))
 	if err != nil {
-		return fmt.Errorf("failed to subscribe to stream: %w", err)
+		return fmt.Errorf("failed to get the latest event of the stream type %s: %w", streamType, err)
+	}
+	if latest == nil {
+		return nil
 	}
 
-	if err := HandleSubscription(stream, handler); err != nil {
-		return err
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sopts := esdb.SubscribeToAllOptions{
+		From: esdb.Start{},
+		Filter: &esdb.SubscriptionFilter{
+			Type:     esdb.StreamFilterType,
+			Prefixes: []string{prefix},
+		},
 	}
 
-	if err := stream.Close(); err != nil {
-		return fmt.Errorf("closing the stream resulted in an error: %w", err)
+	stream, err := esdbClient.SubscribeToAll(ctx, sopts)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to $all: %w", err)
 	}
+	defer stream.Close()
 
-	return nil
+	for {
+		subEvent := stream.Recv()
+
+		if subEvent.SubscriptionDropped != nil {
+			return fmt.Errorf("subscription to $all dropped before the latest event: %w", subEvent.SubscriptionDropped.Error)
+		}
+
+		if subEvent.EventAppeared == nil {
+			continue
+		}
+
+		event := subEvent.EventAppeared.Event
+		if event == nil {
+			return fmt.Errorf("event at commit %v is nil", subEvent.EventAppeared.Commit)
+		}
+
+		if err := handler(*event); err != nil {
+			return fmt.Errorf("the event handler returned an error: %w", err)
+		}
+
+		if event.Position.Commit >= latest.Position.Commit {
+			return nil
+		}
+	}
+}
+
+func HandleAllStream(ctx context.Context, esdbClient *esdb.Client, opts esdb.SubscribeToAllOptions, handler func(esdb.RecordedEvent) error) error {
+	stream, err := esdbClient.SubscribeToAll(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to stream: %w", err)
+	}
+	defer stream.Close()
+
+	return HandleSubscription(stream, handler)
 }
 
-func HandleStream(ctx context.Context, esdbClient *esdb.Client, streamName string, handler func(esdb.RecordedEvent) error) error {
+// The tracker can be nil
+func HandleStream(ctx context.Context, esdbClient *esdb.Client, streamName string, tracker *SubscriptionTracker, handler func(esdb.RecordedEvent) error) error {
 	stream, err := esdbClient.SubscribeToStream(ctx, streamName, esdb.SubscribeToStreamOptions{})
 	if err != nil {
 		return fmt.Errorf("failed to subscribe to stream %s: %w", streamName, err)
 	}
+	defer stream.Close()
 
-	if err := HandleSubscription(stream, handler); err != nil {
-		return err
-	}
+	handleEvent := func(event esdb.RecordedEvent) error {
+		if err := handler(event); err != nil {
+			return err
+		}
+
+		tracker.Processed(event)
 
-	if err := stream.Close(); err != nil {
-		return fmt.Errorf("closing the stream resulted in an error: %w", err)
+		return nil
 	}
 
-	return nil
+	return HandleSubscription(stream, handleEvent)
 }
 
 func HandleSubscription(stream *esdb.Subscription, handler func(esdb.RecordedEvent) error) error {
@@ -143,26 +206,46 @@ func HandleSubscription(stream *esdb.Subscription, handler func(esdb.RecordedEve
 	}
 }
 
-func AppendCreateUserEvent(ctx context.Context, esdbClient *esdb.Client, event events.CreateUserEvent) (*esdb.WriteResult, error) {
-	return AppendEvent(
-		ctx,
-		esdbClient,
-		events.UserEventsStream.ForUser(event.Username),
-		events.CreateUser,
-		event,
-		esdb.NoStream{},
-	)
+// The idempotency key can be empty, see appendUserEvent
+func AppendCreateUserEvent(ctx context.Context, esdbClient *esdb.Client, event events.CreateUserEvent, idempotencyKey string) (*esdb.WriteResult, error) {
+	return appendUserEvent(ctx, esdbClient, event.Username, events.CreateUser, event, esdb.NoStream{}, idempotencyKey)
+}
+
+// The expected revision is usually esdb.StreamExists{}, or the revision the client last saw
+func AppendLoginUserEvent(ctx context.Context, esdbClient *esdb.Client, event events.LoginUserEvent, expectedRevision esdb.ExpectedRevision, idempotencyKey string) (*esdb.WriteResult, error) {
+	return appendUserEvent(ctx, esdbClient, event.Username, events.LoginUser, event, expectedRevision, idempotencyKey)
 }
 
-func AppendLoginUserEvent(ctx context.Context, esdbClient *esdb.Client, event events.LoginUserEvent) (*esdb.WriteResult, error) {
-	return AppendEvent(
-		ctx,
-		esdbClient,
-		events.UserEventsStream.ForUser(event.Username),
-		events.LoginUser,
-		event,
-		esdb.StreamExists{},
-	)
+// When the idempotency key isn't empty, the event ID is derived from it, so a retried append is only written once
+func appendUserEvent(
+	ctx context.Context,
+	esdbClient *esdb.Client,
+	username string,
+	eventType events.Event,
+	eventData any,
+	expectedRevision esdb.ExpectedRevision,
+	idempotencyKey string,
+) (*esdb.WriteResult, error) {
+	streamName := events.UserEventsStream.ForUser(username)
+	if idempotencyKey == "" {
+		return AppendEvent(ctx, esdbClient, streamName, eventType, eventData, expectedRevision)
+	}
+
+	esdbEvent, err := events.CreateWithID(events.IdempotentEventID(idempotencyKey, streamName), eventType, eventData)
+	if err != nil {
+		return nil, err
+	}
+
+	aopts := esdb.AppendToStreamOptions{
+		ExpectedRevision: expectedRevision,
+	}
+
+	appendResult, err := esdbClient.AppendToStream(ctx, streamName, aopts, esdbEvent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to append to stream: %w", err)
+	}
+
+	return appendResult, nil
 }
 
 func NewUserFromStream(ctx context.Context, esdbClient *esdb.Client, username string) (aggregates.User, error) {
@@ -183,7 +266,55 @@ func NewUserFromStream(ctx context.Context, esdbClient *esdb.Client, username st
 	return user, nil
 }
 
+// Returns the event number of the last event in the stream
+func GetStreamRevision(ctx context.Context, esdbClient *esdb.Client, streamName string) (uint64, error) {
+	event, err := GetLatestEventOfStream(ctx, esdbClient, streamName)
+	if err != nil {
+		return 0, err
+	}
+
+	return event.EventNumber, nil
+}
+
+func GetLatestEventOfStream(ctx context.Context, esdbClient *esdb.Client, streamName string) (*esdb.RecordedEvent, error) {
+	ropts := esdb.ReadStreamOptions{
+		From:      esdb.End{},
+		Direction: esdb.Backwards,
+	}
+
+	stream, err := esdbClient.ReadStream(ctx, streamName, ropts, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the stream '%s': %w", streamName, err)
+	}
+	defer stream.Close()
+
+	resolved, err := stream.Recv()
+	if err != nil {
+		return nil, fmt.Errorf("error while reading the last event from the stream %s: %w", streamName, err)
+	}
+
+	if resolved.Event == nil {
+		return nil, fmt.Errorf("event is nil!")
+	}
+
+	return resolved.Event, nil
+}
+
 func GetPositionOfLatestEventForStreamType(ctx context.Context, esdbClient *esdb.Client, streamType events.Stream) (*esdb.Position, error) {
+	event, err := GetLatestEventForStreamType(ctx, esdbClient, streamType)
+	if err != nil {
+		return nil, err
+	}
+
+	if event == nil {
+		return &esdb.Position{}, nil
+	}
+
+	return &event.Position, nil
+}
+
+// Returns the latest event of any stream of the given type, or nil if there is none
+func GetLatestEventForStreamType(ctx context.Context, esdbClient *esdb.Client, streamType events.Stream) (*esdb.RecordedEvent, error) {
 	opts := esdb.ReadAllOptions{
 		From:      esdb.End{},
 		Direction: esdb.Backwards,
@@ -198,7 +329,7 @@ func GetPositionOfLatestEventForStreamType(ctx context.Context, esdbClient *esdb
 		resolved, err := allStream.Recv()
 
 		if errors.Is(err, io.EOF) {
-			return &esdb.Position{}, nil
+			return nil, nil
 		}
 
 		if err != nil {
@@ -210,7 +341,7 @@ func GetPositionOfLatestEventForStreamType(ctx context.Context, esdbClient *esdb
 		}
 
 		if strings.HasPrefix(resolved.Event.StreamID, string(streamType)) {
-			return &resolved.Event.Position, nil
+			return resolved.Event, nil
 		}
 	}
 }
@@ -222,9 +353,10 @@ func HandleAllStreamWithRetry(
 	opts esdb.SubscribeToAllOptions,
 	handler func(esdb.RecordedEvent) error,
 ) error {
-	lastProcessedEvent := esdb.Position{}
-	retryCounter := 0
-	lastRetry := time.Now()
+	var lastProcessedEvent esdb.AllPosition = opts.From
+	if lastProcessedEvent == nil {
+		lastProcessedEvent = esdb.Start{}
+	}
 
 	handleEvent := func(event esdb.RecordedEvent) error {
 		if err := handler(event); err != nil {
@@ -236,10 +368,55 @@ func HandleAllStreamWithRetry(
 		return nil
 	}
 
-	handleStream := func() error {
+	return retryAllStream(ctx, logger, func() error {
 		opts.From = lastProcessedEvent
+		return HandleAllStream(ctx, esdbClient, opts, handleEvent)
+	})
+}
+
+/*
+Same as HandleAllStreamWithRetry, but the events are handled by a PartitionedHandler with the given number of workers.
+
+When resubscribing, the subscription continues from the lowest fully processed position.
+*/
+func HandlePartitionedAllStreamWithRetry(
+	ctx context.Context,
+	logger *slog.Logger,
+	esdbClient *esdb.Client,
+	opts esdb.SubscribeToAllOptions,
+	workers int,
+	handler func(esdb.RecordedEvent) error,
+	onCheckpoint func(esdb.RecordedEvent),
+) error {
+	var checkpoint esdb.AllPosition = opts.From
+	if checkpoint == nil {
+		checkpoint = esdb.Start{}
+	}
+
+	return retryAllStream(ctx, logger, func() error {
+		ph := NewPartitionedHandler(ctx, workers, handler, onCheckpoint)
+
+		opts.From = checkpoint
+		err := HandleAllStream(ctx, esdbClient, opts, ph.Dispatch)
+
+		if closeErr := ph.Close(); err == nil {
+			err = closeErr
+		}
+
+		if position := ph.Checkpoint(); position != (esdb.Position{}) {
+			checkpoint = position
+		}
+
+		return err
+	})
+}
+
+func retryAllStream(ctx context.Context, logger *slog.Logger, handleStream func() error) error {
+	retryCounter := 0
+	lastRetry := time.Now()
 
-		err := HandleAllStream(ctx, esdbClient, opts, handleEvent)
+	handleStreamWithRetry := func() error {
+		err := handleStream()
 		if err == nil {
 			return nil
 		}
@@ -271,58 +448,82 @@ func HandleAllStreamWithRetry(
 		case <-ctx.Done():
 			return nil
 		default:
-			if err := handleStream(); err != nil {
+			if err := handleStreamWithRetry(); err != nil {
 				return err
 			}
 		}
 	}
 }
 
-// This function is made to handle readiness and retry requirements
+type AllStreamsOfTypeOptions struct {
+	// Position from which the events should be handled, start of $all if nil
+	From esdb.AllPosition
+	// Number of workers, events of the same stream are always handled by the same worker
+	Workers int
+	// Called every time the checkpoint advances, can be nil
+	OnCheckpoint func(esdb.Position)
+	// Tracks the progress of the subscription, can be nil
+	Tracker *SubscriptionTracker
+}
+
+/*
+This function is made to handle readiness and retry requirements, readyChan can be nil.
+
+Events are handled by the given number of workers, events of the same stream are handled in order.
+*/
 func HandleAllStreamsOfType(
 	ctx context.Context,
 	logger *slog.Logger,
 	esdbClient *esdb.Client,
 	streamType events.Stream,
+	opts AllStreamsOfTypeOptions,
 	handler func(esdb.RecordedEvent) error,
 	readyChan chan<- struct{},
 ) error {
 	isReady := false
-	lastProcessedEvent := esdb.Position{}
 	notReadyUntil, err := GetPositionOfLatestEventForStreamType(ctx, esdbClient, streamType)
 	if err != nil {
 		return err
 	}
 
-	checkIfReady := func() {
-		if !isReady && lastProcessedEvent.Commit >= notReadyUntil.Commit {
-			readyChan <- struct{}{}
+	checkIfReady := func(checkpoint esdb.Position) {
+		if !isReady && readyChan != nil && checkpoint.Commit >= notReadyUntil.Commit {
+			select {
+			case readyChan <- struct{}{}:
+			case <-ctx.Done():
+			}
 			close(readyChan)
 			isReady = true
 			logger.Debug("ready signal sent", "function", "HandleAllStreamsOfType", "streamType", string(streamType))
 		}
 	}
 
-	handleEvent := func(event esdb.RecordedEvent) error {
-		if err := handler(event); err != nil {
-			return err
+	onCheckpoint := func(checkpoint esdb.RecordedEvent) {
+		if opts.OnCheckpoint != nil {
+			opts.OnCheckpoint(checkpoint.Position)
 		}
+		opts.Tracker.Processed(checkpoint)
+		checkIfReady(checkpoint.Position)
+	}
 
-		lastProcessedEvent = event.Position
-		checkIfReady()
-
-		return nil
+	if opts.From == nil {
+		opts.From = esdb.Start{}
 	}
+	opts.Tracker.Resumed(opts.From)
 
-	opts := esdb.SubscribeToAllOptions{
-		From: esdb.Start{},
+	sopts := esdb.SubscribeToAllOptions{
+		From: opts.From,
 		Filter: &esdb.SubscriptionFilter{
 			Type:     esdb.StreamFilterType,
 			Prefixes: []string{string(streamType)},
 		},
 	}
 
-	checkIfReady()
+	if from, ok := opts.From.(esdb.Position); ok {
+		checkIfReady(from)
+	} else {
+		checkIfReady(esdb.Position{})
+	}
 
-	return HandleAllStreamWithRetry(ctx, logger, esdbClient, opts, handleEvent)
+	return HandlePartitionedAllStreamWithRetry(ctx, logger, esdbClient, sopts, opts.Workers, handler, onCheckpoint)
 }
@@ -3,12 +3,23 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
 	"github.com/MatejaMaric/esdb-playground/aggregates"
 	"github.com/go-sql-driver/mysql"
 )
 
+// Querier is implemented by both *sql.DB and *sql.Tx
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 func ConnectToMariaDB() (*sql.DB, error) {
 	cfg := mysql.Config{
 		Net:                  "tcp",
@@ -17,6 +28,7 @@ func ConnectToMariaDB() (*sql.DB, error) {
 		User:                 "playground_user",
 		Passwd:               "playground_user_password",
 		AllowNativePasswords: true,
+		ParseTime:            true,
 	}
 
 	db, err := sql.Open("mysql", cfg.FormatDSN())
@@ -31,8 +43,17 @@ func ConnectToMariaDB() (*sql.DB, error) {
 	return db, nil
 }
 
-func InsertUser(ctx context.Context, db *sql.DB, user aggregates.User) (int64, error) {
-	result, err := db.ExecContext(ctx, "INSERT INTO users (username, email, login_count, version) VALUES (?, ?, ?, ?)", user.Username, user.Email, user.LoginCount, user.Version)
+// Returned when the user's username or email belongs to a different user of the table
+var ErrUserConflict = errors.New("user conflicts with another user")
+
+/*
+Inserting a user which already exists does nothing, so a replayed create event is safe to apply again.
+
+The duplicate key can also be the email, or a username differing only in case, of a different user.
+Such a user isn't merged into the existing one, ErrUserConflict is returned instead.
+*/
+func InsertUser(ctx context.Context, db Querier, user aggregates.User) (int64, error) {
+	result, err := db.ExecContext(ctx, "INSERT INTO users (username, email, login_count, version) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE username=username", user.Username, user.Email, user.LoginCount, user.Version)
 	if err != nil {
 		return 0, fmt.Errorf("failed to exec insert command: %w", err)
 	}
@@ -42,18 +63,21 @@ func InsertUser(ctx context.Context, db *sql.DB, user aggregates.User) (int64, e
 		return 0, fmt.Errorf("failed getting the last insert id: %w", err)
 	}
 
+	stored, err := GetUser(ctx, db, user.Username)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	if err != nil || stored.Username != user.Username || stored.Email != user.Email {
+		return 0, fmt.Errorf("failed to insert the user %s with the email %s: %w", user.Username, user.Email, ErrUserConflict)
+	}
+
 	return id, nil
 }
 
-func GetUser(ctx context.Context, db *sql.DB, username string) (aggregates.User, error) {
+func GetUser(ctx context.Context, db Querier, username string) (aggregates.User, error) {
 	var user aggregates.User
 
-	query, err := db.PrepareContext(ctx, "SELECT username, email, login_count, version FROM users WHERE username = ?")
-	if err != nil {
-		return user, fmt.Errorf("failed to prepare the statement: %w", err)
-	}
-
-	row := query.QueryRowContext(ctx, username)
+	row := db.QueryRowContext(ctx, "SELECT username, email, login_count, version FROM users WHERE username = ?", username)
 	if err := row.Scan(&user.Username, &user.Email, &user.LoginCount, &user.Version); err != nil {
 		return user, fmt.Errorf("failed to get the user %s: %w", username, err)
 	}
@@ -85,13 +109,117 @@ func GetAllUsers(ctx context.Context, db *sql.DB) ([]aggregates.User, error) {
 	return users, nil
 }
 
-func UpdateUser(ctx context.Context, db *sql.DB, user aggregates.User) (int64, error) {
-	stmt, err := db.PrepareContext(ctx, "UPDATE users SET login_count=?, version=? WHERE username=?")
+type UserSort string
+
+const (
+	SortByUsername   UserSort = "username"
+	SortByLoginCount UserSort = "login_count"
+	SortByVersion    UserSort = "version"
+)
+
+// Position of the last user of a page, the next page starts after it
+type UserCursor struct {
+	// Value of the sorted column, unused when sorting by username
+	Value uint64
+	// Breaks the ties between users with the same value
+	Username string
+}
+
+type ListUsersOptions struct {
+	// SortByUsername when empty
+	Sort       UserSort
+	Descending bool
+	// Nil for the first page
+	After *UserCursor
+	Limit int
+	// Only users with an email inside the domain, any domain when empty
+	EmailDomain string
+	MinLogins   int32
+}
+
+/*
+Returns at most limit users in the order of the sorted column and the username, starting after the cursor.
+
+The cursor is compared with the indexed sorted column and username, so no page reads the users before it.
+*/
+func ListUsers(ctx context.Context, db Querier, opts ListUsersOptions) ([]aggregates.User, error) {
+	if opts.Sort == "" {
+		opts.Sort = SortByUsername
+	}
+
+	switch opts.Sort {
+	case SortByUsername, SortByLoginCount, SortByVersion:
+	default:
+		return nil, fmt.Errorf("unknown user sort: %s", opts.Sort)
+	}
+
+	direction, comparison := "ASC", ">"
+	if opts.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	var conditions []string
+	var args []any
+
+	if opts.EmailDomain != "" {
+		conditions = append(conditions, "email_domain = ?")
+		args = append(args, opts.EmailDomain)
+	}
+
+	if opts.MinLogins > 0 {
+		conditions = append(conditions, "login_count >= ?")
+		args = append(args, opts.MinLogins)
+	}
+
+	if opts.After != nil {
+		if opts.Sort == SortByUsername {
+			conditions = append(conditions, "username "+comparison+" ?")
+			args = append(args, opts.After.Username)
+		} else {
+			column := string(opts.Sort)
+			conditions = append(conditions, fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND username %[2]s ?))", column, comparison))
+			args = append(args, opts.After.Value, opts.After.Value, opts.After.Username)
+		}
+	}
+
+	query := "SELECT username, email, login_count, version FROM users"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	if opts.Sort == SortByUsername {
+		query += " ORDER BY username " + direction
+	} else {
+		query += fmt.Sprintf(" ORDER BY %s %s, username %s", opts.Sort, direction, direction)
+	}
+
+	query += " LIMIT ?"
+	args = append(args, opts.Limit)
+
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return 0, fmt.Errorf("failed to prepare the statement: %w", err)
+		return nil, fmt.Errorf("failed to select users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []aggregates.User{}
+	for rows.Next() {
+		var user aggregates.User
+		if err := rows.Scan(&user.Username, &user.Email, &user.LoginCount, &user.Version); err != nil {
+			return nil, fmt.Errorf("failed to scan the row: %w", err)
+		}
+		users = append(users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err(): %w", err)
 	}
 
-	result, err := stmt.ExecContext(ctx, user.LoginCount, user.Version, user.Username)
+	return users, nil
+}
+
+func UpdateUser(ctx context.Context, db Querier, user aggregates.User) (int64, error) {
+	result, err := db.ExecContext(ctx, "UPDATE users SET login_count=?, version=? WHERE username=?", user.LoginCount, user.Version, user.Username)
 	if err != nil {
 		return 0, fmt.Errorf("failed to exec update command: %w", err)
 	}
@@ -103,3 +231,177 @@ func UpdateUser(ctx context.Context, db *sql.DB, user aggregates.User) (int64, e
 
 	return num, nil
 }
+
+// Returns the users with the given usernames, mapped by their username
+func GetUsersByUsername(ctx context.Context, db Querier, usernames []string) (map[string]aggregates.User, error) {
+	users := make(map[string]aggregates.User, len(usernames))
+	if len(usernames) == 0 {
+		return users, nil
+	}
+
+	placeholders := strings.Repeat("?, ", len(usernames)-1) + "?"
+	args := make([]any, len(usernames))
+	for i, username := range usernames {
+		args[i] = username
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT username, email, login_count, version FROM users WHERE username IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select users: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user aggregates.User
+		if err := rows.Scan(&user.Username, &user.Email, &user.LoginCount, &user.Version); err != nil {
+			return nil, fmt.Errorf("failed to scan the row: %w", err)
+		}
+		users[user.Username] = user
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err(): %w", err)
+	}
+
+	return users, nil
+}
+
+/*
+Inserts the new users and updates the existing ones, each using a single statement.
+
+Only the username identifies an existing user, a new user whose email, or username differing only in case,
+belongs to a different user isn't merged into it, ErrUserConflict is returned instead.
+*/
+func UpsertUsers(ctx context.Context, db Querier, users []aggregates.User) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	usernames := make([]string, len(users))
+	for i, user := range users {
+		usernames[i] = user.Username
+	}
+
+	stored, err := GetUsersByUsername(ctx, db, usernames)
+	if err != nil {
+		return err
+	}
+
+	var inserted, updated []aggregates.User
+	for _, user := range users {
+		if existing, ok := stored[user.Username]; ok && existing.Email == user.Email {
+			updated = append(updated, user)
+		} else {
+			inserted = append(inserted, user)
+		}
+	}
+
+	if len(inserted) > 0 {
+		_, err := db.ExecContext(ctx, "INSERT INTO users (username, email, login_count, version) VALUES "+userPlaceholders(len(inserted)), userArgs(inserted)...)
+
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry {
+			return fmt.Errorf("failed to insert the users: %w: %w", ErrUserConflict, err)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to exec insert command: %w", err)
+		}
+	}
+
+	if len(updated) > 0 {
+		// Every row exists, so the duplicate key is always the username
+		query := "INSERT INTO users (username, email, login_count, version) VALUES " + userPlaceholders(len(updated)) +
+			" ON DUPLICATE KEY UPDATE login_count=VALUES(login_count), version=VALUES(version)"
+
+		if _, err := db.ExecContext(ctx, query, userArgs(updated)...); err != nil {
+			return fmt.Errorf("failed to exec upsert command: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Error number of the rows violating a unique key
+const mysqlDuplicateEntry uint16 = 1062
+
+func userPlaceholders(n int) string {
+	return strings.Repeat("(?, ?, ?, ?), ", n-1) + "(?, ?, ?, ?)"
+}
+
+func userArgs(users []aggregates.User) []any {
+	args := make([]any, 0, 4*len(users))
+	for _, user := range users {
+		args = append(args, user.Username, user.Email, user.LoginCount, user.Version)
+	}
+	return args
+}
+
+// Records the event which a projection skipped after failing to apply it, recording it again updates the error
+func SaveDeadLetter(ctx context.Context, db Querier, projection string, event esdb.RecordedEvent, cause error) error {
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO dead_letters (projection, stream_id, event_number, event_type, commit_position, prepare_position, error, failed_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE error=VALUES(error), failed_at=VALUES(failed_at)",
+		projection, event.StreamID, event.EventNumber, event.EventType, event.Position.Commit, event.Position.Prepare, cause.Error(), time.Now().UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save the dead letter of event %d of stream %s: %w", event.EventNumber, event.StreamID, err)
+	}
+
+	return nil
+}
+
+/*
+Returns the position stored for the named projection together with the version
+of the projection which stored it, or esdb.Start{} and version zero if there is none.
+*/
+func GetCheckpoint(ctx context.Context, db Querier, name string) (esdb.AllPosition, int, error) {
+	var position esdb.Position
+	var version int
+
+	row := db.QueryRowContext(ctx, "SELECT commit_position, prepare_position, version FROM checkpoints WHERE name = ?", name)
+	err := row.Scan(&position.Commit, &position.Prepare, &version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return esdb.Start{}, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get the checkpoint %s: %w", name, err)
+	}
+
+	return position, version, nil
+}
+
+func SaveCheckpoint(ctx context.Context, db Querier, name string, position esdb.Position, version int) error {
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO checkpoints (name, commit_position, prepare_position, version) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE commit_position=VALUES(commit_position), prepare_position=VALUES(prepare_position), version=VALUES(version)",
+		name, position.Commit, position.Prepare, version,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save the checkpoint %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// Deletes every row of the projection's tables together with its checkpoint, inside a single transaction
+func ResetProjection(ctx context.Context, sqlClient *sql.DB, name string, tables ...string) error {
+	tx, err := sqlClient.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range tables {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table); err != nil {
+			return fmt.Errorf("failed to delete rows of %s: %w", table, err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM checkpoints WHERE name = ?", name); err != nil {
+		return fmt.Errorf("failed to delete the checkpoint %s: %w", name, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit the transaction: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,254 @@
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MatejaMaric/esdb-playground/aggregates"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/go-test/deep"
+)
+
+func TestListUsers(t *testing.T) {
+	ctx := context.Background()
+
+	users := []aggregates.User{
+		{Username: "anna", Email: "anna@a.com", LoginCount: 3, Version: 4},
+		{Username: "bob", Email: "bob@b.com", LoginCount: 1, Version: 2},
+		{Username: "carl", Email: "carl@a.com", LoginCount: 3, Version: 5},
+		{Username: "dora", Email: "dora@b.com", LoginCount: 0, Version: 1},
+		{Username: "emil", Email: "emil@a.com", LoginCount: 7, Version: 8},
+	}
+	if err := db.UpsertUsers(ctx, TestSqlClient, users); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pages through the users two at a time, continuing after the last user of every page
+	listAll := func(opts db.ListUsersOptions, cursorValue func(aggregates.User) uint64) []string {
+		t.Helper()
+
+		var usernames []string
+		opts.Limit = 2
+
+		for {
+			page, err := db.ListUsers(ctx, TestSqlClient, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, user := range page {
+				usernames = append(usernames, user.Username)
+			}
+
+			if len(page) < opts.Limit {
+				return usernames
+			}
+
+			last := page[len(page)-1]
+			opts.After = &db.UserCursor{Value: cursorValue(last), Username: last.Username}
+		}
+	}
+
+	byUsername := func(aggregates.User) uint64 { return 0 }
+	byLogins := func(user aggregates.User) uint64 { return uint64(user.LoginCount) }
+	byVersion := func(user aggregates.User) uint64 { return user.Version }
+
+	testCases := []struct {
+		name     string
+		opts     db.ListUsersOptions
+		value    func(aggregates.User) uint64
+		expected []string
+	}{
+		{"username", db.ListUsersOptions{}, byUsername, []string{"anna", "bob", "carl", "dora", "emil"}},
+		{"username descending", db.ListUsersOptions{Descending: true}, byUsername, []string{"emil", "dora", "carl", "bob", "anna"}},
+		{"login count", db.ListUsersOptions{Sort: db.SortByLoginCount}, byLogins, []string{"dora", "bob", "anna", "carl", "emil"}},
+		{"login count descending", db.ListUsersOptions{Sort: db.SortByLoginCount, Descending: true}, byLogins, []string{"emil", "carl", "anna", "bob", "dora"}},
+		{"version", db.ListUsersOptions{Sort: db.SortByVersion}, byVersion, []string{"dora", "bob", "anna", "carl", "emil"}},
+		{"email domain", db.ListUsersOptions{EmailDomain: "a.com"}, byUsername, []string{"anna", "carl", "emil"}},
+		{"min logins", db.ListUsersOptions{Sort: db.SortByLoginCount, MinLogins: 3}, byLogins, []string{"anna", "carl", "emil"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := deep.Equal(tc.expected, listAll(tc.opts, tc.value)); diff != nil {
+				t.Fatalf("unexpected users:\n%v\n", strings.Join(diff, "\n"))
+			}
+		})
+	}
+}
+
+func TestInsertUserTwice(t *testing.T) {
+	ctx := context.Background()
+
+	t.Cleanup(func() {
+		if _, err := TestSqlClient.ExecContext(ctx, "DELETE FROM users WHERE username = ?", "twice"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	user := aggregates.User{Username: "twice", Email: "twice@test.com", LoginCount: 0, Version: 0}
+
+	for i := 0; i < 2; i++ {
+		if _, err := db.InsertUser(ctx, TestSqlClient, user); err != nil {
+			t.Fatalf("insert %d: %v", i+1, err)
+		}
+	}
+
+	stored, err := db.GetUser(ctx, TestSqlClient, user.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := deep.Equal(user, stored); diff != nil {
+		t.Fatalf("unexpected user:\n%v\n", strings.Join(diff, "\n"))
+	}
+
+	// Users with the same email, or a username differing only in case, aren't merged into the existing one
+	for _, conflicting := range []aggregates.User{
+		{Username: "thrice", Email: "twice@test.com"},
+		{Username: "thrice", Email: "TWICE@test.com"},
+		{Username: "Twice", Email: "other-twice@test.com"},
+	} {
+		if _, err := db.InsertUser(ctx, TestSqlClient, conflicting); !errors.Is(err, db.ErrUserConflict) {
+			t.Fatalf("expected a conflict inserting %v, got %v", conflicting, err)
+		}
+	}
+
+	if _, err := db.GetUser(ctx, TestSqlClient, "thrice"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("the conflicting user was inserted: %v", err)
+	}
+}
+
+func TestUpsertUsersConflict(t *testing.T) {
+	ctx := context.Background()
+
+	t.Cleanup(func() {
+		if _, err := TestSqlClient.ExecContext(ctx, "DELETE FROM users WHERE username IN (?, ?)", "upserted", "newcomer"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	existing := aggregates.User{Username: "upserted", Email: "upserted@test.com", LoginCount: 1, Version: 1}
+	if err := db.UpsertUsers(ctx, TestSqlClient, []aggregates.User{existing}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new user with the email of the existing one doesn't overwrite its row
+	newcomer := aggregates.User{Username: "newcomer", Email: "UPSERTED@test.com", LoginCount: 7, Version: 7}
+	existing.LoginCount, existing.Version = 2, 2
+
+	if err := db.UpsertUsers(ctx, TestSqlClient, []aggregates.User{existing, newcomer}); !errors.Is(err, db.ErrUserConflict) {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+
+	stored, err := db.GetUser(ctx, TestSqlClient, existing.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.LoginCount != 2 || stored.Version != 2 {
+		t.Fatalf("unexpected existing user %v", stored)
+	}
+
+	if _, err := db.GetUser(ctx, TestSqlClient, newcomer.Username); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("the conflicting user was inserted: %v", err)
+	}
+}
+
+// The schema of the users table before the read models were added, which the migrations upgrade
+const baselineSchema string = `CREATE TABLE users(
+    username VARCHAR(255),
+    email VARCHAR(255) NOT NULL UNIQUE,
+    login_count INT NOT NULL DEFAULT 0,
+    version BIGINT NOT NULL,
+    CONSTRAINT PRIMARY KEY (username)
+);`
+
+// Describes the columns and indexes of every table of the current database
+func describeSchema(t *testing.T, ctx context.Context, conn *sql.Conn) []string {
+	t.Helper()
+
+	rows, err := conn.QueryContext(ctx, `
+		SELECT CONCAT_WS(' ', table_name, column_name, column_type, is_nullable, IFNULL(collation_name, ''), IFNULL(column_default, ''))
+		FROM information_schema.columns WHERE table_schema = DATABASE()
+		UNION ALL
+		SELECT CONCAT_WS(' ', table_name, 'index', index_name, non_unique, GROUP_CONCAT(column_name ORDER BY seq_in_index))
+		FROM information_schema.statistics WHERE table_schema = DATABASE() GROUP BY table_name, index_name, non_unique
+		ORDER BY 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var schema []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			t.Fatal(err)
+		}
+		schema = append(schema, line)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return schema
+}
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+
+	// USE only applies to the connection, so the databases are only used through it
+	conn, err := TestSqlClient.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Cleanup(func() {
+		if _, err := conn.ExecContext(ctx, "USE projected_models; DROP DATABASE IF EXISTS migrated; DROP DATABASE IF EXISTS created"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	base, err := os.ReadFile("../initdb.d/base.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = conn.ExecContext(ctx, "CREATE DATABASE created; USE created; "+strings.Replace(string(base), "USE projected_models;", "", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := describeSchema(t, ctx, conn)
+
+	if _, err := conn.ExecContext(ctx, "CREATE DATABASE migrated; USE migrated; "+baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+
+	migrations, err := filepath.Glob("../migrations/*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Applying them again to the upgraded database must not change anything
+	for i := 0; i < 2; i++ {
+		for _, migration := range migrations {
+			script, err := os.ReadFile(migration)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.ExecContext(ctx, string(script)); err != nil {
+				t.Fatalf("%s: %v", migration, err)
+			}
+		}
+
+		if diff := deep.Equal(expected, describeSchema(t, ctx, conn)); diff != nil {
+			t.Fatalf("the migrated schema differs from the created one:\n%v\n", strings.Join(diff, "\n"))
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/events"
+)
+
+// Maximum number of events read from $all when counting the lag of a subscription to a stream type
+const lagScanLimit uint64 = 10000
+
+type SubscriptionStatus struct {
+	Name string `json:"name"`
+	// Stream type (for subscriptions to $all) or stream name the subscription handles
+	Source string `json:"source"`
+
+	LastPosition     esdb.Position `json:"last_position"`
+	LastEventNumber  uint64        `json:"last_event_number"`
+	LastEventCreated time.Time     `json:"last_event_created"`
+	LastProcessedAt  time.Time     `json:"last_processed_at"`
+
+	HeadPosition     esdb.Position `json:"head_position"`
+	HeadEventCreated time.Time     `json:"head_event_created"`
+
+	// Number of events which weren't processed yet
+	LagEvents uint64 `json:"lag_events"`
+	// True if there are more unprocessed events than LagEvents
+	LagEventsCapped bool `json:"lag_events_capped"`
+	// For how long the oldest unprocessed event is waiting
+	LagSeconds float64 `json:"lag_seconds"`
+
+	SampledAt   time.Time `json:"sampled_at"`
+	SampleError string    `json:"sample_error,omitempty"`
+}
+
+// Tracks the progress of a single subscription, the nil tracker ignores everything
+type SubscriptionTracker struct {
+	streamType events.Stream
+	streamName string
+
+	mu        sync.Mutex
+	processed bool
+	status    SubscriptionStatus
+}
+
+// Records the event as the last processed event of the subscription
+func (t *SubscriptionTracker) Processed(event esdb.RecordedEvent) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.processed = true
+	t.status.LastPosition = event.Position
+	t.status.LastEventNumber = event.EventNumber
+	t.status.LastEventCreated = event.CreatedDate
+	t.status.LastProcessedAt = time.Now()
+}
+
+/*
+Records the checkpoint from which a subscription to a stream type resumes, so the lag only counts the events after it.
+
+The start of $all is ignored, as are the positions behind an already processed event.
+*/
+func (t *SubscriptionTracker) Resumed(from esdb.AllPosition) {
+	if t == nil || t.streamName != "" {
+		return
+	}
+
+	position, ok := from.(esdb.Position)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.processed && t.status.LastPosition.Commit >= position.Commit {
+		return
+	}
+
+	t.processed = true
+	t.status.LastPosition = position
+}
+
+func (t *SubscriptionTracker) Status() SubscriptionStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.status
+}
+
+func (t *SubscriptionTracker) last() (esdb.RecordedEvent, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return esdb.RecordedEvent{
+		Position:    t.status.LastPosition,
+		EventNumber: t.status.LastEventNumber,
+		CreatedDate: t.status.LastEventCreated,
+	}, t.processed
+}
+
+// Samples the head of the subscribed stream(s) and computes the lag of the subscription
+func (t *SubscriptionTracker) sample(ctx context.Context, esdbClient *esdb.Client) {
+	last, processed := t.last()
+
+	var sampled SubscriptionStatus
+	var err error
+	if t.streamName != "" {
+		sampled, err = sampleStream(ctx, esdbClient, t.streamName, last, processed)
+	} else {
+		sampled, err = sampleStreamType(ctx, esdbClient, t.streamType, last, processed)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.status.SampledAt = time.Now()
+	t.status.SampleError = ""
+	if err != nil {
+		t.status.SampleError = err.Error()
+		return
+	}
+
+	t.status.HeadPosition = sampled.HeadPosition
+	t.status.HeadEventCreated = sampled.HeadEventCreated
+	t.status.LagEvents = sampled.LagEvents
+	t.status.LagEventsCapped = sampled.LagEventsCapped
+	t.status.LagSeconds = sampled.LagSeconds
+}
+
+func sampleStream(ctx context.Context, esdbClient *esdb.Client, streamName string, last esdb.RecordedEvent, processed bool) (SubscriptionStatus, error) {
+	var sampled SubscriptionStatus
+
+	head, err := GetLatestEventOfStream(ctx, esdbClient, streamName)
+	if IsErrorCode(err, esdb.ErrorCodeResourceNotFound) {
+		return sampled, nil
+	}
+	if err != nil {
+		return sampled, err
+	}
+
+	sampled.HeadPosition = head.Position
+	sampled.HeadEventCreated = head.CreatedDate
+
+	next := uint64(0)
+	if processed {
+		next = last.EventNumber + 1
+	}
+
+	if head.EventNumber < next {
+		return sampled, nil
+	}
+
+	sampled.LagEvents = head.EventNumber - next + 1
+
+	ropts := esdb.ReadStreamOptions{
+		From:      esdb.Revision(next),
+		Direction: esdb.Forwards,
+	}
+
+	stream, err := esdbClient.ReadStream(ctx, streamName, ropts, 1)
+	if err != nil {
+		return sampled, err
+	}
+	defer stream.Close()
+
+	resolved, err := stream.Recv()
+	if err != nil {
+		return sampled, err
+	}
+
+	if resolved.Event != nil {
+		sampled.LagSeconds = time.Since(resolved.Event.CreatedDate).Seconds()
+	}
+
+	return sampled, nil
+}
+
+func sampleStreamType(ctx context.Context, esdbClient *esdb.Client, streamType events.Stream, last esdb.RecordedEvent, processed bool) (SubscriptionStatus, error) {
+	var sampled SubscriptionStatus
+
+	head, err := GetLatestEventForStreamType(ctx, esdbClient, streamType)
+	if err != nil {
+		return sampled, err
+	}
+
+	if head == nil {
+		return sampled, nil
+	}
+
+	sampled.HeadPosition = head.Position
+	sampled.HeadEventCreated = head.CreatedDate
+
+	if processed && last.Position.Commit >= head.Position.Commit {
+		return sampled, nil
+	}
+
+	var from esdb.AllPosition = esdb.Start{}
+	if processed {
+		from = last.Position
+	}
+
+	allStream, err := esdbClient.ReadAll(ctx, esdb.ReadAllOptions{From: from, Direction: esdb.Forwards}, lagScanLimit)
+	if err != nil {
+		return sampled, err
+	}
+	defer allStream.Close()
+
+	scanned := uint64(0)
+	for {
+		resolved, err := allStream.Recv()
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return sampled, err
+		}
+
+		scanned++
+
+		if resolved.Event == nil || !strings.HasPrefix(resolved.Event.StreamID, string(streamType)) {
+			continue
+		}
+
+		if processed && resolved.Event.Position.Commit <= last.Position.Commit {
+			continue
+		}
+
+		if sampled.LagEvents == 0 {
+			sampled.LagSeconds = time.Since(resolved.Event.CreatedDate).Seconds()
+		}
+
+		sampled.LagEvents++
+
+		if resolved.Event.Position.Commit >= head.Position.Commit {
+			break
+		}
+	}
+
+	sampled.LagEventsCapped = scanned >= lagScanLimit
+
+	return sampled, nil
+}
+
+// Monitor keeps track of subscriptions and periodically samples their lag, the nil monitor tracks nothing
+type Monitor struct {
+	mu          sync.Mutex
+	trackers    map[string]*SubscriptionTracker
+	checkpoints map[string]*ProjectionCheckpoint
+}
+
+func NewMonitor() *Monitor {
+	return &Monitor{
+		trackers:    map[string]*SubscriptionTracker{},
+		checkpoints: map[string]*ProjectionCheckpoint{},
+	}
+}
+
+// Returns the checkpoint of the named projection, creating it if needed
+func (m *Monitor) Checkpoint(name string) *ProjectionCheckpoint {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	checkpoint, ok := m.checkpoints[name]
+	if !ok {
+		checkpoint = NewProjectionCheckpoint()
+		m.checkpoints[name] = checkpoint
+	}
+
+	return checkpoint
+}
+
+// Returns the tracker for a subscription to all streams of the given type
+func (m *Monitor) TrackStreamType(name string, streamType events.Stream) *SubscriptionTracker {
+	return m.track(name, &SubscriptionTracker{streamType: streamType, status: SubscriptionStatus{Name: name, Source: string(streamType)}})
+}
+
+// Returns the tracker for a subscription to a single stream
+func (m *Monitor) TrackStream(name string, streamName string) *SubscriptionTracker {
+	return m.track(name, &SubscriptionTracker{streamName: streamName, status: SubscriptionStatus{Name: name, Source: streamName}})
+}
+
+func (m *Monitor) track(name string, tracker *SubscriptionTracker) *SubscriptionTracker {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.trackers[name] = tracker
+
+	return tracker
+}
+
+func (m *Monitor) trackerList() []*SubscriptionTracker {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	trackers := make([]*SubscriptionTracker, 0, len(m.trackers))
+	for _, tracker := range m.trackers {
+		trackers = append(trackers, tracker)
+	}
+
+	sort.Slice(trackers, func(i, j int) bool {
+		return trackers[i].status.Name < trackers[j].status.Name
+	})
+
+	return trackers
+}
+
+// Returns the statuses of all the tracked subscriptions, sorted by name
+func (m *Monitor) Statuses() []SubscriptionStatus {
+	trackers := m.trackerList()
+
+	statuses := make([]SubscriptionStatus, len(trackers))
+	for i, tracker := range trackers {
+		statuses[i] = tracker.Status()
+	}
+
+	return statuses
+}
+
+// Samples the lag of all the tracked subscriptions every interval and logs their statuses
+func (m *Monitor) Run(ctx context.Context, logger *slog.Logger, esdbClient *esdb.Client, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			for _, tracker := range m.trackerList() {
+				tracker.sample(ctx, esdbClient)
+
+				status := tracker.Status()
+				logger.Info("subscription status",
+					"name", status.Name,
+					"source", status.Source,
+					"lastCommitPosition", status.LastPosition.Commit,
+					"lastProcessedAt", status.LastProcessedAt,
+					"headCommitPosition", status.HeadPosition.Commit,
+					"lagEvents", status.LagEvents,
+					"lagEventsCapped", status.LagEventsCapped,
+					"lagSeconds", status.LagSeconds,
+					"sampleError", status.SampleError,
+				)
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package db_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+)
+
+func TestMonitorStatuses(t *testing.T) {
+	monitor := db.NewMonitor()
+
+	users := monitor.TrackStreamType("users", events.UserEventsStream)
+	monitor.TrackStream("reservations", string(events.ReservationStream))
+
+	created := time.Now().Add(-time.Minute)
+	users.Processed(esdb.RecordedEvent{Position: esdb.Position{Commit: 42, Prepare: 42}, CreatedDate: created})
+
+	statuses := monitor.Statuses()
+	if len(statuses) != 2 {
+		t.Fatalf("unexpected number of statuses: %d", len(statuses))
+	}
+
+	if statuses[0].Name != "reservations" || statuses[1].Name != "users" {
+		t.Fatalf("statuses are not sorted by name: %v", statuses)
+	}
+
+	if statuses[1].LastPosition.Commit != 42 || !statuses[1].LastEventCreated.Equal(created) {
+		t.Fatalf("unexpected users status: %+v", statuses[1])
+	}
+
+	var nilMonitor *db.Monitor
+	nilMonitor.TrackStream("ignored", "ignored").Processed(esdb.RecordedEvent{})
+}
+
+func TestTrackerResumedFromCheckpoint(t *testing.T) {
+	monitor := db.NewMonitor()
+	users := monitor.TrackStreamType("users", events.UserEventsStream)
+
+	users.Resumed(esdb.Start{})
+	if status := users.Status(); status.LastPosition.Commit != 0 {
+		t.Fatalf("the start of $all shouldn't seed the tracker: %+v", status)
+	}
+
+	users.Resumed(esdb.Position{Commit: 100, Prepare: 100})
+	if status := users.Status(); status.LastPosition.Commit != 100 {
+		t.Fatalf("the tracker wasn't seeded with the checkpoint: %+v", status)
+	}
+
+	users.Processed(esdb.RecordedEvent{Position: esdb.Position{Commit: 120, Prepare: 120}})
+	users.Resumed(esdb.Position{Commit: 110, Prepare: 110})
+	if status := users.Status(); status.LastPosition.Commit != 120 {
+		t.Fatalf("resuming moved the tracker back: %+v", status)
+	}
+}
@@ -0,0 +1,224 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+)
+
+const partitionBufferSize int = 64
+
+var ErrPartitionedHandlerClosed = errors.New("partitioned handler is closed")
+
+type pendingEvent struct {
+	event esdb.RecordedEvent
+	done  bool
+}
+
+/*
+PartitionedHandler fans events out to a fixed number of workers.
+
+Events are assigned to a worker by hashing their StreamID, so events of the
+same stream are always handled in order, by the same worker.
+*/
+type PartitionedHandler struct {
+	ctx          context.Context
+	handler      func(esdb.RecordedEvent) error
+	onCheckpoint func(esdb.RecordedEvent)
+	workers      []chan *partitionedEvent
+	wg           sync.WaitGroup
+	// Wakes the goroutine calling onCheckpoint, which is closed once the workers are done
+	advanced  chan struct{}
+	notified  chan struct{}
+	closeOnce sync.Once
+
+	mu         sync.Mutex
+	pending    []*pendingEvent
+	checkpoint esdb.RecordedEvent
+	err        error
+	failed     chan struct{}
+	closed     bool
+}
+
+type partitionedEvent struct {
+	event   esdb.RecordedEvent
+	pending *pendingEvent
+}
+
+/*
+Create a PartitionedHandler and start its workers.
+
+The onCheckpoint function (can be nil) is called with the checkpoint event every time the checkpoint advances.
+It's called by a single goroutine, so the workers don't wait for it, and it can skip the checkpoints
+which were already passed by the time it runs.
+*/
+func NewPartitionedHandler(
+	ctx context.Context,
+	workers int,
+	handler func(esdb.RecordedEvent) error,
+	onCheckpoint func(esdb.RecordedEvent),
+) *PartitionedHandler {
+	if workers < 1 {
+		workers = 1
+	}
+
+	ph := &PartitionedHandler{
+		ctx:          ctx,
+		handler:      handler,
+		onCheckpoint: onCheckpoint,
+		workers:      make([]chan *partitionedEvent, workers),
+		advanced:     make(chan struct{}, 1),
+		notified:     make(chan struct{}),
+		failed:       make(chan struct{}),
+	}
+
+	go ph.notifyCheckpoints()
+
+	for i := range ph.workers {
+		ph.workers[i] = make(chan *partitionedEvent, partitionBufferSize)
+		ph.wg.Add(1)
+		go ph.work(ph.workers[i])
+	}
+
+	return ph
+}
+
+func (ph *PartitionedHandler) partition(streamID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(streamID))
+	return int(h.Sum32() % uint32(len(ph.workers)))
+}
+
+// Dispatch hands the event to the worker responsible for its stream.
+func (ph *PartitionedHandler) Dispatch(event esdb.RecordedEvent) error {
+	ph.mu.Lock()
+	if ph.err != nil {
+		err := ph.err
+		ph.mu.Unlock()
+		return err
+	}
+	if ph.closed {
+		ph.mu.Unlock()
+		return ErrPartitionedHandlerClosed
+	}
+	pending := &pendingEvent{event: event}
+	ph.pending = append(ph.pending, pending)
+	ph.mu.Unlock()
+
+	select {
+	case ph.workers[ph.partition(event.StreamID)] <- &partitionedEvent{event, pending}:
+		return nil
+	case <-ph.failed:
+		return ph.Err()
+	case <-ph.ctx.Done():
+		return ph.ctx.Err()
+	}
+}
+
+func (ph *PartitionedHandler) work(events <-chan *partitionedEvent) {
+	defer ph.wg.Done()
+
+	for pe := range events {
+		if err := ph.handler(pe.event); err != nil {
+			ph.fail(fmt.Errorf("handling event %d of stream %s failed: %w", pe.event.EventNumber, pe.event.StreamID, err))
+			return
+		}
+
+		ph.markDone(pe.pending)
+	}
+}
+
+func (ph *PartitionedHandler) fail(err error) {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	if ph.err == nil {
+		ph.err = err
+		close(ph.failed)
+	}
+}
+
+func (ph *PartitionedHandler) markDone(pending *pendingEvent) {
+	ph.mu.Lock()
+	pending.done = true
+
+	advanced := false
+	for len(ph.pending) > 0 && ph.pending[0].done {
+		ph.checkpoint = ph.pending[0].event
+		ph.pending = ph.pending[1:]
+		advanced = true
+	}
+	ph.mu.Unlock()
+
+	if advanced {
+		select {
+		case ph.advanced <- struct{}{}:
+		default:
+			// The notifier is already woken up, it will see the latest checkpoint
+		}
+	}
+}
+
+// Calls onCheckpoint with the latest checkpoint every time it advances, until the workers are done
+func (ph *PartitionedHandler) notifyCheckpoints() {
+	defer close(ph.notified)
+
+	var notified esdb.Position
+	for range ph.advanced {
+		ph.mu.Lock()
+		checkpoint := ph.checkpoint
+		ph.mu.Unlock()
+
+		if ph.onCheckpoint == nil || checkpoint.Position == notified {
+			continue
+		}
+
+		ph.onCheckpoint(checkpoint)
+		notified = checkpoint.Position
+	}
+}
+
+/*
+Checkpoint returns the position of the latest event for which all the
+previously dispatched events were fully processed.
+*/
+func (ph *PartitionedHandler) Checkpoint() esdb.Position {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	return ph.checkpoint.Position
+}
+
+// Err returns the first error returned by any of the workers.
+func (ph *PartitionedHandler) Err() error {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	return ph.err
+}
+
+/*
+Close stops accepting new events and waits for the workers to finish
+processing the events that were already dispatched, and for onCheckpoint to see the last checkpoint.
+
+It must not be called concurrently with Dispatch.
+*/
+func (ph *PartitionedHandler) Close() error {
+	ph.mu.Lock()
+	if !ph.closed {
+		ph.closed = true
+		for _, worker := range ph.workers {
+			close(worker)
+		}
+	}
+	ph.mu.Unlock()
+
+	ph.wg.Wait()
+
+	ph.closeOnce.Do(func() { close(ph.advanced) })
+	<-ph.notified
+
+	return ph.Err()
+}
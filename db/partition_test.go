@@ -0,0 +1,135 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+)
+
+func fakePartitionedEvents(streams, eventsPerStream int) []esdb.RecordedEvent {
+	var res []esdb.RecordedEvent
+
+	commit := uint64(1)
+	for n := 0; n < eventsPerStream; n++ {
+		for s := 0; s < streams; s++ {
+			res = append(res, esdb.RecordedEvent{
+				StreamID:    fmt.Sprintf("user_events-%d", s),
+				EventNumber: uint64(n),
+				Position:    esdb.Position{Commit: commit, Prepare: commit},
+			})
+			commit++
+		}
+	}
+
+	return res
+}
+
+func TestPartitionedHandlerKeepsStreamOrder(t *testing.T) {
+	evs := fakePartitionedEvents(10, 50)
+
+	var mu sync.Mutex
+	lastEventNumbers := map[string]uint64{}
+
+	handler := func(event esdb.RecordedEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if last, ok := lastEventNumbers[event.StreamID]; ok && last+1 != event.EventNumber {
+			return fmt.Errorf("stream %s: got event %d after %d", event.StreamID, event.EventNumber, last)
+		}
+		lastEventNumbers[event.StreamID] = event.EventNumber
+
+		return nil
+	}
+
+	ph := db.NewPartitionedHandler(context.Background(), 4, handler, nil)
+
+	for _, event := range evs {
+		if err := ph.Dispatch(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ph.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if checkpoint := ph.Checkpoint(); checkpoint != evs[len(evs)-1].Position {
+		t.Fatalf("unexpected checkpoint %v, wanted %v", checkpoint, evs[len(evs)-1].Position)
+	}
+}
+
+func TestPartitionedHandlerCheckpointStopsAtFailure(t *testing.T) {
+	evs := fakePartitionedEvents(4, 10)
+	failAt := evs[13]
+
+	handler := func(event esdb.RecordedEvent) error {
+		if event.Position == failAt.Position {
+			return errors.New("failed on purpose")
+		}
+		time.Sleep(time.Millisecond)
+		return nil
+	}
+
+	ph := db.NewPartitionedHandler(context.Background(), 4, handler, nil)
+
+	for _, event := range evs {
+		if err := ph.Dispatch(event); err != nil {
+			break
+		}
+	}
+
+	if err := ph.Close(); err == nil {
+		t.Fatal("error expected from a failing handler")
+	}
+
+	if checkpoint := ph.Checkpoint(); checkpoint.Commit >= failAt.Position.Commit {
+		t.Fatalf("checkpoint %v advanced past the failed event %v", checkpoint, failAt.Position)
+	}
+}
+
+func TestPartitionedHandlerCheckpointCallback(t *testing.T) {
+	evs := fakePartitionedEvents(10, 20)
+
+	var ph *db.PartitionedHandler
+	var notified []esdb.Position
+
+	onCheckpoint := func(checkpoint esdb.RecordedEvent) {
+		// The workers keep going while the checkpoint is stored
+		time.Sleep(time.Millisecond)
+
+		// Called without holding the lock of the handler
+		if position := ph.Checkpoint(); position.Commit < checkpoint.Position.Commit {
+			t.Errorf("checkpoint %v is behind the notified %v", position, checkpoint.Position)
+		}
+		notified = append(notified, checkpoint.Position)
+	}
+
+	ph = db.NewPartitionedHandler(context.Background(), 4, func(esdb.RecordedEvent) error { return nil }, onCheckpoint)
+
+	for _, event := range evs {
+		if err := ph.Dispatch(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ph.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(notified) == 0 || notified[len(notified)-1] != evs[len(evs)-1].Position {
+		t.Fatalf("the last checkpoint wasn't notified, got %v", notified)
+	}
+
+	for i := 1; i < len(notified); i++ {
+		if notified[i].Commit <= notified[i-1].Commit {
+			t.Fatalf("checkpoint %v notified after %v", notified[i], notified[i-1])
+		}
+	}
+}
@@ -5,9 +5,22 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/aggregates"
 	"github.com/redis/go-redis/v9"
 )
 
+// Prefix of the Redis hashes holding the user read model
+const RedisUserKeyPrefix string = "users:"
+
+// Only overwrites the hash if the stored version is older
+var saveUserScript = redis.NewScript(`local version = redis.call('HGET', KEYS[1], 'version')
+if version and tonumber(version) >= tonumber(ARGV[4]) then
+    return 0
+end
+redis.call('HSET', KEYS[1], 'username', ARGV[1], 'email', ARGV[2], 'login_count', ARGV[3], 'version', ARGV[4])
+return 1`)
+
 func ConnectToRedis() (*redis.Client, error) {
 	opts, err := redis.ParseURL("redis://localhost:6379/")
 	if err != nil {
@@ -26,3 +39,94 @@ func ConnectToRedis() (*redis.Client, error) {
 
 	return client, nil
 }
+
+func RedisUserKey(username string) string {
+	return RedisUserKeyPrefix + username
+}
+
+// Returns the user stored inside Redis, the boolean is false if there is none
+func GetUserFromRedis(ctx context.Context, redisClient *redis.Client, username string) (aggregates.User, bool, error) {
+	var user aggregates.User
+
+	cmd := redisClient.HGetAll(ctx, RedisUserKey(username))
+	if err := cmd.Err(); err != nil {
+		return user, false, fmt.Errorf("failed to get the user %s from Redis: %w", username, err)
+	}
+
+	if len(cmd.Val()) == 0 {
+		return user, false, nil
+	}
+
+	if err := cmd.Scan(&user); err != nil {
+		return user, false, fmt.Errorf("failed to scan the user %s: %w", username, err)
+	}
+
+	return user, true, nil
+}
+
+// Stores the user inside Redis, unless a newer version is already stored
+func SaveUserToRedis(ctx context.Context, redisClient *redis.Client, user aggregates.User) (bool, error) {
+	res, err := saveUserScript.Run(ctx, redisClient, []string{RedisUserKey(user.Username)},
+		user.Username, user.Email, user.LoginCount, user.Version,
+	).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to save the user %s to Redis: %w", user.Username, err)
+	}
+
+	return res == 1, nil
+}
+
+// Prefix of the Redis hashes holding the checkpoints of the projections whose read model lives outside MariaDB
+const RedisCheckpointKeyPrefix string = "checkpoints:"
+
+func RedisCheckpointKey(name string) string {
+	return RedisCheckpointKeyPrefix + name
+}
+
+/*
+Returns the position stored inside Redis for the named projection together with the version
+of the projection which stored it, or esdb.Start{} and version zero if there is none.
+*/
+func GetRedisCheckpoint(ctx context.Context, redisClient *redis.Client, name string) (esdb.AllPosition, int, error) {
+	var checkpoint struct {
+		Commit  uint64 `redis:"commit_position"`
+		Prepare uint64 `redis:"prepare_position"`
+		Version int    `redis:"version"`
+	}
+
+	cmd := redisClient.HGetAll(ctx, RedisCheckpointKey(name))
+	if err := cmd.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to get the checkpoint %s from Redis: %w", name, err)
+	}
+
+	if len(cmd.Val()) == 0 {
+		return esdb.Start{}, 0, nil
+	}
+
+	if err := cmd.Scan(&checkpoint); err != nil {
+		return nil, 0, fmt.Errorf("failed to scan the checkpoint %s: %w", name, err)
+	}
+
+	return esdb.Position{Commit: checkpoint.Commit, Prepare: checkpoint.Prepare}, checkpoint.Version, nil
+}
+
+func SaveRedisCheckpoint(ctx context.Context, redisClient *redis.Client, name string, position esdb.Position, version int) error {
+	err := redisClient.HSet(ctx, RedisCheckpointKey(name),
+		"commit_position", position.Commit,
+		"prepare_position", position.Prepare,
+		"version", version,
+	).Err()
+	if err != nil {
+		return fmt.Errorf("failed to save the checkpoint %s to Redis: %w", name, err)
+	}
+
+	return nil
+}
+
+func DeleteRedisCheckpoint(ctx context.Context, redisClient *redis.Client, name string) error {
+	if err := redisClient.Del(ctx, RedisCheckpointKey(name)).Err(); err != nil {
+		return fmt.Errorf("failed to delete the checkpoint %s from Redis: %w", name, err)
+	}
+
+	return nil
+}
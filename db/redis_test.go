@@ -0,0 +1,80 @@
+package db_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/aggregates"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/go-test/deep"
+)
+
+func TestSaveUserToRedis(t *testing.T) {
+	ctx := context.Background()
+
+	newer := aggregates.User{Username: "redis", Email: "redis@test.com", LoginCount: 3, Version: 3}
+	older := aggregates.User{Username: "redis", Email: "redis@test.com", LoginCount: 1, Version: 1}
+
+	saved, err := db.SaveUserToRedis(ctx, TestRedisClient, newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved {
+		t.Fatal("expected the user to be saved")
+	}
+
+	saved, err = db.SaveUserToRedis(ctx, TestRedisClient, older)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved {
+		t.Fatal("older version of the user should not overwrite the newer one")
+	}
+
+	user, found, err := db.GetUserFromRedis(ctx, TestRedisClient, "redis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("expected the user to be found")
+	}
+
+	if diff := deep.Equal(newer, user); diff != nil {
+		t.Fatalf("unexpected user:\n%v\n", strings.Join(diff, "\n"))
+	}
+}
+
+func TestRedisCheckpoint(t *testing.T) {
+	ctx := context.Background()
+
+	from, version, err := db.GetRedisCheckpoint(ctx, TestRedisClient, "redis_checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != (esdb.Start{}) || version != 0 {
+		t.Fatalf("expected no checkpoint, got %v with version %d", from, version)
+	}
+
+	position := esdb.Position{Commit: 42, Prepare: 41}
+	if err := db.SaveRedisCheckpoint(ctx, TestRedisClient, "redis_checkpoint", position, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	from, version, err = db.GetRedisCheckpoint(ctx, TestRedisClient, "redis_checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != position || version != 2 {
+		t.Fatalf("expected %v with version 2, got %v with version %d", position, from, version)
+	}
+
+	if err := db.DeleteRedisCheckpoint(ctx, TestRedisClient, "redis_checkpoint"); err != nil {
+		t.Fatal(err)
+	}
+
+	if from, _, err := db.GetRedisCheckpoint(ctx, TestRedisClient, "redis_checkpoint"); err != nil || from != (esdb.Start{}) {
+		t.Fatalf("checkpoint should be removed, got %v (error: %v)", from, err)
+	}
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type TimelineEntry struct {
+	Username    string          `json:"username"`
+	EventNumber uint64          `json:"event_number"`
+	EventType   string          `json:"event_type"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Summary     string          `json:"summary"`
+	Metadata    json.RawMessage `json:"metadata"`
+}
+
+// Inserts the entry, entries which were already inserted are ignored
+func InsertTimelineEntry(ctx context.Context, db Querier, entry TimelineEntry) error {
+	_, err := db.ExecContext(ctx,
+		"INSERT IGNORE INTO user_timeline (username, event_number, event_type, created_at, summary, metadata) VALUES (?, ?, ?, ?, ?, ?)",
+		entry.Username, entry.EventNumber, entry.EventType, entry.CreatedAt.UTC(), entry.Summary, string(entry.Metadata),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert the timeline entry %d of %s: %w", entry.EventNumber, entry.Username, err)
+	}
+
+	return nil
+}
+
+// Returns at most limit entries of the user's timeline with an event number greater than after, nil after means from the beginning
+func GetTimeline(ctx context.Context, db Querier, username string, after *uint64, limit int) ([]TimelineEntry, error) {
+	query := "SELECT username, event_number, event_type, created_at, summary, metadata FROM user_timeline WHERE username = ?"
+	args := []any{username}
+
+	if after != nil {
+		query += " AND event_number > ?"
+		args = append(args, *after)
+	}
+
+	query += " ORDER BY event_number LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select the timeline of %s: %w", username, err)
+	}
+	defer rows.Close()
+
+	entries := []TimelineEntry{}
+	for rows.Next() {
+		var entry TimelineEntry
+		var metadata string
+		if err := rows.Scan(&entry.Username, &entry.EventNumber, &entry.EventType, &entry.CreatedAt, &entry.Summary, &metadata); err != nil {
+			return nil, fmt.Errorf("failed to scan the row: %w", err)
+		}
+		entry.Metadata = json.RawMessage(metadata)
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err(): %w", err)
+	}
+
+	return entries, nil
+}
@@ -3,6 +3,7 @@ package events
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
 	"github.com/gofrs/uuid"
@@ -14,19 +15,42 @@ const (
 	UserEventsStream  Stream = "user_events"
 	UserStateStream   Stream = "user_state"
 	ReservationStream Stream = "reservations"
+	// Streams of single reserved values, the prefix also matches the reservation streams
+	ReservationKeyStream Stream = "reservation"
+	// Streams of the registration sagas, one per registration
+	RegistrationStream Stream = "registration"
 )
 
 func (s Stream) ForUser(username string) string {
 	return fmt.Sprintf("%s-%s", s, username)
 }
 
+// Returns the username of a stream name created by ForUser
+func (s Stream) User(streamName string) (string, bool) {
+	return strings.CutPrefix(streamName, string(s)+"-")
+}
+
 type Event string
 
 const (
-	UserAggregate Event = "UserAggregate"
-	CreateUser    Event = "CreateUser"
-	LoginUser     Event = "LoginUser"
-	ReserveEmail  Event = "ReserveEmail"
+	UserAggregate   Event = "UserAggregate"
+	CreateUser      Event = "CreateUser"
+	LoginUser       Event = "LoginUser"
+	ChangeUserEmail Event = "ChangeUserEmail"
+	DeleteUser      Event = "DeleteUser"
+	// Written to the legacy reservations stream, before reservations had namespaces
+	ReserveEmail       Event = "ReserveEmail"
+	Reserve            Event = "Reserve"
+	ReleaseReservation Event = "ReleaseReservation"
+	// The lease of a saved reservation expired before it was persisted and the value was reserved again
+	ReservationExpired Event = "ReservationExpired"
+	// The reservation was confirmed, so it doesn't expire anymore
+	ReservationPersisted Event = "ReservationPersisted"
+	// Steps of the registration saga
+	RegistrationStarted     Event = "RegistrationStarted"
+	RegistrationUserCreated Event = "RegistrationUserCreated"
+	RegistrationConfirmed   Event = "RegistrationConfirmed"
+	RegistrationCompensated Event = "RegistrationCompensated"
 )
 
 type CreateUserEvent struct {
@@ -38,12 +62,37 @@ type LoginUserEvent struct {
 	Username string `json:"username"`
 }
 
+type ChangeUserEmailEvent struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+type DeleteUserEvent struct {
+	Username string `json:"username"`
+}
+
+// Namespace of the event IDs derived from idempotency keys
+var idempotencyNamespace = uuid.Must(uuid.FromString("1dbdd097-86c9-4b93-8142-3fd4b4df21cf"))
+
+/*
+Returns the event ID of the event appended to the stream by the request with the idempotency key.
+
+Retried appends get the same ID, so EventStoreDB writes the event only once.
+*/
+func IdempotentEventID(idempotencyKey string, streamName string) uuid.UUID {
+	return uuid.NewV5(idempotencyNamespace, streamName+"/"+idempotencyKey)
+}
+
 func Create(eventType Event, eventData any) (esdb.EventData, error) {
 	eventId, err := uuid.NewV4()
 	if err != nil {
 		return esdb.EventData{}, fmt.Errorf("failed to create a uuid: %w", err)
 	}
 
+	return CreateWithID(eventId, eventType, eventData)
+}
+
+func CreateWithID(eventId uuid.UUID, eventType Event, eventData any) (esdb.EventData, error) {
 	jsonData, err := json.Marshal(eventData)
 	if err != nil {
 		return esdb.EventData{}, fmt.Errorf("failed to marshal json: %w", err)
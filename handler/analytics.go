@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/projections"
+)
+
+// Parses a YYYY-MM-DD query parameter, returns the fallback if the parameter is missing
+func parseDateParam(req *http.Request, name string, fallback time.Time) (time.Time, error) {
+	query := req.URL.Query()
+	if !query.Has(name) {
+		return fallback, nil
+	}
+
+	date, err := time.Parse(time.DateOnly, query.Get(name))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("query parameter %s must be a YYYY-MM-DD date: %w", name, err)
+	}
+
+	return date, nil
+}
+
+// Parses the from and to query parameters, by default the range covers the last 30 days
+func parseDateRange(req *http.Request) (time.Time, time.Time, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	from, err := parseDateParam(req, "from", today.AddDate(0, 0, -30))
+	if err != nil {
+		return from, today, err
+	}
+
+	to, err := parseDateParam(req, "to", today)
+	if err != nil {
+		return from, to, err
+	}
+
+	if to.Before(from) {
+		return from, to, errors.New("query parameter to must not be before from")
+	}
+
+	return from, to, nil
+}
+
+func handleGetDailyActiveUsers(h *HttpHandlerContext, req *http.Request) (int, any, error) {
+	from, to, err := parseDateRange(req)
+	if err != nil {
+		return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "%s", err)
+	}
+
+	stale, err := waitForConsistency(h, req, projections.LoginsCheckpoint)
+	if err != nil {
+		return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "%s", err)
+	}
+	if stale != nil {
+		return http.StatusServiceUnavailable, stale, nil
+	}
+
+	dau, err := db.GetDailyActiveUsers(h.Ctx, h.SqlClient, from, to)
+	if err != nil {
+		return http.StatusInternalServerError, nil, fmt.Errorf("failed to get daily active users: %w", err)
+	}
+
+	return http.StatusOK, dau, nil
+}
+
+func handleGetUserLogins(h *HttpHandlerContext, req *http.Request) (int, any, error) {
+	username, err := requestUsername(req)
+	if err != nil {
+		return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "%s", err)
+	}
+
+	from, to, err := parseDateRange(req)
+	if err != nil {
+		return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "%s", err)
+	}
+
+	stale, err := waitForConsistency(h, req, projections.LoginsCheckpoint)
+	if err != nil {
+		return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "%s", err)
+	}
+	if stale != nil {
+		return http.StatusServiceUnavailable, stale, nil
+	}
+
+	logins, err := db.GetUserLogins(h.Ctx, h.SqlClient, username, from, to)
+	if err != nil {
+		return http.StatusInternalServerError, nil, fmt.Errorf("failed to get user logins: %w", err)
+	}
+
+	return http.StatusOK, logins, nil
+}
+
+func handleGetInactiveUsers(h *HttpHandlerContext, req *http.Request) (int, any, error) {
+	if !req.URL.Query().Has("since") {
+		return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "query parameter since is required")
+	}
+
+	since, err := parseDateParam(req, "since", time.Time{})
+	if err != nil {
+		return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "%s", err)
+	}
+
+	stale, err := waitForConsistency(h, req, projections.LoginsCheckpoint)
+	if err != nil {
+		return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "%s", err)
+	}
+	if stale != nil {
+		return http.StatusServiceUnavailable, stale, nil
+	}
+
+	users, err := db.GetInactiveUsers(h.Ctx, h.SqlClient, since)
+	if err != nil {
+		return http.StatusInternalServerError, nil, fmt.Errorf("failed to get inactive users: %w", err)
+	}
+
+	return http.StatusOK, users, nil
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+)
+
+const (
+	ConsistencyTokenHeader string = "X-Consistency-Token"
+	ConsistencyTokenParam  string = "consistency_token"
+)
+
+// How long a read waits for a projection to reach the consistency token
+const consistencyTimeout time.Duration = 3 * time.Second
+
+// Returned by commands, the token can be passed to reads to see the effects of the command
+type CommandResult struct {
+	ConsistencyToken string `json:"consistency_token"`
+}
+
+// Returned by reads when the projection didn't reach the consistency token in time
+type StaleResult struct {
+	Status           string `json:"status"`
+	Projection       string `json:"projection"`
+	ConsistencyToken string `json:"consistency_token"`
+	Checkpoint       string `json:"checkpoint"`
+}
+
+func newCommandResult(wr *esdb.WriteResult) CommandResult {
+	return CommandResult{
+		ConsistencyToken: strconv.FormatUint(wr.CommitPosition, 10),
+	}
+}
+
+// Reads the consistency token from the header or the query parameter
+func parseConsistencyToken(req *http.Request) (uint64, bool, error) {
+	token := req.Header.Get(ConsistencyTokenHeader)
+	if token == "" {
+		token = req.URL.Query().Get(ConsistencyTokenParam)
+	}
+
+	if token == "" {
+		return 0, false, nil
+	}
+
+	commit, err := strconv.ParseUint(token, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid consistency token %q: %w", token, err)
+	}
+
+	return commit, true, nil
+}
+
+/*
+Wait until the projection's checkpoint reaches the consistency token of the request.
+
+When the wait times out, the returned stale result should be sent to the client.
+*/
+func waitForConsistency(h *HttpHandlerContext, req *http.Request, projection string) (*StaleResult, error) {
+	commit, ok, err := parseConsistencyToken(req)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	checkpoint := h.Monitor.Checkpoint(projection)
+
+	ctx, cancel := context.WithTimeout(req.Context(), consistencyTimeout)
+	defer cancel()
+
+	err = checkpoint.Wait(ctx, commit)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &StaleResult{
+			Status:           "stale",
+			Projection:       projection,
+			ConsistencyToken: strconv.FormatUint(commit, 10),
+			Checkpoint:       strconv.FormatUint(checkpoint.Position().Commit, 10),
+		}, nil
+	}
+
+	return nil, err
+}
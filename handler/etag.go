@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+)
+
+// The entity tag of a user is the revision of its stream, it changes with every event of the user
+func revisionETag(revision uint64) string {
+	return strconv.Quote(strconv.FormatUint(revision, 10))
+}
+
+func withETag(body any, revision uint64) ResultWithHeaders {
+	return ResultWithHeaders{
+		Header: http.Header{"Etag": []string{revisionETag(revision)}},
+		Body:   body,
+	}
+}
+
+// Condition of the If-Match header, see RFC 9110
+type ifMatch struct {
+	// The request has the header
+	conditional bool
+	// "*", any current revision matches
+	any bool
+	// Revisions of the strong entity tags, the weak tags and the tags which aren't revisions never match
+	revisions []uint64
+}
+
+var errInvalidIfMatch = errors.New("header If-Match must be \"*\" or a list of ETags")
+
+// Parses all the If-Match headers of the request, which hold "*" or a comma separated list of entity tags
+func parseIfMatch(req *http.Request) (ifMatch, error) {
+	var condition ifMatch
+	// Count of all the entity tags, including the weak ones and the ones which aren't revisions
+	tags := 0
+
+	for _, header := range req.Header.Values("If-Match") {
+		rest := header
+		for {
+			rest = strings.TrimLeft(rest, " \t,")
+			if rest == "" {
+				break
+			}
+
+			condition.conditional = true
+
+			if strings.HasPrefix(rest, "*") {
+				condition.any = true
+				rest = rest[1:]
+				if after := strings.TrimLeft(rest, " \t"); after != "" && after[0] != ',' {
+					return ifMatch{}, errInvalidIfMatch
+				}
+				continue
+			}
+
+			weak := strings.HasPrefix(rest, "W/")
+			rest = strings.TrimPrefix(rest, "W/")
+
+			if !strings.HasPrefix(rest, "\"") {
+				return ifMatch{}, errInvalidIfMatch
+			}
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return ifMatch{}, errInvalidIfMatch
+			}
+			tag := rest[1 : end+1]
+			rest = rest[end+2:]
+
+			if after := strings.TrimLeft(rest, " \t"); after != "" && after[0] != ',' {
+				return ifMatch{}, errInvalidIfMatch
+			}
+
+			tags++
+
+			// The strong comparison is used, so the weak tags never match
+			if revision, err := strconv.ParseUint(tag, 10, 64); err == nil && !weak {
+				condition.revisions = append(condition.revisions, revision)
+			}
+		}
+	}
+
+	// "*" stands alone, also across the header lines
+	if condition.any && tags > 0 {
+		return ifMatch{}, errInvalidIfMatch
+	}
+
+	return condition, nil
+}
+
+/*
+Returns the revision the stream has to be at for the condition to hold, false if it can't hold.
+
+A single revision is checked by the append, for a list the current revision of the stream is looked up.
+*/
+func (m ifMatch) expectedRevision(ctx context.Context, esdbClient *esdb.Client, streamName string) (esdb.ExpectedRevision, bool, error) {
+	switch {
+	case m.any:
+		return esdb.StreamExists{}, true, nil
+	case len(m.revisions) == 0:
+		return nil, false, nil
+	case len(m.revisions) == 1:
+		return esdb.Revision(m.revisions[0]), true, nil
+	}
+
+	current, err := db.GetStreamRevision(ctx, esdbClient, streamName)
+	if db.IsErrorCode(err, esdb.ErrorCodeResourceNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !slices.Contains(m.revisions, current) {
+		return nil, false, nil
+	}
+
+	return esdb.Revision(current), true, nil
+}
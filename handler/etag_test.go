@@ -0,0 +1,75 @@
+package handler_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+)
+
+func TestIfMatch(t *testing.T) {
+	ctx := context.Background()
+
+	user := events.CreateUserEvent{Username: "etag", Email: "etag@test.com"}
+	if _, err := db.AppendCreateUserEvent(ctx, TestEsdbClient, user, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Revision of the user stream, every successful login advances it
+	var revision uint64
+
+	tests := []struct {
+		name    string
+		ifMatch func(revision uint64) []string
+		status  int
+	}{
+		{name: "no header", ifMatch: func(uint64) []string { return nil }, status: http.StatusCreated},
+		{name: "current", ifMatch: func(r uint64) []string { return []string{fmt.Sprintf(`"%d"`, r)} }, status: http.StatusCreated},
+		{name: "stale", ifMatch: func(r uint64) []string { return []string{fmt.Sprintf(`"%d"`, r-1)} }, status: http.StatusPreconditionFailed},
+		{name: "weak current", ifMatch: func(r uint64) []string { return []string{fmt.Sprintf(`W/"%d"`, r)} }, status: http.StatusPreconditionFailed},
+		{name: "list with current", ifMatch: func(r uint64) []string { return []string{fmt.Sprintf(`"%d", W/"%d", "%d"`, r+5, r, r)} }, status: http.StatusCreated},
+		{name: "headers with current", ifMatch: func(r uint64) []string { return []string{fmt.Sprintf(`"%d"`, r+5), fmt.Sprintf(`"%d"`, r)} }, status: http.StatusCreated},
+		{name: "list without current", ifMatch: func(r uint64) []string { return []string{fmt.Sprintf(`"%d", "%d"`, r+1, r+2)} }, status: http.StatusPreconditionFailed},
+		{name: "foreign tag", ifMatch: func(uint64) []string { return []string{`"abc"`} }, status: http.StatusPreconditionFailed},
+		{name: "any", ifMatch: func(uint64) []string { return []string{"*"} }, status: http.StatusCreated},
+		{name: "unquoted", ifMatch: func(r uint64) []string { return []string{strconv.FormatUint(r, 10)} }, status: http.StatusBadRequest},
+		{name: "any with a tag", ifMatch: func(r uint64) []string { return []string{fmt.Sprintf(`*, "%d"`, r)} }, status: http.StatusBadRequest},
+		{name: "any with a weak tag", ifMatch: func(r uint64) []string { return []string{fmt.Sprintf(`W/"%d", *`, r)} }, status: http.StatusBadRequest},
+		{name: "any with a foreign tag", ifMatch: func(uint64) []string { return []string{`*, "abc"`} }, status: http.StatusBadRequest},
+		{name: "headers with any and a tag", ifMatch: func(r uint64) []string { return []string{"*", fmt.Sprintf(`"%d"`, r)} }, status: http.StatusBadRequest},
+		{name: "any with trailing characters", ifMatch: func(uint64) []string { return []string{"*abc"} }, status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/users/etag/logins", nil)
+		for _, value := range test.ifMatch(revision) {
+			req.Header.Add("If-Match", value)
+		}
+
+		res := serve(req)
+		if res.Code != test.status {
+			t.Fatalf("%s: expected status %d, got %d: %s", test.name, test.status, res.Code, res.Body)
+		}
+
+		if res.Code != http.StatusCreated {
+			continue
+		}
+
+		revision++
+		if etag := res.Header().Get("Etag"); etag != strconv.Quote(strconv.FormatUint(revision, 10)) {
+			t.Fatalf("%s: unexpected ETag %s at revision %d", test.name, etag, revision)
+		}
+	}
+
+	// A list is compared with the current revision, a user without one can't match it
+	req := httptest.NewRequest(http.MethodPost, "/users/nobody/logins", nil)
+	req.Header.Set("If-Match", `"0", "1"`)
+	if res := serve(req); res.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected status %d for a missing user, got %d", http.StatusPreconditionFailed, res.Code)
+	}
+}
@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+)
+
+const (
+	EventStreamContentType string = "text/event-stream"
+	LastEventIDHeader      string = "Last-Event-ID"
+)
+
+// Comments are sent this often, so proxies and clients don't close an idle stream
+const heartbeatInterval time.Duration = 15 * time.Second
+
+// Returns the revision after which the stream continues, the start of the stream if there is no header
+func parseLastEventID(req *http.Request) (esdb.StreamPosition, error) {
+	lastEventID := strings.TrimSpace(req.Header.Get(LastEventIDHeader))
+	if lastEventID == "" {
+		return esdb.Start{}, nil
+	}
+
+	revision, err := strconv.ParseUint(lastEventID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("header %s must be the event number of the last received event", LastEventIDHeader)
+	}
+
+	return esdb.Revision(revision), nil
+}
+
+/*
+Streams the events of the user as server-sent events, replaying the previous events before the live ones.
+
+The ID of every event is its event number, a reconnecting client continues after the one of its Last-Event-ID header.
+The stream ends when the client disconnects, the server shuts down or the subscription is dropped.
+*/
+func handleStreamUserEvents(h *HttpHandlerContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		username := req.PathValue("username")
+		streamName := events.UserEventsStream.ForUser(username)
+
+		from, err := parseLastEventID(req)
+		if err != nil {
+			writeError(h, w, req, http.StatusBadRequest, problem(CodeInvalidRequest, "%s", err))
+			return
+		}
+
+		// The subscription would wait for a stream which doesn't exist
+		_, err = db.GetStreamRevision(req.Context(), h.EsdbClient, streamName)
+		if db.IsErrorCode(err, esdb.ErrorCodeResourceNotFound) {
+			writeError(h, w, req, http.StatusNotFound, problem(CodeUserNotFound, "user %s does not exist", username))
+			return
+		}
+		if err != nil {
+			writeError(h, w, req, http.StatusInternalServerError, fmt.Errorf("failed to get the stream revision: %w", err))
+			return
+		}
+
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		stop := context.AfterFunc(h.Ctx, cancel)
+		defer stop()
+
+		subscription, err := h.EsdbClient.SubscribeToStream(ctx, streamName, esdb.SubscribeToStreamOptions{From: from})
+		if err != nil {
+			writeError(h, w, req, http.StatusInternalServerError, fmt.Errorf("failed to subscribe to stream %s: %w", streamName, err))
+			return
+		}
+		defer subscription.Close()
+
+		recorded := make(chan esdb.RecordedEvent)
+		dropped := make(chan error, 1)
+		go func() {
+			dropped <- db.HandleSubscription(subscription, func(event esdb.RecordedEvent) error {
+				select {
+				case recorded <- event:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		}()
+
+		rc := http.NewResponseController(w)
+
+		w.Header().Set("Content-Type", EventStreamContentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			h.Log.Warn("failed to flush the event stream", "username", username, "error", err)
+			return
+		}
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-dropped:
+				if err != nil && ctx.Err() == nil {
+					h.Log.Warn("subscription of the event stream returned an error", "username", username, "error", err)
+				}
+				return
+			case <-heartbeat.C:
+				if err := writeEventStream(rc, w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+			case event := <-recorded:
+				data, err := json.Marshal(UserEvent{
+					EventNumber: event.EventNumber,
+					Type:        event.EventType,
+					CreatedAt:   event.CreatedDate,
+					Data:        event.Data,
+				})
+				if err != nil {
+					h.Log.Error("failed to marshal the user event", "username", username, "eventNumber", event.EventNumber, "error", err)
+					return
+				}
+
+				message := fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", event.EventNumber, event.EventType, data)
+				if err := writeEventStream(rc, w, message); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Write errors mean the client is gone
+func writeEventStream(rc *http.ResponseController, w http.ResponseWriter, message string) error {
+	if _, err := fmt.Fprint(w, message); err != nil {
+		return err
+	}
+
+	return rc.Flush()
+}
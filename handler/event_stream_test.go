@@ -0,0 +1,143 @@
+package handler_test
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+)
+
+// Returns the ID of the next event of the stream, skipping the heartbeats
+func nextEventID(t *testing.T, scanner *bufio.Scanner) string {
+	t.Helper()
+
+	for scanner.Scan() {
+		if id, ok := strings.CutPrefix(scanner.Text(), "id: "); ok {
+			return id
+		}
+	}
+
+	t.Fatalf("the event stream ended: %v", scanner.Err())
+	return ""
+}
+
+func TestStreamUserEvents(t *testing.T) {
+	ctx := context.Background()
+
+	user := events.CreateUserEvent{Username: "streamed", Email: "streamed@test.com"}
+	if _, err := db.AppendCreateUserEvent(ctx, TestEsdbClient, user, ""); err != nil {
+		t.Fatal(err)
+	}
+	login := func() {
+		t.Helper()
+		if _, err := db.AppendLoginUserEvent(ctx, TestEsdbClient, events.LoginUserEvent{Username: "streamed"}, esdb.Any{}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	login()
+	login()
+
+	// Signals when the handler returns, so the teardown can be observed
+	served := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		TestHandler.ServeHTTP(w, req)
+		served <- struct{}{}
+	}))
+	defer server.Close()
+
+	stream := func(ctx context.Context, username string, lastEventID string) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/users/"+username+"/events/stream", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	t.Run("invalid requests", func(t *testing.T) {
+		for lastEventID, status := range map[string]int{"abc": http.StatusBadRequest, "-1": http.StatusBadRequest} {
+			res := stream(ctx, "streamed", lastEventID)
+			res.Body.Close()
+			<-served
+			if res.StatusCode != status {
+				t.Fatalf("expected status %d for %q, got %d", status, lastEventID, res.StatusCode)
+			}
+		}
+
+		res := stream(ctx, "nobody", "")
+		res.Body.Close()
+		<-served
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected status %d for a missing user, got %d", http.StatusNotFound, res.StatusCode)
+		}
+	})
+
+	t.Run("replay then live", func(t *testing.T) {
+		streamCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		res := stream(streamCtx, "streamed", "")
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, res.StatusCode)
+		}
+
+		scanner := bufio.NewScanner(res.Body)
+		for _, expected := range []string{"0", "1", "2"} {
+			if id := nextEventID(t, scanner); id != expected {
+				t.Fatalf("expected the replayed event %s, got %s", expected, id)
+			}
+		}
+
+		login()
+		if id := nextEventID(t, scanner); id != "3" {
+			t.Fatalf("expected the live event 3, got %s", id)
+		}
+
+		// The handler returns once the client disconnects
+		cancel()
+		select {
+		case <-served:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the handler didn't return after the client disconnected")
+		}
+	})
+
+	t.Run("resume after the last event ID", func(t *testing.T) {
+		streamCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		res := stream(streamCtx, "streamed", " 1 ")
+		defer res.Body.Close()
+
+		scanner := bufio.NewScanner(res.Body)
+		for _, expected := range []string{"2", "3"} {
+			if id := nextEventID(t, scanner); id != expected {
+				t.Fatalf("expected the event %s after the last event ID, got %s", expected, id)
+			}
+		}
+
+		cancel()
+		select {
+		case <-served:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the handler didn't return after the client disconnected")
+		}
+	})
+}
@@ -0,0 +1,8 @@
+package handler
+
+import "github.com/xeipuuv/gojsonschema"
+
+// Compiles the schema of the sample the way the request bodies of the routes are validated
+func CompileRequestSchema(sample any) (*gojsonschema.Schema, error) {
+	return newSchemaGenerator().compile(sample)
+}
@@ -0,0 +1,90 @@
+package handler_test
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/handler"
+	"github.com/MatejaMaric/esdb-playground/projections"
+	"github.com/MatejaMaric/esdb-playground/registration"
+	"github.com/MatejaMaric/esdb-playground/reservation"
+	"github.com/MatejaMaric/esdb-playground/tests"
+	"github.com/ory/dockertest/v3"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	TestEsdbClient  *esdb.Client
+	TestRedisClient *redis.Client
+	TestSqlClient   *sql.DB
+	TestHandler     http.Handler
+)
+
+func TestMain(m *testing.M) {
+	pool := tests.SetupDockertestPool()
+
+	var resourceRedis, resourceEventStoreDB, resourceMariaDB *dockertest.Resource
+
+	eg := &errgroup.Group{}
+
+	eg.Go(func() error {
+		var err error
+		TestRedisClient, resourceRedis, err = tests.SpawnTestRedis(pool)
+		return err
+	})
+
+	eg.Go(func() error {
+		var err error
+		TestEsdbClient, resourceEventStoreDB, err = tests.SpawnTestEventStoreDB(pool)
+		return err
+	})
+
+	eg.Go(func() error {
+		var err error
+		TestSqlClient, resourceMariaDB, err = tests.SpawnTestMariaDB(pool)
+		if err != nil {
+			return err
+		}
+		return tests.CreateSchema(TestSqlClient, "../initdb.d/base.sql")
+	})
+
+	if err := eg.Wait(); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	reserver := reservation.NewReserver(TestEsdbClient, reservation.NewMemoryStore(), reservation.ReserverOptions{})
+	registrations := registration.NewRegistrations(logger, TestEsdbClient, TestRedisClient, reserver, 0)
+
+	var err error
+	TestHandler, err = handler.NewHttpHandler(ctx, logger, TestEsdbClient, TestSqlClient, TestRedisClient, reserver, registrations, db.NewMonitor(), projections.NewSearchIndex())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+
+	// You can't defer this because os.Exit doesn't care for defer
+	tests.PurgeResources(pool, resourceRedis, resourceEventStoreDB, resourceMariaDB)
+
+	os.Exit(code)
+}
+
+// Serves the request with the test handler and returns the recorded response
+func serve(req *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	TestHandler.ServeHTTP(recorder, req)
+	return recorder
+}
@@ -8,9 +8,15 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/mail"
+	"slices"
+	"strings"
 
+	"github.com/MatejaMaric/esdb-playground/aggregates"
 	"github.com/MatejaMaric/esdb-playground/db"
 	"github.com/MatejaMaric/esdb-playground/events"
+	"github.com/MatejaMaric/esdb-playground/projections"
+	"github.com/MatejaMaric/esdb-playground/registration"
 	"github.com/MatejaMaric/esdb-playground/reservation"
 
 	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
@@ -23,55 +29,242 @@ type HttpHandlerContext struct {
 	EsdbClient  *esdb.Client
 	SqlClient   *sql.DB
 	RedisClient *redis.Client
+	// Reserves the unique values (emails, usernames...)
+	Reservations *reservation.Reserver
+	// Runs the registration saga of the created users
+	Registrations *registration.Registrations
+	Monitor       *db.Monitor
+	Search        *projections.SearchIndex
+	// Usernames which are path segments of the routes, see api.reservedUsernames
+	reservedUsernames []string
 }
 
+// Length of the username and email columns
+const maxFieldLength int = 255
+
 type CustomHttpHandler[T any] func(*HttpHandlerContext, *http.Request) (int, T, error)
 
+// Result whose headers are set on the response, only the body is marshaled
+type ResultWithHeaders struct {
+	Header http.Header
+	Body   any
+}
+
+/*
+Wrap the handler into an http.HandlerFunc, marshaling its result as JSON or its error as a problem.
+
+POST and PATCH requests with an Idempotency-Key header are handled only once, see serveIdempotent.
+*/
 func WrapHandler[T any](h *HttpHandlerContext, handler CustomHttpHandler[T]) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		status, res, err := handler(h, r)
-
-		var dataToBeMarshaled any
-		if err != nil {
-			dataToBeMarshaled = map[string]string{
-				"error": err.Error(),
-			}
-		} else {
-			dataToBeMarshaled = res
+		respond := func() storedResponse {
+			status, res, err := handler(h, r)
+			return buildResponse(h, r, status, res, err)
 		}
 
-		data, err := json.Marshal(dataToBeMarshaled)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		if key := r.Header.Get(IdempotencyKeyHeader); key != "" && (r.Method == http.MethodPost || r.Method == http.MethodPatch) {
+			serveIdempotent(h, w, r, key, respond)
 			return
 		}
 
-		if status == http.StatusNoContent {
-			w.WriteHeader(status)
-			return
+		writeResponse(w, respond())
+	}
+}
+
+func buildResponse[T any](h *HttpHandlerContext, req *http.Request, status int, res T, err error) storedResponse {
+	response := storedResponse{Status: status, Header: http.Header{}}
+
+	var dataToBeMarshaled any
+	if err != nil {
+		p := newProblem(h, req, status, err)
+		response.Header.Set("Content-Type", ProblemContentType)
+		dataToBeMarshaled = p
+	} else if withHeaders, ok := any(res).(ResultWithHeaders); ok {
+		for name, values := range withHeaders.Header {
+			response.Header[name] = values
 		}
+		dataToBeMarshaled = withHeaders.Body
+	} else {
+		dataToBeMarshaled = res
+	}
+
+	data, err := json.Marshal(dataToBeMarshaled)
+	if err != nil {
+		return buildResponse[any](h, req, http.StatusInternalServerError, nil, fmt.Errorf("failed to marshal the response: %w", err))
+	}
+	response.Body = data
+
+	return response
+}
+
+// Writes the response as JSON, unless the response sets its own content type
+func writeResponse(w http.ResponseWriter, response storedResponse) {
+	for name, values := range response.Header {
+		w.Header()[name] = values
+	}
+
+	if response.Status == http.StatusNoContent || response.Body == nil {
+		w.WriteHeader(response.Status)
+		return
+	}
 
+	if w.Header().Get("Content-Type") == "" {
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(status)
-		w.Write(data)
 	}
+	w.WriteHeader(response.Status)
+	w.Write(response.Body)
 }
 
-func NewHttpHandler(ctx context.Context, logger *slog.Logger, esdbClient *esdb.Client, sqlClient *sql.DB, redisClient *redis.Client) http.Handler {
+func NewHttpHandler(ctx context.Context, logger *slog.Logger, esdbClient *esdb.Client, sqlClient *sql.DB, redisClient *redis.Client, reservations *reservation.Reserver, registrations *registration.Registrations, monitor *db.Monitor, search *projections.SearchIndex) (http.Handler, error) {
 	hndCtx := &HttpHandlerContext{
-		Ctx:         ctx,
-		Log:         logger,
-		EsdbClient:  esdbClient,
-		SqlClient:   sqlClient,
-		RedisClient: redisClient,
+		Ctx:           ctx,
+		Log:           logger,
+		EsdbClient:    esdbClient,
+		SqlClient:     sqlClient,
+		RedisClient:   redisClient,
+		Reservations:  reservations,
+		Registrations: registrations,
+		Monitor:       monitor,
+		Search:        search,
 	}
 
 	router := http.NewServeMux()
-	router.HandleFunc("GET /", WrapHandler(hndCtx, handleGetUsers))
-	router.HandleFunc("POST /", WrapHandler(hndCtx, handleCreateUser))
-	router.HandleFunc("PATCH /", WrapHandler(hndCtx, handleUserLogin))
+	api := newAPI(hndCtx, router)
+
+	api.handle(route{
+		Method: http.MethodGet, Path: "/users", Summary: "List a page of users",
+		Query:    []string{"sort", "order", "limit", "after", "min_logins", "email_domain"},
+		Response: UserPage{}, Consistent: true,
+		Handler: WrapHandler(hndCtx, handleListUsers),
+	})
+	api.handle(route{
+		Method: http.MethodPost, Path: "/users", Summary: "Register a user",
+		Request: events.CreateUserEvent{}, Status: http.StatusCreated, Response: CommandResult{},
+		Handler: WrapHandler(hndCtx, createdOnSuccess(handleCreateUser)),
+	})
+	api.handle(route{
+		Method: http.MethodGet, Path: "/users/search", Summary: "Search the users by their username and email",
+		Query:    []string{"q", "match", "limit"},
+		Response: []projections.SearchResult{}, Consistent: true,
+		Handler: WrapHandler(hndCtx, handleSearchUsers),
+	})
+	api.handle(route{
+		Method: http.MethodGet, Path: "/users/{username}", Summary: "Get a user",
+		Response: aggregates.User{},
+		Handler:  WrapHandler(hndCtx, handleGetUser),
+	})
+	api.handle(route{
+		Method: http.MethodGet, Path: "/users/{username}/events", Summary: "List the events of a user",
+		Response: []UserEvent{},
+		Handler:  WrapHandler(hndCtx, handleGetUserEvents),
+	})
+	api.handle(route{
+		Method: http.MethodGet, Path: "/users/{username}/events/stream", Summary: "Stream the events of a user, followed by the live ones",
+		Headers: []string{LastEventIDHeader}, Response: UserEvent{}, ContentType: EventStreamContentType,
+		Handler: handleStreamUserEvents(hndCtx),
+	})
+	api.handle(route{
+		Method: http.MethodGet, Path: "/users/{username}/timeline", Summary: "Get a page of the user's timeline",
+		Query:    []string{"after", "limit"},
+		Response: TimelinePage{}, Consistent: true,
+		Handler: WrapHandler(hndCtx, handleGetTimeline),
+	})
+	api.handle(route{
+		Method: http.MethodGet, Path: "/users/{username}/logins", Summary: "Count the daily logins of a user",
+		Query:    []string{"from", "to"},
+		Response: []db.DailyLogins{}, Consistent: true,
+		Handler: WrapHandler(hndCtx, handleGetUserLogins),
+	})
+	api.handle(route{
+		Method: http.MethodPost, Path: "/users/{username}/logins", Summary: "Log the user in",
+		Headers: []string{"If-Match"}, Status: http.StatusCreated, Response: CommandResult{},
+		Handler: WrapHandler(hndCtx, createdOnSuccess(handlePostLogin)),
+	})
+	api.handle(route{
+		Method: http.MethodGet, Path: "/reservations/{namespace}/{value}", Summary: "Get the status of a reservation",
+		Response: ReservationStatus{},
+		Handler:  WrapHandler(hndCtx, handleGetReservation),
+	})
+	api.handle(route{
+		Method: http.MethodPost, Path: "/reservations/{namespace}/{value}", Summary: "Reserve a value",
+		Response: Lease{},
+		Handler:  WrapHandler(hndCtx, handleReserve),
+	})
+	api.handle(route{
+		Method: http.MethodPost, Path: "/reservations/{namespace}/{value}/renew", Summary: "Renew the lease of a reservation",
+		Headers: []string{AccessTokenHeader}, Response: Lease{},
+		Handler: WrapHandler(hndCtx, handleRenewReservation),
+	})
+	api.handle(route{
+		Method: http.MethodDelete, Path: "/reservations/{namespace}/{value}", Summary: "Release a reservation",
+		Headers: []string{AccessTokenHeader}, Status: http.StatusNoContent,
+		Handler: WrapHandler(hndCtx, handleReleaseReservation),
+	})
+	api.handle(route{
+		Method: http.MethodGet, Path: "/problems/{code}", Summary: "Describe the problem type of an error response",
+		Response: ProblemType{},
+		Handler:  WrapHandler(hndCtx, handleGetProblemType),
+	})
+	api.handle(route{
+		Method: http.MethodGet, Path: "/admin/subscriptions", Summary: "Get the statuses of the subscriptions",
+		Response: []db.SubscriptionStatus{},
+		Handler:  WrapHandler(hndCtx, handleGetSubscriptionStatuses),
+	})
+	api.handle(route{
+		Method: http.MethodGet, Path: "/admin/consistency/redis", Summary: "Compare the users inside Redis with their streams",
+		Response: []projections.VersionMismatch{},
+		Handler:  WrapHandler(hndCtx, handleCheckRedisConsistency),
+	})
+	api.handle(route{
+		Method: http.MethodGet, Path: "/analytics/daily-active-users", Summary: "Count the daily active users",
+		Query:    []string{"from", "to"},
+		Response: []db.DailyActiveUsers{}, Consistent: true,
+		Handler: WrapHandler(hndCtx, handleGetDailyActiveUsers),
+	})
+	api.handle(route{
+		Method: http.MethodGet, Path: "/analytics/inactive-users", Summary: "List the users who didn't log in since the date",
+		Query:    []string{"since"},
+		Response: []db.InactiveUser{}, Consistent: true,
+		Handler: WrapHandler(hndCtx, handleGetInactiveUsers),
+	})
+
+	// Deprecated routes, kept working for the existing clients
+	api.handle(route{
+		Method: http.MethodGet, Path: "/{$}", Summary: "List every user, or get the single user of the username query parameter",
+		Query:    []string{"username"},
+		Response: oneOf{[]aggregates.User{}, aggregates.User{}}, Consistent: true, Successor: "/users",
+		Handler: WrapHandler(hndCtx, handleGetUsers),
+	})
+	api.handle(route{
+		Method: http.MethodPost, Path: "/{$}", Summary: "Register a user",
+		Request: events.CreateUserEvent{}, Response: CommandResult{}, Successor: "/users",
+		Handler: WrapHandler(hndCtx, handleCreateUser),
+	})
+	api.handle(route{
+		Method: http.MethodPatch, Path: "/{$}", Summary: "Log the user in",
+		Headers: []string{"If-Match"}, Request: events.LoginUserEvent{}, Response: CommandResult{}, Successor: "/users/{username}/logins",
+		Handler: WrapHandler(hndCtx, handleUserLogin),
+	})
+	api.handle(route{
+		Method: http.MethodGet, Path: "/users/timeline", Summary: "Get a page of the user's timeline",
+		Query:    []string{"username", "after", "limit"},
+		Response: TimelinePage{}, Consistent: true, Successor: "/users/{username}/timeline",
+		Handler: WrapHandler(hndCtx, handleGetTimeline),
+	})
+	api.handle(route{
+		Method: http.MethodGet, Path: "/analytics/logins", Summary: "Count the daily logins of a user",
+		Query:    []string{"username", "from", "to"},
+		Response: []db.DailyLogins{}, Consistent: true, Successor: "/users/{username}/logins",
+		Handler: WrapHandler(hndCtx, handleGetUserLogins),
+	})
+
+	if err := api.err(); err != nil {
+		return nil, fmt.Errorf("failed to register the routes: %w", err)
+	}
 
-	return router
+	hndCtx.reservedUsernames = api.reservedUsernames()
+
+	return router, nil
 }
 
 func handleCreateUser(h *HttpHandlerContext, req *http.Request) (int, any, error) {
@@ -80,56 +273,193 @@ func handleCreateUser(h *HttpHandlerContext, req *http.Request) (int, any, error
 	var event events.CreateUserEvent
 	decoder := json.NewDecoder(req.Body)
 	if err := decoder.Decode(&event); err != nil {
-		return http.StatusBadRequest, nil, fmt.Errorf("failed to decode request: %w", err)
+		return http.StatusBadRequest, nil, problem(CodeInvalidBody, "failed to decode request: %s", err)
+	}
+
+	if fieldErrors := validateCreateUser(event, h.reservedUsernames); len(fieldErrors) > 0 {
+		return http.StatusBadRequest, nil, validationProblem(fieldErrors...)
 	}
 
-	emailReservation, err := reservation.CreateReservation(h.Ctx, h.RedisClient, event.Email)
+	emailReservation, err := h.Reservations.Reserve(h.Ctx, reservation.EmailNamespace, event.Email)
+	if errors.Is(err, reservation.ErrInvalidValue) {
+		return http.StatusBadRequest, nil, validationProblem(FieldError{Field: "email", Message: "must be a valid email address"})
+	}
+	if errors.Is(err, reservation.ErrReservationExists) {
+		return http.StatusBadRequest, nil, problem(CodeEmailTaken, "email %s is already registered", event.Email)
+	}
 	if err != nil {
-		return http.StatusBadRequest, nil, fmt.Errorf("email already registered: %w", err)
+		return http.StatusInternalServerError, nil, fmt.Errorf("failed to reserve the email: %w", err)
 	}
 
-	if wr, err := reservation.SaveReservation(h.Ctx, h.EsdbClient, emailReservation); err != nil {
-		return http.StatusInternalServerError, nil, fmt.Errorf("appending a reservation event to stream resulted in an error: %w", err)
-	} else {
-		h.Log.Info("SaveReservation succeeded",
-			"emailReservation", emailReservation,
-			"WriteResult", wr,
-		)
+	usernameReservation, err := h.Reservations.Reserve(h.Ctx, reservation.UsernameNamespace, event.Username)
+	if err != nil {
+		releaseReservations(h, emailReservation)
+	}
+	if errors.Is(err, reservation.ErrInvalidValue) {
+		return http.StatusBadRequest, nil, validationProblem(FieldError{Field: "username", Message: "must be a valid username"})
+	}
+	if errors.Is(err, reservation.ErrReservationExists) {
+		return http.StatusBadRequest, nil, problem(CodeUsernameTaken, "username %s is already taken", event.Username)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, nil, fmt.Errorf("failed to reserve the username: %w", err)
+	}
+
+	h.Log.Info("reservations succeeded",
+		"emailReservation", emailReservation,
+		"usernameReservation", usernameReservation,
+	)
+
+	// The user must not be created with a value whose reservation was lost in the meantime
+	for _, res := range []reservation.Reservation{emailReservation, usernameReservation} {
+		err := h.Reservations.Renew(h.Ctx, res)
+		if err != nil {
+			releaseReservations(h, emailReservation, usernameReservation)
+		}
+		if errors.Is(err, reservation.ErrLeaseExpired) {
+			return http.StatusConflict, nil, problem(CodeReservationExpired, "reservation of %s %s expired before the user was created", res.Namespace, res.Value)
+		}
+		if err != nil {
+			return http.StatusInternalServerError, nil, fmt.Errorf("failed to renew the reservation: %w", err)
+		}
+	}
+
+	// The saga releases the reservations if the user isn't created, even if this process crashes
+	reg, err := h.Registrations.Start(h.Ctx, event, emailReservation, usernameReservation)
+	if err != nil {
+		releaseReservations(h, emailReservation, usernameReservation)
+		return http.StatusInternalServerError, nil, fmt.Errorf("failed to start the registration: %w", err)
 	}
 
-	appendRes, err := db.AppendCreateUserEvent(h.Ctx, h.EsdbClient, event)
-	if esdbErr, isNil := esdb.FromError(err); !isNil && esdbErr.Code() == esdb.ErrorCodeWrongExpectedVersion {
-		return http.StatusBadRequest, nil, errors.New("user already exists")
+	appendRes, err := db.AppendCreateUserEvent(h.Ctx, h.EsdbClient, event, req.Header.Get(IdempotencyKeyHeader))
+	if err != nil {
+		compensateRegistration(h, reg, err)
+	}
+	if db.IsErrorCode(err, esdb.ErrorCodeWrongExpectedVersion) {
+		return http.StatusBadRequest, nil, problem(CodeUserExists, "user %s already exists", event.Username)
 	}
 	if err != nil {
 		return http.StatusInternalServerError, nil, fmt.Errorf("appending to stream resulted in an error: %w", err)
 	}
+	if err := h.Registrations.UserCreated(h.Ctx, reg.ID); err != nil {
+		h.Log.Error("failed to check the registration of the created user", "registration", reg.ID, "error", err)
+	}
 	h.Log.Debug("successfully appended to stream",
 		"CommitPosition", appendRes.CommitPosition,
 		"PreparePosition", appendRes.PreparePosition,
 		"NextExpectedVersion", appendRes.NextExpectedVersion,
 	)
 
-	return http.StatusOK, nil, nil
+	return http.StatusOK, withETag(newCommandResult(appendRes), appendRes.NextExpectedVersion), nil
 }
 
+// Returns the invalid fields of the user, the values are canonicalized and fully checked when they are reserved
+func validateCreateUser(event events.CreateUserEvent, reservedUsernames []string) []FieldError {
+	var fieldErrors []FieldError
+
+	if event.Username == "" {
+		fieldErrors = append(fieldErrors, FieldError{Field: "username", Message: "is required"})
+	} else if len(event.Username) > maxFieldLength {
+		fieldErrors = append(fieldErrors, FieldError{Field: "username", Message: fmt.Sprintf("must be at most %d characters long", maxFieldLength)})
+	} else if strings.Contains(event.Username, "/") {
+		fieldErrors = append(fieldErrors, FieldError{Field: "username", Message: "must not contain a slash"})
+	} else if slices.ContainsFunc(reservedUsernames, func(reserved string) bool { return strings.EqualFold(reserved, event.Username) }) {
+		fieldErrors = append(fieldErrors, FieldError{Field: "username", Message: "is reserved"})
+	}
+
+	if event.Email == "" {
+		fieldErrors = append(fieldErrors, FieldError{Field: "email", Message: "is required"})
+	} else if len(event.Email) > maxFieldLength {
+		fieldErrors = append(fieldErrors, FieldError{Field: "email", Message: fmt.Sprintf("must be at most %d characters long", maxFieldLength)})
+	} else if addr, err := mail.ParseAddress(event.Email); err != nil || addr.Address != event.Email {
+		// A display name or angle brackets are parsed as well, only the plain address is accepted
+		fieldErrors = append(fieldErrors, FieldError{Field: "email", Message: "must be a valid email address"})
+	}
+
+	return fieldErrors
+}
+
+// Lists every user, or returns the user of the username query parameter
 func handleGetUsers(h *HttpHandlerContext, req *http.Request) (int, any, error) {
 	query := req.URL.Query()
 	if query.Has("username") {
-		user, err := db.NewUserFromStream(h.Ctx, h.EsdbClient, query.Get("username"))
+		return getUserResponse(h, query.Get("username"))
+	}
+
+	stale, err := waitForConsistency(h, req, projections.UsersCheckpoint)
+	if err != nil {
+		return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "%s", err)
+	}
+	if stale != nil {
+		return http.StatusServiceUnavailable, stale, nil
+	}
+
+	users, err := db.GetAllUsers(h.Ctx, h.SqlClient)
+	if err != nil {
+		return http.StatusInternalServerError, nil, fmt.Errorf("failed to get all users: %w", err)
+	}
+
+	return http.StatusOK, users, nil
+}
+
+/*
+Get the user from the Redis read model.
+
+If the user is missing from Redis or its version is behind the stream revision,
+the user is aggregated from its stream and stored back into Redis.
+*/
+func getUser(h *HttpHandlerContext, username string) (aggregates.User, error) {
+	user, found, err := db.GetUserFromRedis(h.Ctx, h.RedisClient, username)
+	if err != nil {
+		h.Log.Warn("failed to get the user from Redis", "username", username, "error", err)
+	}
+
+	if found {
+		revision, err := db.GetStreamRevision(h.Ctx, h.EsdbClient, events.UserEventsStream.ForUser(username))
 		if err != nil {
-			return http.StatusInternalServerError, nil, fmt.Errorf("failed to aggregate user data: %w", err)
+			return user, err
+		}
+
+		if revision == user.Version {
+			return user, nil
 		}
 
-		return http.StatusOK, user, nil
+		h.Log.Debug("user stored inside Redis is stale", "username", username, "version", user.Version, "revision", revision)
+	}
+
+	user, err = db.NewUserFromStream(h.Ctx, h.EsdbClient, username)
+	if err != nil {
+		return user, err
 	}
 
+	if _, err := db.SaveUserToRedis(h.Ctx, h.RedisClient, user); err != nil {
+		h.Log.Warn("failed to save the user to Redis", "username", username, "error", err)
+	}
+
+	return user, nil
+}
+
+func handleGetSubscriptionStatuses(h *HttpHandlerContext, req *http.Request) (int, any, error) {
+	return http.StatusOK, h.Monitor.Statuses(), nil
+}
+
+func handleCheckRedisConsistency(h *HttpHandlerContext, req *http.Request) (int, any, error) {
 	users, err := db.GetAllUsers(h.Ctx, h.SqlClient)
 	if err != nil {
 		return http.StatusInternalServerError, nil, fmt.Errorf("failed to get all users: %w", err)
 	}
 
-	return http.StatusOK, users, nil
+	usernames := make([]string, len(users))
+	for i, user := range users {
+		usernames[i] = user.Username
+	}
+
+	mismatches, err := projections.CheckRedisConsistency(h.Ctx, h.EsdbClient, h.RedisClient, usernames)
+	if err != nil {
+		return http.StatusInternalServerError, nil, fmt.Errorf("failed to check the consistency: %w", err)
+	}
+
+	return http.StatusOK, mismatches, nil
 }
 
 func handleUserLogin(h *HttpHandlerContext, req *http.Request) (int, any, error) {
@@ -138,12 +468,47 @@ func handleUserLogin(h *HttpHandlerContext, req *http.Request) (int, any, error)
 	var event events.LoginUserEvent
 	decoder := json.NewDecoder(req.Body)
 	if err := decoder.Decode(&event); err != nil {
-		return http.StatusBadRequest, nil, fmt.Errorf("failed to decode request: %w", err)
+		return http.StatusBadRequest, nil, problem(CodeInvalidBody, "failed to decode request: %s", err)
+	}
+
+	if event.Username == "" {
+		return http.StatusBadRequest, nil, validationProblem(FieldError{Field: "username", Message: "is required"})
 	}
 
-	appendRes, err := db.AppendLoginUserEvent(h.Ctx, h.EsdbClient, event)
-	if esdbErr, isNil := esdb.FromError(err); !isNil && esdbErr.Code() == esdb.ErrorCodeResourceNotFound {
-		return http.StatusBadRequest, nil, fmt.Errorf("user does not exists")
+	status, res, err := loginUser(h, req, event)
+	if status == http.StatusNotFound {
+		// The deprecated route responded with 400 before users became resources
+		status = http.StatusBadRequest
+	}
+
+	return status, res, err
+}
+
+// The login is only appended if the user is at one of the revisions of the If-Match header, when there is one
+func loginUser(h *HttpHandlerContext, req *http.Request, event events.LoginUserEvent) (int, any, error) {
+	condition, err := parseIfMatch(req)
+	if err != nil {
+		return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "%s", err)
+	}
+
+	var expectedRevision esdb.ExpectedRevision = esdb.StreamExists{}
+	if condition.conditional {
+		var matches bool
+		expectedRevision, matches, err = condition.expectedRevision(h.Ctx, h.EsdbClient, events.UserEventsStream.ForUser(event.Username))
+		if err != nil {
+			return http.StatusInternalServerError, nil, fmt.Errorf("failed to get the revision of the user: %w", err)
+		}
+		if !matches {
+			return http.StatusPreconditionFailed, nil, problem(CodePreconditionFailed, "user isn't at a revision of the If-Match header")
+		}
+	}
+
+	appendRes, err := db.AppendLoginUserEvent(h.Ctx, h.EsdbClient, event, expectedRevision, req.Header.Get(IdempotencyKeyHeader))
+	if db.IsErrorCode(err, esdb.ErrorCodeWrongExpectedVersion) && condition.conditional {
+		return http.StatusPreconditionFailed, nil, problem(CodePreconditionFailed, "user was modified since the revision of the If-Match header")
+	}
+	if db.IsErrorCode(err, esdb.ErrorCodeResourceNotFound) || db.IsErrorCode(err, esdb.ErrorCodeWrongExpectedVersion) {
+		return http.StatusNotFound, nil, problem(CodeUserNotFound, "user %s does not exist", event.Username)
 	}
 	if err != nil {
 		return http.StatusInternalServerError, nil, fmt.Errorf("appending to stream resulted in an error: %w", err)
@@ -154,5 +519,5 @@ func handleUserLogin(h *HttpHandlerContext, req *http.Request) (int, any, error)
 		"NextExpectedVersion", appendRes.NextExpectedVersion,
 	)
 
-	return http.StatusOK, nil, nil
+	return http.StatusOK, withETag(newCommandResult(appendRes), appendRes.NextExpectedVersion), nil
 }
@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	IdempotencyKeyHeader string = "Idempotency-Key"
+	// Set on the responses replayed for duplicate requests
+	IdempotentReplayedHeader string = "Idempotent-Replayed"
+)
+
+const (
+	maxIdempotencyKeyLength int = 255
+	// How long the first response is replayed for
+	idempotencyTTL time.Duration = 24 * time.Hour
+	// How long a request is considered in flight, so a crashed request doesn't block the key forever
+	inFlightTTL time.Duration = time.Minute
+)
+
+// Response as stored inside Redis, the zero status marks a request which is still in flight
+type storedResponse struct {
+	Status int             `json:"status"`
+	Header http.Header     `json:"header,omitempty"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	// Fingerprint of the request which stored the response, see requestFingerprint
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+func idempotencyRedisKey(key string) string {
+	return fmt.Sprintf("idempotency:%s", key)
+}
+
+// Hash of the method, path and body of the request, a key can only be reused by a request with the same fingerprint
+func requestFingerprint(req *http.Request, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	fingerprint := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%x", req.Method, req.URL.Path, bodyHash)))
+	return hex.EncodeToString(fingerprint[:])
+}
+
+/*
+Handle the request only once per idempotency key, replaying the first response to the duplicates.
+
+A duplicate of a request which is still in flight is rejected with 409 Conflict.
+Reusing the key for a request with a different method, path or body is rejected with 422 Unprocessable Content.
+Server errors aren't stored, so the request can be retried with the same key.
+*/
+func serveIdempotent(h *HttpHandlerContext, w http.ResponseWriter, req *http.Request, key string, respond func() storedResponse) {
+	if len(key) > maxIdempotencyKeyLength {
+		writeError(h, w, req, http.StatusBadRequest, problem(CodeInvalidRequest, "header %s must be at most %d characters long", IdempotencyKeyHeader, maxIdempotencyKeyLength))
+		return
+	}
+
+	body, ok := readBody(h, w, req)
+	if !ok {
+		return
+	}
+	fingerprint := requestFingerprint(req, body)
+
+	redisKey := idempotencyRedisKey(key)
+
+	inFlight, err := json.Marshal(storedResponse{Fingerprint: fingerprint})
+	if err != nil {
+		writeError(h, w, req, http.StatusInternalServerError, err)
+		return
+	}
+
+	acquired, err := h.RedisClient.SetNX(h.Ctx, redisKey, inFlight, inFlightTTL).Result()
+	if err != nil {
+		writeError(h, w, req, http.StatusInternalServerError, fmt.Errorf("failed to acquire the idempotency key: %w", err))
+		return
+	}
+
+	if !acquired {
+		stored, err := getStoredResponse(h.Ctx, h.RedisClient, redisKey)
+		if err != nil {
+			writeError(h, w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		switch {
+		case stored == nil:
+			// The in flight marker expired in the meantime
+			writeError(h, w, req, http.StatusConflict, problem(CodeIdempotencyConflict, "request with the same idempotency key was just finished, retry it"))
+		case stored.Fingerprint != fingerprint:
+			writeError(h, w, req, http.StatusUnprocessableEntity, problem(CodeIdempotencyMismatch, "idempotency key was already used with a different request"))
+		case stored.Status == 0:
+			writeError(h, w, req, http.StatusConflict, problem(CodeIdempotencyConflict, "request with the same idempotency key is in progress"))
+		default:
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			writeResponse(w, *stored)
+		}
+		return
+	}
+
+	response := respond()
+	response.Fingerprint = fingerprint
+
+	ctx := context.WithoutCancel(h.Ctx)
+	if response.Status >= http.StatusInternalServerError {
+		if err := h.RedisClient.Del(ctx, redisKey).Err(); err != nil {
+			h.Log.Error("failed to release the idempotency key", "key", key, "error", err)
+		}
+	} else if data, err := json.Marshal(response); err != nil {
+		h.Log.Error("failed to marshal the response", "key", key, "error", err)
+	} else if err := h.RedisClient.Set(ctx, redisKey, data, idempotencyTTL).Err(); err != nil {
+		h.Log.Error("failed to store the response of the idempotency key", "key", key, "error", err)
+	}
+
+	writeResponse(w, response)
+}
+
+// Returns nil if there is no stored response
+func getStoredResponse(ctx context.Context, redisClient *redis.Client, redisKey string) (*storedResponse, error) {
+	data, err := redisClient.Get(ctx, redisKey).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the stored response: %w", err)
+	}
+
+	var stored storedResponse
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the stored response: %w", err)
+	}
+
+	return &stored, nil
+}
+
+func writeError(h *HttpHandlerContext, w http.ResponseWriter, req *http.Request, status int, err error) {
+	writeResponse(w, buildResponse[any](h, req, status, nil, err))
+}
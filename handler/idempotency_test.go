@@ -0,0 +1,143 @@
+package handler_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/MatejaMaric/esdb-playground/handler"
+)
+
+func TestIdempotency(t *testing.T) {
+	h := &handler.HttpHandlerContext{
+		Ctx:         context.Background(),
+		Log:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		RedisClient: TestRedisClient,
+	}
+
+	var calls atomic.Int32
+	var status atomic.Int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	close(release)
+	blocked := release
+
+	serveKey := handler.WrapHandler(h, func(h *handler.HttpHandlerContext, req *http.Request) (int, any, error) {
+		calls.Add(1)
+		started <- struct{}{}
+		<-blocked
+
+		code := int(status.Load())
+		if code >= http.StatusInternalServerError {
+			return code, nil, errors.New("failed")
+		}
+		return code, map[string]int32{"calls": calls.Load()}, nil
+	})
+
+	post := func(path string, key string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set(handler.IdempotencyKeyHeader, key)
+
+		recorder := httptest.NewRecorder()
+		serveKey(recorder, req)
+
+		select {
+		case <-started:
+		default:
+		}
+		return recorder
+	}
+
+	t.Run("server errors aren't stored", func(t *testing.T) {
+		calls.Store(0)
+		status.Store(http.StatusInternalServerError)
+
+		for i := 1; i <= 2; i++ {
+			res := post("/failing", "failing-key", `{}`)
+			if res.Code != http.StatusInternalServerError {
+				t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, res.Code)
+			}
+			if res.Header().Get(handler.IdempotentReplayedHeader) != "" {
+				t.Fatal("the server error was replayed")
+			}
+			if n := calls.Load(); n != int32(i) {
+				t.Fatalf("expected %d calls of the handler, got %d", i, n)
+			}
+		}
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		calls.Store(0)
+		status.Store(http.StatusCreated)
+
+		first := post("/replayed", "replayed-key", `{"a":1}`)
+		if first.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d", http.StatusCreated, first.Code)
+		}
+
+		second := post("/replayed", "replayed-key", `{"a":1}`)
+		if second.Code != http.StatusCreated || second.Header().Get(handler.IdempotentReplayedHeader) != "true" {
+			t.Fatalf("expected a replayed %d, got %d", http.StatusCreated, second.Code)
+		}
+		if first.Body.String() != second.Body.String() {
+			t.Fatalf("replayed body %s differs from %s", second.Body, first.Body)
+		}
+		if n := calls.Load(); n != 1 {
+			t.Fatalf("expected the handler to be called once, got %d", n)
+		}
+
+		// The key is bound to the fingerprint of the first request
+		if res := post("/replayed", "replayed-key", `{"a":2}`); res.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("expected status %d for a different body, got %d", http.StatusUnprocessableEntity, res.Code)
+		}
+		if res := post("/other", "replayed-key", `{"a":1}`); res.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("expected status %d for a different path, got %d", http.StatusUnprocessableEntity, res.Code)
+		}
+		if n := calls.Load(); n != 1 {
+			t.Fatalf("expected the handler to be called once, got %d", n)
+		}
+	})
+
+	t.Run("in flight", func(t *testing.T) {
+		calls.Store(0)
+		status.Store(http.StatusCreated)
+
+		unblock := make(chan struct{})
+		blocked = unblock
+		defer func() { blocked = release }()
+
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			req := httptest.NewRequest(http.MethodPost, "/in-flight", strings.NewReader(`{}`))
+			req.Header.Set(handler.IdempotencyKeyHeader, "in-flight-key")
+
+			recorder := httptest.NewRecorder()
+			serveKey(recorder, req)
+			done <- recorder
+		}()
+
+		<-started
+
+		if res := post("/in-flight", "in-flight-key", `{}`); res.Code != http.StatusConflict {
+			t.Fatalf("expected status %d while the request is in flight, got %d", http.StatusConflict, res.Code)
+		}
+
+		close(unblock)
+		if res := <-done; res.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d", http.StatusCreated, res.Code)
+		}
+
+		if res := post("/in-flight", "in-flight-key", `{}`); res.Header().Get(handler.IdempotentReplayedHeader) != "true" {
+			t.Fatal("expected the finished request to be replayed")
+		}
+		if n := calls.Load(); n != 1 {
+			t.Fatalf("expected the handler to be called once, got %d", n)
+		}
+	})
+}
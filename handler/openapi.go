@@ -0,0 +1,435 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const openAPIVersion string = "3.0.3"
+
+// Path the OpenAPI document is served at
+const openAPIDocumentPath string = "/openapi.json"
+
+type openAPIDocument struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       openAPIInfo                      `json:"info"`
+	Paths      map[string]map[string]*operation `json:"paths"`
+	Components openAPIComponents                `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIComponents struct {
+	Schemas map[string]*schema `json:"schemas"`
+}
+
+type operation struct {
+	Summary     string              `json:"summary,omitempty"`
+	Deprecated  bool                `json:"deprecated,omitempty"`
+	Parameters  []parameter         `json:"parameters,omitempty"`
+	RequestBody *requestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]response `json:"responses"`
+}
+
+type parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required,omitempty"`
+	Schema   *schema `json:"schema"`
+}
+
+type requestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]mediaType `json:"content"`
+}
+
+type response struct {
+	Description string               `json:"description"`
+	Content     map[string]mediaType `json:"content,omitempty"`
+}
+
+type mediaType struct {
+	Schema *schema `json:"schema"`
+}
+
+// Subset of the OpenAPI schema object, which is also valid JSON Schema so request bodies can be validated against it
+type schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Properties           map[string]*schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *schema            `json:"items,omitempty"`
+	AdditionalProperties *schema            `json:"additionalProperties,omitempty"`
+	AllOf                []*schema          `json:"allOf,omitempty"`
+	OneOf                []*schema          `json:"oneOf,omitempty"`
+	// Only used by the validated schemas, see jsonSchema
+	AnyOf []*schema `json:"anyOf,omitempty"`
+}
+
+// Sample of a body which is one of the samples
+type oneOf []any
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// Generates the schemas of Go types from their JSON encoding, named structs become components
+type schemaGenerator struct {
+	schemas map[string]*schema
+	// Type of every component, to tell apart the types with the same name from different packages
+	types map[string]reflect.Type
+	// Types which can't be described are described by an empty schema, the errors are returned by flush
+	errs []error
+}
+
+func newSchemaGenerator() *schemaGenerator {
+	return &schemaGenerator{
+		schemas: map[string]*schema{},
+		types:   map[string]reflect.Type{},
+	}
+}
+
+// Returns the schema of the sample's type
+func (g *schemaGenerator) schemaOf(sample any) *schema {
+	if samples, ok := sample.(oneOf); ok {
+		s := &schema{}
+		for _, sample := range samples {
+			s.OneOf = append(s.OneOf, g.schemaOf(sample))
+		}
+		return s
+	}
+
+	return g.generate(reflect.TypeOf(sample))
+}
+
+// Returns the errors of the types described since the last flush
+func (g *schemaGenerator) flush() error {
+	err := errors.Join(g.errs...)
+	g.errs = nil
+	return err
+}
+
+func (g *schemaGenerator) generate(t reflect.Type) *schema {
+	switch t {
+	case timeType:
+		return &schema{Type: "string", Format: "date-time"}
+	case rawMessageType:
+		return &schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := g.generate(t.Elem())
+		if s.Ref != "" {
+			// Siblings of a reference are ignored, so the reference is wrapped
+			return &schema{AllOf: []*schema{s}, Nullable: true}
+		}
+		nullable := *s
+		nullable.Nullable = true
+		return &nullable
+	case reflect.Interface:
+		return &schema{}
+	case reflect.Bool:
+		return &schema{Type: "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return &schema{Type: "integer", Format: "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return &schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &schema{Type: "number"}
+	case reflect.String:
+		return &schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &schema{Type: "string", Format: "byte"}
+		}
+		return &schema{Type: "array", Items: g.generate(t.Elem())}
+	case reflect.Map:
+		return &schema{Type: "object", AdditionalProperties: g.generate(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		return g.component(t)
+	default:
+		g.errs = append(g.errs, fmt.Errorf("type %s can't be described by a schema", t))
+		return &schema{}
+	}
+}
+
+// Returns the reference to the component of the struct, generating the component the first time
+func (g *schemaGenerator) component(t reflect.Type) *schema {
+	name := t.Name()
+	if other, ok := g.types[name]; ok && other != t {
+		name = path.Base(t.PkgPath()) + "." + name
+	}
+
+	ref := &schema{Ref: "#/components/schemas/" + name}
+	if _, ok := g.types[name]; ok {
+		return ref
+	}
+
+	// Registered before the fields, so recursive types only reference it
+	g.types[name] = t
+	g.schemas[name] = g.structSchema(t)
+
+	return ref
+}
+
+// Fields without omitempty are required, embedded structs are flattened like encoding/json does
+func (g *schemaGenerator) structSchema(t reflect.Type) *schema {
+	s := &schema{Type: "object", Properties: map[string]*schema{}}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, options, _ := strings.Cut(tag, ",")
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			embedded := g.structSchema(field.Type)
+			for property, propertySchema := range embedded.Properties {
+				s.Properties[property] = propertySchema
+			}
+			s.Required = append(s.Required, embedded.Required...)
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		s.Properties[name] = g.generate(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			s.Required = append(s.Required, name)
+		}
+	}
+
+	return s
+}
+
+// Matches the path parameters of the route patterns
+var pathParamRegexp = regexp.MustCompile(`\{([^}.$]+)(\.\.\.)?\}`)
+
+/*
+Describes the route of a handler, the route is registered together with its OpenAPI operation.
+
+The request and response are samples of the body types, nil if there is no body.
+*/
+type route struct {
+	Method  string
+	Path    string
+	Summary string
+	Query   []string
+	Headers []string
+	Request any
+	// Status of the successful response, 200 OK by default
+	Status   int
+	Response any
+	// Content type of the successful response, application/json by default
+	ContentType string
+	// Reads waiting for the consistency token respond with a stale result when the projection is behind
+	Consistent bool
+	// Path of the route replacing the deprecated route
+	Successor string
+	Handler   http.HandlerFunc
+}
+
+func (g *schemaGenerator) operation(r route) *operation {
+	op := &operation{
+		Summary:    r.Summary,
+		Deprecated: r.Successor != "",
+		Responses:  map[string]response{},
+	}
+
+	for _, match := range pathParamRegexp.FindAllStringSubmatch(r.Path, -1) {
+		op.Parameters = append(op.Parameters, parameter{Name: match[1], In: "path", Required: true, Schema: &schema{Type: "string"}})
+	}
+
+	query := r.Query
+	if r.Consistent {
+		query = append(query, ConsistencyTokenParam)
+	}
+	for _, name := range query {
+		op.Parameters = append(op.Parameters, parameter{Name: name, In: "query", Schema: &schema{Type: "string"}})
+	}
+
+	headers := r.Headers
+	if r.Consistent {
+		headers = append(headers, ConsistencyTokenHeader)
+	}
+	if r.Method == http.MethodPost || r.Method == http.MethodPatch {
+		headers = append(headers, IdempotencyKeyHeader)
+	}
+	for _, name := range headers {
+		op.Parameters = append(op.Parameters, parameter{Name: name, In: "header", Schema: &schema{Type: "string"}})
+	}
+
+	if r.Request != nil {
+		op.RequestBody = &requestBody{
+			Required: true,
+			Content:  map[string]mediaType{"application/json": {Schema: g.schemaOf(r.Request)}},
+		}
+	}
+
+	status := r.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	contentType := r.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	success := response{Description: http.StatusText(status)}
+	if r.Response != nil {
+		success.Content = map[string]mediaType{contentType: {Schema: g.schemaOf(r.Response)}}
+	}
+	op.Responses[strconv.Itoa(status)] = success
+
+	if r.Consistent {
+		op.Responses[strconv.Itoa(http.StatusServiceUnavailable)] = response{
+			Description: "The projection didn't reach the consistency token in time",
+			Content:     map[string]mediaType{"application/json": {Schema: g.schemaOf(StaleResult{})}},
+		}
+	}
+
+	op.Responses["default"] = response{
+		Description: "Error",
+		Content:     map[string]mediaType{ProblemContentType: {Schema: g.schemaOf(Problem{})}},
+	}
+
+	return op
+}
+
+// The OpenAPI path of the route pattern, without the exact match marker of Go patterns
+func openAPIPath(pattern string) string {
+	return strings.ReplaceAll(pattern, "{$}", "")
+}
+
+/*
+Registers the routes on the router and documents them in the OpenAPI document served at /openapi.json.
+
+Request bodies are validated against the schema of the route before the handler runs.
+*/
+type api struct {
+	h         *HttpHandlerContext
+	router    *http.ServeMux
+	generator *schemaGenerator
+	document  openAPIDocument
+	// Errors of the routes which couldn't be registered, see err
+	errs []error
+}
+
+func newAPI(h *HttpHandlerContext, router *http.ServeMux) *api {
+	generator := newSchemaGenerator()
+
+	a := &api{
+		h:         h,
+		router:    router,
+		generator: generator,
+		document: openAPIDocument{
+			OpenAPI:    openAPIVersion,
+			Info:       openAPIInfo{Title: "esdb-playground", Version: "1.0.0"},
+			Paths:      map[string]map[string]*operation{},
+			Components: openAPIComponents{Schemas: generator.schemas},
+		},
+	}
+
+	router.HandleFunc("GET "+openAPIDocumentPath, a.handleOpenAPI)
+
+	return a
+}
+
+func (a *api) handle(r route) {
+	path := openAPIPath(r.Path)
+	if a.document.Paths[path] == nil {
+		a.document.Paths[path] = map[string]*operation{}
+	}
+	a.document.Paths[path][strings.ToLower(r.Method)] = a.generator.operation(r)
+	if err := a.generator.flush(); err != nil {
+		a.errs = append(a.errs, fmt.Errorf("invalid schema of %s %s: %w", r.Method, r.Path, err))
+		return
+	}
+
+	handler := r.Handler
+	if r.Request != nil {
+		bodySchema, err := a.generator.compile(r.Request)
+		if err != nil {
+			a.errs = append(a.errs, fmt.Errorf("invalid request schema of %s %s: %w", r.Method, r.Path, err))
+			return
+		}
+		handler = validateBody(a.h, bodySchema, handler)
+	}
+
+	if r.Successor != "" {
+		handler = deprecated(r.Successor, handler)
+	}
+
+	a.router.HandleFunc(r.Method+" "+r.Path, handler)
+}
+
+/*
+Returns the fixed path segments of the registered routes and of the OpenAPI document.
+
+A user whose username is one of them has a path which could be mistaken for another route,
+e.g. /users/search, so the usernames are reserved.
+*/
+func (a *api) reservedUsernames() []string {
+	paths := []string{openAPIDocumentPath}
+	for path := range a.document.Paths {
+		paths = append(paths, path)
+	}
+
+	var reserved []string
+	for _, path := range paths {
+		for _, segment := range strings.Split(path, "/") {
+			if segment != "" && !strings.HasPrefix(segment, "{") && !slices.Contains(reserved, segment) {
+				reserved = append(reserved, segment)
+			}
+		}
+	}
+	slices.Sort(reserved)
+
+	return reserved
+}
+
+// Returns the errors of the routes which weren't registered
+func (a *api) err() error {
+	return errors.Join(a.errs...)
+}
+
+// The routes are only registered on start, so the document isn't modified while it's served
+func (a *api) handleOpenAPI(w http.ResponseWriter, req *http.Request) {
+	data, err := json.Marshal(a.document)
+	if err != nil {
+		writeError(a.h, w, req, http.StatusInternalServerError, fmt.Errorf("failed to marshal the OpenAPI document: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
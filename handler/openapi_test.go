@@ -0,0 +1,130 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/MatejaMaric/esdb-playground/handler"
+	"github.com/go-test/deep"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+type nestedSample struct {
+	Name string `json:"name"`
+}
+
+type nullableSample struct {
+	Count  *int          `json:"count"`
+	Nested *nestedSample `json:"nested"`
+	Tags   []string      `json:"tags,omitempty"`
+}
+
+func TestSchemaGenerator(t *testing.T) {
+	for _, sample := range []any{
+		struct{ Updates chan int }{},
+		struct{ Callback func() }{},
+		struct{ Values map[string]complex128 }{},
+	} {
+		if _, err := handler.CompileRequestSchema(sample); err == nil {
+			t.Fatalf("expected an error for %T", sample)
+		}
+	}
+
+	bodySchema, err := handler.CompileRequestSchema(nullableSample{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		body  string
+		valid bool
+	}{
+		{body: `{"count": null, "nested": null}`, valid: true},
+		{body: `{"count": 1, "nested": {"name": "a"}, "tags": ["b"]}`, valid: true},
+		{body: `{"count": "1", "nested": null}`, valid: false},
+		{body: `{"count": 1, "nested": {}}`, valid: false},
+		{body: `{"nested": null}`, valid: false},
+		{body: `null`, valid: false},
+	}
+
+	for _, test := range tests {
+		result, err := bodySchema.Validate(gojsonschema.NewStringLoader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Valid() != test.valid {
+			t.Fatalf("expected %s to be valid: %t, errors: %v", test.body, test.valid, result.Errors())
+		}
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	res := serve(httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.Code)
+	}
+
+	type schema struct {
+		Ref        string             `json:"$ref"`
+		Nullable   bool               `json:"nullable"`
+		Properties map[string]*schema `json:"properties"`
+		OneOf      []*schema          `json:"oneOf"`
+	}
+	var document struct {
+		Paths map[string]map[string]struct {
+			Deprecated bool `json:"deprecated"`
+			Responses  map[string]struct {
+				Content map[string]struct {
+					Schema schema `json:"schema"`
+				} `json:"content"`
+			} `json:"responses"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]schema `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&document); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deprecated listing returns a single user when it's filtered by the username
+	listing := document.Paths["/"]["get"]
+	users := listing.Responses["200"].Content["application/json"].Schema
+	if !listing.Deprecated || len(users.OneOf) != 2 {
+		t.Fatalf("expected the deprecated listing to be one of the users or a user, got %+v", users)
+	}
+	if users.OneOf[1].Ref != "#/components/schemas/User" {
+		t.Fatalf("expected the single user to reference its component, got %+v", users.OneOf[1])
+	}
+
+	if next := document.Components.Schemas["UserPage"].Properties["next"]; next == nil || !next.Nullable {
+		t.Fatalf("expected the next cursor to be nullable, got %+v", next)
+	}
+
+	// A user named after a fixed segment of any route could be mistaken for the route
+	segments := []string{"openapi.json"}
+	for path := range document.Paths {
+		for _, segment := range strings.Split(path, "/") {
+			if segment != "" && !strings.HasPrefix(segment, "{") {
+				segments = append(segments, segment)
+			}
+		}
+	}
+
+	for _, segment := range segments {
+		body := `{"username": "` + strings.ToUpper(segment) + `", "email": "` + segment + `@reserved.com"}`
+		res := serve(httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body)))
+		if res.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for username %s, got %d", http.StatusBadRequest, segment, res.Code)
+		}
+
+		p := decodeProblem(t, res)
+		expected := []handler.FieldError{{Field: "username", Message: "is reserved"}}
+		if diff := deep.Equal(expected, p.Errors); diff != nil {
+			t.Fatalf("username %s: %v", segment, diff)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gofrs/uuid"
+)
+
+// Content type of the error responses, see RFC 7807
+const ProblemContentType string = "application/problem+json"
+
+// Prefix of the problem type URIs, the code of the problem is appended to it, see handleGetProblemType
+const problemTypePrefix string = "/problems/"
+
+// Stable code of a problem, clients should branch on it instead of the title or detail
+type ErrorCode string
+
+const (
+	CodeInvalidRequest       ErrorCode = "invalid-request"
+	CodeInvalidBody          ErrorCode = "invalid-body"
+	CodeValidationFailed     ErrorCode = "validation-failed"
+	CodeNotFound             ErrorCode = "not-found"
+	CodeUserNotFound         ErrorCode = "user-not-found"
+	CodeUserExists           ErrorCode = "user-exists"
+	CodeEmailTaken           ErrorCode = "email-taken"
+	CodeUsernameTaken        ErrorCode = "username-taken"
+	CodeReservationExists    ErrorCode = "reservation-exists"
+	CodeReservationExpired   ErrorCode = "reservation-expired"
+	CodeReservationPersisted ErrorCode = "reservation-persisted"
+	CodeAccessDenied         ErrorCode = "access-denied"
+	CodeConflict             ErrorCode = "conflict"
+	CodePreconditionFailed   ErrorCode = "precondition-failed"
+	CodeIdempotencyConflict  ErrorCode = "idempotency-conflict"
+	CodeIdempotencyMismatch  ErrorCode = "idempotency-mismatch"
+	CodeInternal             ErrorCode = "internal-error"
+)
+
+var problemTitles = map[ErrorCode]string{
+	CodeInvalidRequest:       "The request is invalid",
+	CodeInvalidBody:          "The request body can't be decoded",
+	CodeValidationFailed:     "The request failed validation",
+	CodeNotFound:             "The resource was not found",
+	CodeUserNotFound:         "The user does not exist",
+	CodeUserExists:           "The user already exists",
+	CodeEmailTaken:           "The email is already registered",
+	CodeUsernameTaken:        "The username is already taken",
+	CodeReservationExists:    "The value is already reserved",
+	CodeReservationExpired:   "The reservation expired",
+	CodeReservationPersisted: "The reservation belongs to a value in use",
+	CodeAccessDenied:         "The access token doesn't hold the reservation",
+	CodeConflict:             "The request conflicts with the current state",
+	CodePreconditionFailed:   "The precondition of the request failed",
+	CodeIdempotencyConflict:  "The idempotency key is in use",
+	CodeIdempotencyMismatch:  "The idempotency key was used with a different request",
+	CodeInternal:             "Internal server error",
+}
+
+// Code of the errors which aren't problems, based on the status returned with them
+func defaultErrorCode(status int) ErrorCode {
+	switch status {
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusPreconditionFailed:
+		return CodePreconditionFailed
+	default:
+		if status >= http.StatusInternalServerError {
+			return CodeInternal
+		}
+		return CodeInvalidRequest
+	}
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error response of the API, see RFC 7807
+type Problem struct {
+	Type   string    `json:"type"`
+	Title  string    `json:"title"`
+	Status int       `json:"status"`
+	Detail string    `json:"detail,omitempty"`
+	Code   ErrorCode `json:"code"`
+	// The request path
+	Instance string       `json:"instance,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+	// Identifies the logged cause of an internal error
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.Detail
+	}
+
+	return p.Title
+}
+
+// Returned by the handlers instead of a plain error, the status is the one returned with it
+func problem(code ErrorCode, format string, args ...any) *Problem {
+	return &Problem{Code: code, Detail: fmt.Sprintf(format, args...)}
+}
+
+func validationProblem(fieldErrors ...FieldError) *Problem {
+	return &Problem{
+		Code:   CodeValidationFailed,
+		Detail: "one or more fields are invalid",
+		Errors: fieldErrors,
+	}
+}
+
+/*
+Convert the error returned by a handler into a problem.
+
+Server errors are logged under a correlation ID, only the ID is sent to the client so the internals don't leak.
+Client errors which aren't problems are logged as well, their detail isn't sent.
+*/
+func newProblem(h *HttpHandlerContext, req *http.Request, status int, err error) Problem {
+	var p Problem
+
+	var handlerProblem *Problem
+	if errors.As(err, &handlerProblem) {
+		p = *handlerProblem
+	} else {
+		// The detail of a plain error could leak the internals, the client only gets the title of its code
+		p = Problem{Code: defaultErrorCode(status)}
+		if status < http.StatusInternalServerError {
+			h.Log.Warn("request failed with a plain error",
+				"method", req.Method,
+				"path", req.URL.Path,
+				"status", status,
+				"error", err,
+			)
+		}
+	}
+
+	p.Status = status
+	p.Instance = req.URL.Path
+
+	if status >= http.StatusInternalServerError {
+		correlationID := uuid.Must(uuid.NewV4()).String()
+		h.Log.Error("request failed",
+			"correlationId", correlationID,
+			"method", req.Method,
+			"path", req.URL.Path,
+			"status", status,
+			"error", err,
+		)
+
+		p.Code = CodeInternal
+		p.Detail = "the request failed, reference the correlation ID when reporting it"
+		p.Errors = nil
+		p.CorrelationID = correlationID
+	}
+
+	p.Type = problemTypePrefix + string(p.Code)
+	p.Title = problemTitles[p.Code]
+
+	return p
+}
+
+// Documentation of a problem type, served at its type URI
+type ProblemType struct {
+	Type  string    `json:"type"`
+	Code  ErrorCode `json:"code"`
+	Title string    `json:"title"`
+}
+
+func handleGetProblemType(h *HttpHandlerContext, req *http.Request) (int, any, error) {
+	code := ErrorCode(req.PathValue("code"))
+
+	title, ok := problemTitles[code]
+	if !ok {
+		return http.StatusNotFound, nil, problem(CodeNotFound, "problem type %s doesn't exist", code)
+	}
+
+	return http.StatusOK, ProblemType{Type: problemTypePrefix + string(code), Code: code, Title: title}, nil
+}
@@ -0,0 +1,101 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/MatejaMaric/esdb-playground/handler"
+	"github.com/go-test/deep"
+)
+
+func decodeProblem(t *testing.T, res *httptest.ResponseRecorder) handler.Problem {
+	t.Helper()
+
+	if contentType := res.Header().Get("Content-Type"); contentType != handler.ProblemContentType {
+		t.Fatalf("expected a problem, got %s: %s", contentType, res.Body)
+	}
+
+	var p handler.Problem
+	if err := json.NewDecoder(res.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestProblems(t *testing.T) {
+	h := &handler.HttpHandlerContext{
+		Ctx: context.Background(),
+		Log: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	failing := func(status int) func(http.ResponseWriter, *http.Request) {
+		return handler.WrapHandler(h, func(h *handler.HttpHandlerContext, req *http.Request) (int, any, error) {
+			return status, nil, errors.New("dial tcp 10.0.0.7:3306: connection refused")
+		})
+	}
+
+	t.Run("plain errors don't leak", func(t *testing.T) {
+		for _, status := range []int{http.StatusBadRequest, http.StatusConflict, http.StatusInternalServerError} {
+			res := httptest.NewRecorder()
+			failing(status)(res, httptest.NewRequest(http.MethodGet, "/failing", nil))
+
+			p := decodeProblem(t, res)
+			if strings.Contains(p.Detail, "10.0.0.7") {
+				t.Fatalf("status %d leaked the error: %s", status, p.Detail)
+			}
+			if p.Status != status || p.Title == "" {
+				t.Fatalf("unexpected problem %+v", p)
+			}
+		}
+	})
+
+	t.Run("email with a display name", func(t *testing.T) {
+		for _, email := range []string{"Name <name@test.com>", "<name@test.com>"} {
+			body := `{"username": "display-name", "email": "` + strings.ReplaceAll(email, `"`, `\"`) + `"}`
+			res := serve(httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body)))
+			if res.Code != http.StatusBadRequest {
+				t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, email, res.Code)
+			}
+
+			p := decodeProblem(t, res)
+			expected := []handler.FieldError{{Field: "email", Message: "must be a valid email address"}}
+			if diff := deep.Equal(expected, p.Errors); diff != nil {
+				t.Fatal(diff)
+			}
+		}
+	})
+
+	t.Run("type URIs resolve", func(t *testing.T) {
+		res := serve(httptest.NewRequest(http.MethodGet, "/users/missing-user", nil))
+		if res.Code != http.StatusNotFound {
+			t.Fatalf("expected status %d, got %d", http.StatusNotFound, res.Code)
+		}
+		p := decodeProblem(t, res)
+
+		res = serve(httptest.NewRequest(http.MethodGet, p.Type, nil))
+		if res.Code != http.StatusOK {
+			t.Fatalf("problem type %s didn't resolve: %d", p.Type, res.Code)
+		}
+
+		var problemType handler.ProblemType
+		if err := json.NewDecoder(res.Body).Decode(&problemType); err != nil {
+			t.Fatal(err)
+		}
+		expected := handler.ProblemType{Type: p.Type, Code: p.Code, Title: p.Title}
+		if diff := deep.Equal(expected, problemType); diff != nil {
+			t.Fatal(diff)
+		}
+
+		if res := serve(httptest.NewRequest(http.MethodGet, "/problems/unknown", nil)); res.Code != http.StatusNotFound {
+			t.Fatalf("expected status %d for an unknown problem type, got %d", http.StatusNotFound, res.Code)
+		}
+	})
+}
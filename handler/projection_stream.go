@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+	"github.com/MatejaMaric/esdb-playground/projections"
+)
+
+/*
+Handle all the streams of the given type with a projection that stores its own checkpoint.
+
+The handling continues from the stored checkpoint, unless the projection has to be rebuilt, and the projection is closed when the context is canceled.
+Events are retried until the projection handles them, the handling stops once the retries run out.
+The projection should advance the monitor's checkpoint with the same name once its changes are visible.
+*/
+func HandleProjectionStream(
+	ctx context.Context,
+	logger *slog.Logger,
+	esdbClient *esdb.Client,
+	streamType events.Stream,
+	name string,
+	projection projections.CheckpointedProjection,
+	monitor *db.Monitor,
+	readyChan chan<- struct{},
+) error {
+	defer func() {
+		if err := projection.Close(); err != nil {
+			logger.Error("closing the projection returned an error", "projection", name, "error", err)
+		}
+	}()
+
+	from, err := resumeProjection(logger, name, projection)
+	if err != nil {
+		return err
+	}
+
+	if position, ok := from.(esdb.Position); ok {
+		monitor.Checkpoint(name).Advance(position)
+	}
+
+	opts := db.AllStreamsOfTypeOptions{
+		From:         from,
+		Workers:      userStreamWorkers,
+		OnCheckpoint: projection.SetCheckpoint,
+		Tracker:      monitor.TrackStreamType(name, streamType),
+	}
+
+	// A failed event stops the checkpoint before it, the subscription is retried from there
+	handler := func(event esdb.RecordedEvent) error {
+		if err := projection.HandleEvent(event); err != nil {
+			return fmt.Errorf("projection %s failed to handle the event: %w", name, err)
+		}
+
+		logger.Debug("projection handled event",
+			"projection", name,
+			"EventNumber", event.EventNumber,
+			"CommitPosition", event.Position.Commit,
+			"PreparePosition", event.Position.Prepare,
+		)
+
+		return nil
+	}
+
+	return db.HandleAllStreamsOfType(ctx, logger, esdbClient, streamType, opts, handler, readyChan)
+}
+
+/*
+Returns the position from which the projection should continue.
+
+If there is no stored checkpoint, or it was stored by a different version of the
+projection, the read model is reset and the projection is rebuilt from the start of $all.
+*/
+func resumeProjection(logger *slog.Logger, name string, projection projections.CheckpointedProjection) (esdb.AllPosition, error) {
+	from, storedVersion, err := projection.Checkpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	if !isStartPosition(from) && storedVersion == projection.Version() {
+		return from, nil
+	}
+
+	if !isStartPosition(from) {
+		logger.Info("projection version changed, rebuilding the read model",
+			"projection", name,
+			"storedVersion", storedVersion,
+			"version", projection.Version(),
+		)
+	}
+
+	if err := projection.Reset(); err != nil {
+		return nil, err
+	}
+
+	return esdb.Start{}, nil
+}
+
+func isStartPosition(position esdb.AllPosition) bool {
+	_, isStart := position.(esdb.Start)
+	return isStart
+}
@@ -2,31 +2,181 @@ package handler
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
+	"net/http"
+	"time"
 
 	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
 	"github.com/MatejaMaric/esdb-playground/db"
 	"github.com/MatejaMaric/esdb-playground/events"
+	"github.com/MatejaMaric/esdb-playground/projections"
+	"github.com/MatejaMaric/esdb-playground/registration"
 	"github.com/MatejaMaric/esdb-playground/reservation"
 	"github.com/redis/go-redis/v9"
 )
 
-func HandleReservationStream(ctx context.Context, logger *slog.Logger, esdbClient *esdb.Client, redisClient *redis.Client) error {
-	handler := func(event esdb.RecordedEvent) error {
-		var res reservation.Reservation
-		if err := json.Unmarshal(event.Data, &res); err != nil {
-			logger.Error("failed to unmarshal a reservation event", "event", event, "error", err)
-		}
+/*
+Apply the reservations written to the reservation streams of all namespaces and to the key streams.
 
-		if _, err := reservation.PersistReservation(ctx, redisClient, res); err != nil {
-			logger.Error("failed to persist a reservation", "event", event, "error", err)
-			return nil
-		}
+The stream type prefix also matches the legacy reservations stream.
+The projection catches up from the checkpoint stored inside Redis and continues with the live events,
+readyChan (can be nil) is signaled once the events written before the start are applied.
+*/
+func HandleReservationStream(
+	ctx context.Context,
+	logger *slog.Logger,
+	esdbClient *esdb.Client,
+	redisClient *redis.Client,
+	reserver *reservation.Reserver,
+	monitor *db.Monitor,
+	readyChan chan<- struct{},
+) error {
+	projection := projections.NewReservationProjection(ctx, logger, redisClient, reserver, monitor.Checkpoint(projections.ReservationsCheckpoint))
+	return HandleProjectionStream(ctx, logger, esdbClient, events.ReservationKeyStream, projections.ReservationsCheckpoint, projection, monitor, readyChan)
+}
+
+type ReservationStatus struct {
+	Namespace reservation.Namespace `json:"namespace"`
+	Value     string                `json:"value"`
+	Status    reservation.Status    `json:"status"`
+}
+
+// Header holding the access token of the reservation
+const AccessTokenHeader string = "X-Access-Token"
+
+type Lease struct {
+	Namespace   reservation.Namespace `json:"namespace"`
+	Value       string                `json:"value"`
+	AccessToken string                `json:"access_token"`
+	// The lease has to be renewed before it expires
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func newLease(h *HttpHandlerContext, res reservation.Reservation) Lease {
+	return Lease{
+		Namespace:   res.Namespace,
+		Value:       res.Value,
+		AccessToken: res.AccessToken,
+		ExpiresAt:   time.Now().Add(h.Reservations.Lease()),
+	}
+}
+
+// Returns the reservation of the path values held with the access token from the header
+func heldReservation(req *http.Request) (reservation.Reservation, int, error) {
+	ns, err := reservation.ParseNamespace(req.PathValue("namespace"))
+	if err != nil {
+		return reservation.Reservation{}, http.StatusNotFound, problem(CodeNotFound, "%s", err)
+	}
+
+	token := req.Header.Get(AccessTokenHeader)
+	if token == "" {
+		return reservation.Reservation{}, http.StatusBadRequest, problem(CodeInvalidRequest, "the %s header is required", AccessTokenHeader)
+	}
+
+	res, err := reservation.NewReservation(ns, req.PathValue("value"), token)
+	if err != nil {
+		return reservation.Reservation{}, http.StatusBadRequest, problem(CodeInvalidRequest, "%s", err)
+	}
+
+	return res, http.StatusOK, nil
+}
+
+func handleReserve(h *HttpHandlerContext, req *http.Request) (int, any, error) {
+	ns, err := reservation.ParseNamespace(req.PathValue("namespace"))
+	if err != nil {
+		return http.StatusNotFound, nil, problem(CodeNotFound, "%s", err)
+	}
 
-		logger.Info("reservation event handled", "reservation", res)
-		return nil
+	res, err := h.Reservations.Reserve(h.Ctx, ns, req.PathValue("value"))
+	if errors.Is(err, reservation.ErrInvalidValue) {
+		return http.StatusBadRequest, nil, validationProblem(FieldError{Field: "value", Message: err.Error()})
 	}
+	if errors.Is(err, reservation.ErrReservationExists) {
+		return http.StatusConflict, nil, problem(CodeReservationExists, "%s %s is already reserved", ns, req.PathValue("value"))
+	}
+	if err != nil {
+		return http.StatusInternalServerError, nil, fmt.Errorf("failed to reserve the value: %w", err)
+	}
+
+	return http.StatusOK, newLease(h, res), nil
+}
 
-	return db.HandleStream(ctx, esdbClient, string(events.ReservationStream), handler)
+func handleRenewReservation(h *HttpHandlerContext, req *http.Request) (int, any, error) {
+	res, status, err := heldReservation(req)
+	if err != nil {
+		return status, nil, err
+	}
+
+	err = h.Reservations.Renew(h.Ctx, res)
+	if errors.Is(err, reservation.ErrLeaseExpired) {
+		return http.StatusConflict, nil, problem(CodeReservationExpired, "reservation of %s %s expired", res.Namespace, res.Value)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, nil, fmt.Errorf("failed to renew the reservation: %w", err)
+	}
+
+	return http.StatusOK, newLease(h, res), nil
+}
+
+func handleReleaseReservation(h *HttpHandlerContext, req *http.Request) (int, any, error) {
+	res, status, err := heldReservation(req)
+	if err != nil {
+		return status, nil, err
+	}
+
+	err = h.Reservations.Release(h.Ctx, res)
+	if errors.Is(err, reservation.ErrAccessDenied) {
+		return http.StatusForbidden, nil, problem(CodeAccessDenied, "reservation of %s %s is held with a different access token", res.Namespace, res.Value)
+	}
+	if errors.Is(err, reservation.ErrReservationPersisted) {
+		return http.StatusConflict, nil, problem(CodeReservationPersisted, "reservation of %s %s is persisted", res.Namespace, res.Value)
+	}
+	if errors.Is(err, reservation.ErrLeaseExpired) {
+		return http.StatusConflict, nil, problem(CodeReservationExpired, "reservation of %s %s expired", res.Namespace, res.Value)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, nil, fmt.Errorf("failed to release the reservation: %w", err)
+	}
+
+	return http.StatusNoContent, nil, nil
+}
+
+func handleGetReservation(h *HttpHandlerContext, req *http.Request) (int, any, error) {
+	ns, err := reservation.ParseNamespace(req.PathValue("namespace"))
+	if err != nil {
+		return http.StatusNotFound, nil, problem(CodeNotFound, "%s", err)
+	}
+
+	value := req.PathValue("value")
+
+	status, err := h.Reservations.Status(h.Ctx, ns, value)
+	if errors.Is(err, reservation.ErrInvalidValue) {
+		return http.StatusBadRequest, nil, validationProblem(FieldError{Field: "value", Message: err.Error()})
+	}
+	if err != nil {
+		return http.StatusInternalServerError, nil, fmt.Errorf("failed to get the reservation status: %w", err)
+	}
+
+	return http.StatusOK, ReservationStatus{Namespace: ns, Value: value, Status: status}, nil
+}
+
+// Release the reservations of a failed registration, so it doesn't consume the values forever
+func releaseReservations(h *HttpHandlerContext, reservations ...reservation.Reservation) {
+	ctx := context.WithoutCancel(h.Ctx)
+
+	for _, res := range reservations {
+		// Lost reservations aren't held by the registration anymore
+		if err := h.Reservations.Release(ctx, res); err != nil && !reservation.IsLost(err) {
+			h.Log.Error("failed to release a reservation", "reservation", res, "error", err)
+		}
+	}
+}
+
+// Compensate the registration whose user couldn't be created, the saga compensates it on timeout if this fails
+func compensateRegistration(h *HttpHandlerContext, reg registration.Registration, cause error) {
+	if err := h.Registrations.Compensate(context.WithoutCancel(h.Ctx), reg.ID, cause.Error()); err != nil {
+		h.Log.Error("failed to compensate a registration", "registration", reg.ID, "error", err)
+	}
 }
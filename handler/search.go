@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/MatejaMaric/esdb-playground/projections"
+)
+
+const (
+	defaultSearchLimit int = 20
+	maxSearchLimit     int = 100
+)
+
+func handleSearchUsers(h *HttpHandlerContext, req *http.Request) (int, any, error) {
+	query := req.URL.Query()
+
+	q := query.Get("q")
+	if q == "" {
+		return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "query parameter q is required")
+	}
+
+	match := projections.RankedMatch
+	if query.Has("match") {
+		match = projections.SearchMatch(query.Get("match"))
+	}
+	switch match {
+	case projections.PrefixMatch, projections.SubstringMatch, projections.RankedMatch:
+	default:
+		return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "query parameter match must be one of: %s, %s, %s", projections.PrefixMatch, projections.SubstringMatch, projections.RankedMatch)
+	}
+
+	limit := defaultSearchLimit
+	if query.Has("limit") {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > maxSearchLimit {
+			return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "query parameter limit must be a number between 1 and %d", maxSearchLimit)
+		}
+	}
+
+	stale, err := waitForConsistency(h, req, projections.SearchCheckpoint)
+	if err != nil {
+		return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "%s", err)
+	}
+	if stale != nil {
+		return http.StatusServiceUnavailable, stale, nil
+	}
+
+	return http.StatusOK, h.Search.Search(q, match, limit), nil
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/projections"
+)
+
+const (
+	defaultTimelineLimit int = 50
+	maxTimelineLimit     int = 500
+)
+
+type TimelinePage struct {
+	Entries []db.TimelineEntry `json:"entries"`
+	// Cursor of the next page, nil if there are no more entries
+	Next *string `json:"next"`
+}
+
+func handleGetTimeline(h *HttpHandlerContext, req *http.Request) (int, any, error) {
+	query := req.URL.Query()
+
+	username, err := requestUsername(req)
+	if err != nil {
+		return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "%s", err)
+	}
+
+	var after *uint64
+	if query.Has("after") {
+		eventNumber, err := strconv.ParseUint(query.Get("after"), 10, 64)
+		if err != nil {
+			return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "query parameter after must be an event number")
+		}
+		after = &eventNumber
+	}
+
+	limit := defaultTimelineLimit
+	if query.Has("limit") {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > maxTimelineLimit {
+			return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "query parameter limit must be a number between 1 and %d", maxTimelineLimit)
+		}
+	}
+
+	stale, err := waitForConsistency(h, req, projections.TimelineCheckpoint)
+	if err != nil {
+		return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "%s", err)
+	}
+	if stale != nil {
+		return http.StatusServiceUnavailable, stale, nil
+	}
+
+	// One more entry is requested to know if there is a next page
+	entries, err := db.GetTimeline(h.Ctx, h.SqlClient, username, after, limit+1)
+	if err != nil {
+		return http.StatusInternalServerError, nil, fmt.Errorf("failed to get the timeline: %w", err)
+	}
+
+	page := TimelinePage{Entries: entries}
+	if len(entries) > limit {
+		page.Entries = entries[:limit]
+		next := strconv.FormatUint(page.Entries[limit-1].EventNumber, 10)
+		page.Next = &next
+	}
+
+	return http.StatusOK, page, nil
+}
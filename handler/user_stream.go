@@ -3,33 +3,102 @@ package handler
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"log/slog"
 
 	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
 	"github.com/MatejaMaric/esdb-playground/db"
 	"github.com/MatejaMaric/esdb-playground/events"
 	"github.com/MatejaMaric/esdb-playground/projections"
+	"github.com/redis/go-redis/v9"
 )
 
-func HandleUserStream(ctx context.Context, logger *slog.Logger, esdbClient *esdb.Client, sqlClient *sql.DB, readyChan chan<- struct{}) error {
-	dbProjection := projections.NewDatabaseProjection(ctx, sqlClient)
+// Number of workers handling the user events, events of the same user are always handled by the same worker
+const userStreamWorkers int = 8
+
+/*
+Handle the user events with database and stream projections, continuing from the checkpoint of the database projection.
+
+When the batch size is not zero, the database projection is batched. The stream and Redis projections
+see the events again when the database projection is rebuilt or fails, so they skip the ones they already applied.
+*/
+func HandleUserStream(
+	ctx context.Context,
+	logger *slog.Logger,
+	esdbClient *esdb.Client,
+	sqlClient *sql.DB,
+	redisClient *redis.Client,
+	batchOpts projections.BatchOptions,
+	monitor *db.Monitor,
+	readyChan chan<- struct{},
+) error {
+	committed := monitor.Checkpoint(projections.UsersCheckpoint)
+
+	opts := db.AllStreamsOfTypeOptions{
+		Workers: userStreamWorkers,
+		Tracker: monitor.TrackStreamType(projections.UsersCheckpoint, events.UserEventsStream),
+	}
+
+	var dbProjection projections.CheckpointedProjection
+	if batchOpts.Size > 0 {
+		dbProjection = projections.NewBatchedDatabaseProjection(ctx, logger, sqlClient, batchOpts, committed)
+	} else {
+		dbProjection = projections.NewDatabaseProjection(ctx, sqlClient, committed)
+	}
+	defer func() {
+		if err := dbProjection.Close(); err != nil {
+			logger.Error("closing the database projection returned an error", "error", err)
+		}
+	}()
+
+	from, err := resumeProjection(logger, projections.UsersCheckpoint, dbProjection)
+	if err != nil {
+		return err
+	}
+
+	if position, ok := from.(esdb.Position); ok {
+		committed.Advance(position)
+	}
+
+	opts.From = from
+	opts.OnCheckpoint = dbProjection.SetCheckpoint
+
+	// The handled events of the batched projection are only visible once their batch is flushed
+	if batchOpts.Size > 0 && readyChan != nil {
+		if err := signalWhenCommitted(ctx, logger, esdbClient, committed, readyChan); err != nil {
+			return err
+		}
+		readyChan = nil
+	}
+
 	streamProjection := projections.NewStreamProjection(ctx, esdbClient)
+	redisProjection := projections.NewRedisProjection(ctx, esdbClient, redisClient)
 
 	handler := func(event esdb.RecordedEvent) error {
+		// The checkpoint mustn't pass an event which isn't in MariaDB, the event is handled again after the retry
 		if err := dbProjection.HandleEvent(event); err != nil {
-			logger.Error("database projection event handler returned an error", "error", err)
+			return fmt.Errorf("database projection failed to handle the event: %w", err)
+		}
+		logger.Debug("database projection handled event",
+			"EventNumber", event.EventNumber,
+			"CommitPosition", event.Position.Commit,
+			"PreparePosition", event.Position.Prepare,
+		)
+
+		if err := streamProjection.HandleEvent(event); err != nil {
+			logger.Error("stream projection event handler returned an error", "error", err)
 		} else {
-			logger.Debug("database projection handled event",
+			logger.Debug("stream projection handled event",
 				"EventNumber", event.EventNumber,
 				"CommitPosition", event.Position.Commit,
 				"PreparePosition", event.Position.Prepare,
 			)
 		}
 
-		if err := streamProjection.HandleEvent(event); err != nil {
-			logger.Error("stream projection event handler returned an error", "error", err)
+		if err := redisProjection.HandleEvent(event); err != nil {
+			logger.Error("redis projection event handler returned an error", "error", err)
 		} else {
-			logger.Debug("stream projection handled event",
+			logger.Debug("redis projection handled event",
 				"EventNumber", event.EventNumber,
 				"CommitPosition", event.Position.Commit,
 				"PreparePosition", event.Position.Prepare,
@@ -39,5 +108,29 @@ func HandleUserStream(ctx context.Context, logger *slog.Logger, esdbClient *esdb
 		return nil
 	}
 
-	return db.HandleAllStreamsOfType(ctx, logger, esdbClient, events.UserEventsStream, handler, readyChan)
+	return db.HandleAllStreamsOfType(ctx, logger, esdbClient, events.UserEventsStream, opts, handler, readyChan)
+}
+
+// Signals the readiness once the committed checkpoint reaches the latest user event
+func signalWhenCommitted(ctx context.Context, logger *slog.Logger, esdbClient *esdb.Client, committed *db.ProjectionCheckpoint, readyChan chan<- struct{}) error {
+	notReadyUntil, err := db.GetPositionOfLatestEventForStreamType(ctx, esdbClient, events.UserEventsStream)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := committed.Wait(ctx, notReadyUntil.Commit); err != nil {
+			return
+		}
+
+		select {
+		case readyChan <- struct{}{}:
+		case <-ctx.Done():
+		}
+		close(readyChan)
+
+		logger.Debug("ready signal sent", "function", "HandleUserStream", "commit", notReadyUntil.Commit)
+	}()
+
+	return nil
 }
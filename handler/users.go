@@ -0,0 +1,260 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/aggregates"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+	"github.com/MatejaMaric/esdb-playground/projections"
+)
+
+const (
+	defaultUsersLimit int = 50
+	maxUsersLimit     int = 500
+)
+
+type UserPage struct {
+	Users []aggregates.User `json:"users"`
+	// Cursor of the next page, nil if there are no more users
+	Next *string `json:"next"`
+}
+
+type UserEvent struct {
+	EventNumber uint64          `json:"event_number"`
+	Type        string          `json:"type"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// Responds with 201 Created instead of 200 OK, used by the routes creating resources
+func createdOnSuccess[T any](handler CustomHttpHandler[T]) CustomHttpHandler[T] {
+	return func(h *HttpHandlerContext, req *http.Request) (int, T, error) {
+		status, res, err := handler(h, req)
+		if status == http.StatusOK {
+			status = http.StatusCreated
+		}
+
+		return status, res, err
+	}
+}
+
+// Marks the responses of a deprecated route, pointing to the route replacing it
+func deprecated(successor string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+
+		handler(w, req)
+	}
+}
+
+// Returns the username from the path, falling back to the username query parameter of the deprecated routes
+func requestUsername(req *http.Request) (string, error) {
+	if username := req.PathValue("username"); username != "" {
+		return username, nil
+	}
+
+	if username := req.URL.Query().Get("username"); username != "" {
+		return username, nil
+	}
+
+	return "", errors.New("query parameter username is required")
+}
+
+/*
+Lists a page of users, sorted by the sort query parameter (username, login_count or version) in the given order (asc or desc).
+
+The users can be filtered by their email_domain and min_logins. The after query parameter is the next cursor of the previous page,
+it's only valid with the same sort and order.
+*/
+func handleListUsers(h *HttpHandlerContext, req *http.Request) (int, any, error) {
+	opts, err := parseListUsersOptions(req)
+	if err != nil {
+		return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "%s", err)
+	}
+
+	stale, err := waitForConsistency(h, req, projections.UsersCheckpoint)
+	if err != nil {
+		return http.StatusBadRequest, nil, problem(CodeInvalidRequest, "%s", err)
+	}
+	if stale != nil {
+		return http.StatusServiceUnavailable, stale, nil
+	}
+
+	limit := opts.Limit
+
+	// One more user is requested to know if there is a next page
+	opts.Limit++
+	users, err := db.ListUsers(h.Ctx, h.SqlClient, opts)
+	if err != nil {
+		return http.StatusInternalServerError, nil, fmt.Errorf("failed to list users: %w", err)
+	}
+
+	page := UserPage{Users: users}
+	if len(users) > limit {
+		page.Users = users[:limit]
+
+		next, err := encodeUserCursor(opts, page.Users[limit-1])
+		if err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+		page.Next = &next
+	}
+
+	return http.StatusOK, page, nil
+}
+
+func parseListUsersOptions(req *http.Request) (db.ListUsersOptions, error) {
+	query := req.URL.Query()
+
+	opts := db.ListUsersOptions{
+		Sort:        db.SortByUsername,
+		Limit:       defaultUsersLimit,
+		EmailDomain: query.Get("email_domain"),
+	}
+
+	if query.Has("sort") {
+		opts.Sort = db.UserSort(query.Get("sort"))
+	}
+	switch opts.Sort {
+	case db.SortByUsername, db.SortByLoginCount, db.SortByVersion:
+	default:
+		return opts, fmt.Errorf("query parameter sort must be one of: %s, %s, %s", db.SortByUsername, db.SortByLoginCount, db.SortByVersion)
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		return opts, errors.New("query parameter order must be asc or desc")
+	}
+
+	if query.Has("limit") {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > maxUsersLimit {
+			return opts, fmt.Errorf("query parameter limit must be a number between 1 and %d", maxUsersLimit)
+		}
+		opts.Limit = limit
+	}
+
+	if query.Has("min_logins") {
+		minLogins, err := strconv.ParseInt(query.Get("min_logins"), 10, 32)
+		if err != nil || minLogins < 0 {
+			return opts, errors.New("query parameter min_logins must be a non-negative number")
+		}
+		opts.MinLogins = int32(minLogins)
+	}
+
+	if query.Has("after") {
+		cursor, err := decodeUserCursor(opts, query.Get("after"))
+		if err != nil {
+			return opts, err
+		}
+		opts.After = &cursor
+	}
+
+	return opts, nil
+}
+
+// The cursor keeps the sort and the order of its page, so it can't be used with a different one
+type userCursor struct {
+	Sort       db.UserSort `json:"s"`
+	Descending bool        `json:"d,omitempty"`
+	Value      uint64      `json:"v,omitempty"`
+	Username   string      `json:"u"`
+}
+
+func encodeUserCursor(opts db.ListUsersOptions, last aggregates.User) (string, error) {
+	cursor := userCursor{Sort: opts.Sort, Descending: opts.Descending, Username: last.Username}
+
+	switch opts.Sort {
+	case db.SortByLoginCount:
+		cursor.Value = uint64(last.LoginCount)
+	case db.SortByVersion:
+		cursor.Value = last.Version
+	}
+
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal the cursor: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeUserCursor(opts db.ListUsersOptions, encoded string) (db.UserCursor, error) {
+	invalid := errors.New("query parameter after must be the next cursor of a page with the same sort and order")
+
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return db.UserCursor{}, invalid
+	}
+
+	var cursor userCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return db.UserCursor{}, invalid
+	}
+
+	if cursor.Sort != opts.Sort || cursor.Descending != opts.Descending {
+		return db.UserCursor{}, invalid
+	}
+
+	return db.UserCursor{Value: cursor.Value, Username: cursor.Username}, nil
+}
+
+func handleGetUser(h *HttpHandlerContext, req *http.Request) (int, any, error) {
+	return getUserResponse(h, req.PathValue("username"))
+}
+
+func getUserResponse(h *HttpHandlerContext, username string) (int, any, error) {
+	user, err := getUser(h, username)
+	if db.IsErrorCode(err, esdb.ErrorCodeResourceNotFound) {
+		return http.StatusNotFound, nil, problem(CodeUserNotFound, "user %s does not exist", username)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, nil, fmt.Errorf("failed to aggregate user data: %w", err)
+	}
+
+	return http.StatusOK, withETag(user, user.Version), nil
+}
+
+// Returns every event of the user's stream, oldest first
+func handleGetUserEvents(h *HttpHandlerContext, req *http.Request) (int, any, error) {
+	username := req.PathValue("username")
+
+	userEvents := []UserEvent{}
+	err := db.HandleReadStream(h.Ctx, h.EsdbClient, events.UserEventsStream.ForUser(username), func(event esdb.RecordedEvent) error {
+		userEvents = append(userEvents, UserEvent{
+			EventNumber: event.EventNumber,
+			Type:        event.EventType,
+			CreatedAt:   event.CreatedDate,
+			Data:        event.Data,
+		})
+		return nil
+	})
+	if db.IsErrorCode(err, esdb.ErrorCodeResourceNotFound) {
+		return http.StatusNotFound, nil, problem(CodeUserNotFound, "user %s does not exist", username)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, nil, fmt.Errorf("failed to read the user events: %w", err)
+	}
+
+	if len(userEvents) == 0 {
+		return http.StatusOK, userEvents, nil
+	}
+
+	return http.StatusOK, withETag(userEvents, userEvents[len(userEvents)-1].EventNumber), nil
+}
+
+func handlePostLogin(h *HttpHandlerContext, req *http.Request) (int, any, error) {
+	return loginUser(h, req, events.LoginUserEvent{Username: req.PathValue("username")})
+}
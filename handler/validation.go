@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Maximum size of the request bodies which are read upfront
+const maxBodySize int64 = 1 << 20
+
+// Compiles the schema of the sample's type, together with the components it references
+func (g *schemaGenerator) compile(sample any) (*gojsonschema.Schema, error) {
+	// Generated first, so the components include the ones of the sample
+	sampleSchema := g.schemaOf(sample)
+	if err := g.flush(); err != nil {
+		return nil, err
+	}
+
+	components := map[string]*schema{}
+	for name, component := range g.schemas {
+		components[name] = jsonSchema(component)
+	}
+
+	document := struct {
+		*schema
+		Components openAPIComponents `json:"components"`
+	}{
+		schema:     jsonSchema(sampleSchema),
+		Components: openAPIComponents{Schemas: components},
+	}
+
+	data, err := json.Marshal(document)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the schema: %w", err)
+	}
+
+	return gojsonschema.NewSchema(gojsonschema.NewBytesLoader(data))
+}
+
+// Copy of the OpenAPI schema as JSON Schema, which doesn't know nullable, so nullable schemas become one of null or the schema
+func jsonSchema(s *schema) *schema {
+	if s == nil {
+		return nil
+	}
+
+	copied := *s
+	copied.Nullable = false
+	copied.Items = jsonSchema(s.Items)
+	copied.AdditionalProperties = jsonSchema(s.AdditionalProperties)
+	copied.AllOf = jsonSchemas(s.AllOf)
+	copied.OneOf = jsonSchemas(s.OneOf)
+	copied.AnyOf = jsonSchemas(s.AnyOf)
+
+	if s.Properties != nil {
+		copied.Properties = map[string]*schema{}
+		for name, property := range s.Properties {
+			copied.Properties[name] = jsonSchema(property)
+		}
+	}
+
+	if s.Nullable {
+		return &schema{AnyOf: []*schema{{Type: "null"}, &copied}}
+	}
+	return &copied
+}
+
+func jsonSchemas(schemas []*schema) []*schema {
+	var copied []*schema
+	for _, s := range schemas {
+		copied = append(copied, jsonSchema(s))
+	}
+	return copied
+}
+
+// Responds with a validation problem if the request body doesn't match the schema, the handler gets the same body
+func validateBody(h *HttpHandlerContext, bodySchema *gojsonschema.Schema, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		body, ok := readBody(h, w, req)
+		if !ok {
+			return
+		}
+
+		result, err := bodySchema.Validate(gojsonschema.NewBytesLoader(body))
+		if err != nil {
+			writeError(h, w, req, http.StatusBadRequest, problem(CodeInvalidBody, "failed to decode request: %s", err))
+			return
+		}
+
+		if !result.Valid() {
+			writeError(h, w, req, http.StatusBadRequest, validationProblem(fieldErrors(result)...))
+			return
+		}
+
+		handler(w, req)
+	}
+}
+
+// Reads the whole request body and replaces it with a copy, responds with a problem if it can't be read
+func readBody(h *HttpHandlerContext, w http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBodySize))
+	req.Body.Close()
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeError(h, w, req, http.StatusRequestEntityTooLarge, problem(CodeInvalidBody, "request body must be at most %d bytes", maxBytesErr.Limit))
+		return nil, false
+	}
+	if err != nil {
+		writeError(h, w, req, http.StatusBadRequest, problem(CodeInvalidBody, "failed to read request: %s", err))
+		return nil, false
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+// Field of a missing property is the property itself, not the object missing it
+func fieldErrors(result *gojsonschema.Result) []FieldError {
+	var fieldErrors []FieldError
+
+	for _, resultErr := range result.Errors() {
+		field := resultErr.Field()
+		message := resultErr.Description()
+
+		if resultErr.Type() == "required" {
+			property := fmt.Sprint(resultErr.Details()["property"])
+			if field == gojsonschema.STRING_CONTEXT_ROOT {
+				field = property
+			} else {
+				field += "." + property
+			}
+			message = "is required"
+		}
+
+		fieldErrors = append(fieldErrors, FieldError{Field: field, Message: message})
+	}
+
+	return fieldErrors
+}
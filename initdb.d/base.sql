@@ -5,5 +5,64 @@ CREATE TABLE users(
     email VARCHAR(255) NOT NULL UNIQUE,
     login_count INT NOT NULL DEFAULT 0,
     version BIGINT NOT NULL,
-    CONSTRAINT PRIMARY KEY (username)
+    email_domain VARCHAR(255) AS (SUBSTRING_INDEX(email, '@', -1)) STORED,
+    CONSTRAINT PRIMARY KEY (username),
+    INDEX (login_count, username),
+    INDEX (version, username),
+    INDEX (email_domain, username)
+);
+DROP TABLE IF EXISTS checkpoints;
+CREATE TABLE checkpoints(
+    name VARCHAR(255),
+    commit_position BIGINT UNSIGNED NOT NULL,
+    prepare_position BIGINT UNSIGNED NOT NULL,
+    version INT NOT NULL DEFAULT 0,
+    CONSTRAINT PRIMARY KEY (name)
+);
+DROP TABLE IF EXISTS user_logins_daily;
+CREATE TABLE user_logins_daily(
+    username VARCHAR(255),
+    day DATE NOT NULL,
+    count INT NOT NULL DEFAULT 0,
+    CONSTRAINT PRIMARY KEY (username, day),
+    INDEX (day)
+);
+DROP TABLE IF EXISTS user_login_stats;
+CREATE TABLE user_login_stats(
+    username VARCHAR(255),
+    first_login DATETIME(6) NOT NULL,
+    last_login DATETIME(6) NOT NULL,
+    version BIGINT NOT NULL,
+    CONSTRAINT PRIMARY KEY (username),
+    INDEX (last_login)
+);
+DROP TABLE IF EXISTS user_timeline;
+CREATE TABLE user_timeline(
+    username VARCHAR(255),
+    event_number BIGINT UNSIGNED NOT NULL,
+    event_type VARCHAR(255) NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    summary VARCHAR(1024) NOT NULL,
+    metadata TEXT NOT NULL,
+    CONSTRAINT PRIMARY KEY (username, event_number)
+);
+DROP TABLE IF EXISTS reservations;
+CREATE TABLE reservations(
+    reservation_key VARCHAR(512) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin,
+    token VARCHAR(255) NOT NULL,
+    expires_at DATETIME(6) NULL,
+    CONSTRAINT PRIMARY KEY (reservation_key),
+    INDEX (expires_at)
+);
+DROP TABLE IF EXISTS dead_letters;
+CREATE TABLE dead_letters(
+    projection VARCHAR(255),
+    stream_id VARCHAR(255),
+    event_number BIGINT UNSIGNED NOT NULL,
+    event_type VARCHAR(255) NOT NULL,
+    commit_position BIGINT UNSIGNED NOT NULL,
+    prepare_position BIGINT UNSIGNED NOT NULL,
+    error TEXT NOT NULL,
+    failed_at DATETIME(6) NOT NULL,
+    CONSTRAINT PRIMARY KEY (projection, stream_id, event_number)
 );
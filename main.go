@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
@@ -10,9 +12,13 @@ import (
 	"time"
 
 	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
 	"github.com/MatejaMaric/esdb-playground/handler"
+	"github.com/MatejaMaric/esdb-playground/projections"
+	"github.com/MatejaMaric/esdb-playground/registration"
 	"github.com/MatejaMaric/esdb-playground/reservation"
 	"github.com/MatejaMaric/esdb-playground/utils"
+	"github.com/redis/go-redis/v9"
 )
 
 func main() {
@@ -33,32 +39,121 @@ func main() {
 	}
 	logger.Info("successfully connected to MariaDB instance")
 
-	redisClient, err := db.ConnectToRedis()
+	// Redis is only connected to once it's needed, so the commands which don't use it can run without it
+	var redisClient *redis.Client
+	connectToRedis := func() *redis.Client {
+		if redisClient != nil {
+			return redisClient
+		}
+
+		redisClient, err = db.ConnectToRedis()
+		if err != nil {
+			logger.Error("failed to connect to Redis instance", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("successfully connected to Redis instance")
+
+		return redisClient
+	}
+
+	// The stored reservations have to be re-keyed after the setting changes, see the README
+	if os.Getenv("EMAIL_PROVIDER_RULES") == "true" {
+		reservation.SetCanonicalizer(reservation.EmailNamespace, reservation.ProviderEmailCanonicalizer)
+	}
+
+	reservationStore, err := newReservationStore(ctx, logger, connectToRedis, sqlClient)
+	if err != nil {
+		logger.Error("failed to create the reservation store", "error", err)
+		os.Exit(1)
+	}
+
+	reserverOpts := reservation.ReserverOptions{Mode: reservation.StoreMode}
+	if mode := os.Getenv("RESERVATION_MODE"); mode != "" {
+		if reserverOpts.Mode, err = reservation.ParseMode(mode); err != nil {
+			logger.Error("failed to parse the reservation mode", "error", err)
+			os.Exit(1)
+		}
+	}
+	if lease := os.Getenv("RESERVATION_LEASE"); lease != "" {
+		if reserverOpts.Lease, err = time.ParseDuration(lease); err != nil {
+			logger.Error("failed to parse the reservation lease", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	reserver := reservation.NewReserver(esdbClient, reservationStore, reserverOpts)
+
+	var registrationTimeout time.Duration
+	if timeout := os.Getenv("REGISTRATION_TIMEOUT"); timeout != "" {
+		if registrationTimeout, err = time.ParseDuration(timeout); err != nil {
+			logger.Error("failed to parse the registration timeout", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		os.Exit(runReconcile(ctx, logger, reserver, sqlClient, os.Args[2:]))
+	}
+
+	// Redis stays mandatory for the server, it keeps the users, the idempotency keys and the registrations,
+	// whichever store keeps the reservations
+	connectToRedis()
+
+	registrations := registration.NewRegistrations(logger, esdbClient, redisClient, reserver, registrationTimeout)
+
+	monitor := db.NewMonitor()
+	searchIndex := projections.NewSearchIndex()
+
+	httpHandler, err := handler.NewHttpHandler(ctx, logger, esdbClient, sqlClient, redisClient, reserver, registrations, monitor, searchIndex)
 	if err != nil {
-		logger.Error("failed to connect to Redis instance", "error", err)
+		logger.Error("failed to create the HTTP handler", "error", err)
 		os.Exit(1)
 	}
-	logger.Info("successfully connected to Redis instance")
 
 	srv := &http.Server{
 		Addr:    ":8080",
-		Handler: handler.NewHttpHandler(ctx, logger, esdbClient, sqlClient, redisClient),
+		Handler: httpHandler,
 	}
 
 	userReady := make(chan struct{})
+	reservationsReady := make(chan struct{})
+	// The search index lives in memory, so it's rebuilt from the start on every boot
+	searchReady := make(chan struct{})
 
 	userEventHandler := utils.NewStartStop(ctx, func(stoppableCtx context.Context) error {
-		return handler.HandleUserStream(stoppableCtx, logger, esdbClient, sqlClient, userReady)
+		batchOpts := projections.BatchOptions{Size: 256, Interval: time.Second}
+		return handler.HandleUserStream(stoppableCtx, logger, esdbClient, sqlClient, redisClient, batchOpts, monitor, userReady)
+	})
+
+	loginsHandler := utils.NewStartStop(ctx, func(stoppableCtx context.Context) error {
+		loginsProjection := projections.NewLoginsProjection(stoppableCtx, sqlClient, monitor.Checkpoint(projections.LoginsCheckpoint))
+		return handler.HandleProjectionStream(stoppableCtx, logger, esdbClient, events.UserEventsStream, projections.LoginsCheckpoint, loginsProjection, monitor, nil)
+	})
+
+	timelineHandler := utils.NewStartStop(ctx, func(stoppableCtx context.Context) error {
+		timelineProjection := projections.NewTimelineProjection(stoppableCtx, sqlClient, monitor.Checkpoint(projections.TimelineCheckpoint))
+		return handler.HandleProjectionStream(stoppableCtx, logger, esdbClient, events.UserEventsStream, projections.TimelineCheckpoint, timelineProjection, monitor, nil)
+	})
+
+	searchHandler := utils.NewStartStop(ctx, func(stoppableCtx context.Context) error {
+		searchProjection := projections.NewSearchProjection(searchIndex, monitor.Checkpoint(projections.SearchCheckpoint))
+		return handler.HandleProjectionStream(stoppableCtx, logger, esdbClient, events.UserEventsStream, projections.SearchCheckpoint, searchProjection, monitor, searchReady)
 	})
 
 	reservationHandler := utils.NewStartStop(ctx, func(stoppableCtx context.Context) error {
-		return handler.HandleReservationStream(stoppableCtx, logger, esdbClient, redisClient)
+		return handler.HandleReservationStream(stoppableCtx, logger, esdbClient, redisClient, reserver, monitor, reservationsReady)
 	})
 
-	if err := reservation.RepopulateRedis(ctx, esdbClient, redisClient); err != nil {
-		logger.Error("failed to repopulate Redis with reservations", "error", err)
-		os.Exit(1)
-	}
+	registrationHandler := utils.NewStartStop(ctx, func(stoppableCtx context.Context) error {
+		tracker := monitor.TrackStreamType(registration.ManagerName, events.RegistrationStream)
+		return registrations.Run(stoppableCtx, tracker, time.Second)
+	})
+
+	go func() {
+		if err := monitor.Run(ctx, logger, esdbClient, 10*time.Second); err != nil {
+			logger.Error("subscription monitor returned an error", "error", err)
+		}
+	}()
 
 	go func() {
 		logger.Debug("starting user event handler")
@@ -67,6 +162,20 @@ func main() {
 		}
 	}()
 
+	go func() {
+		logger.Debug("starting search handler")
+		if err := searchHandler.Start(); err != nil {
+			logger.Error("search handler returned an error", "error", err)
+		}
+	}()
+
+	go func() {
+		logger.Debug("starting reservation handler")
+		if err := reservationHandler.Start(); err != nil {
+			logger.Error("reservation handler returned an error", "error", err)
+		}
+	}()
+
 	select {
 	case <-userReady:
 		logger.Debug("user event handler finished processing previous events")
@@ -74,6 +183,20 @@ func main() {
 		logger.Debug("interrupt received before user event handler finished processing previous events")
 	}
 
+	select {
+	case <-searchReady:
+		logger.Debug("search handler indexed the previous users")
+	case <-ctx.Done():
+		logger.Debug("interrupt received before search handler indexed the previous users")
+	}
+
+	select {
+	case <-reservationsReady:
+		logger.Debug("reservation handler caught up with previous reservations")
+	case <-ctx.Done():
+		logger.Debug("interrupt received before reservation handler caught up with previous reservations")
+	}
+
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			logger.Error("server's ListenAndServe method returned an error", "error", err)
@@ -81,8 +204,20 @@ func main() {
 	}()
 
 	go func() {
-		if err := reservationHandler.Start(); err != nil {
-			logger.Error("reservation handler returned an error", "error", err)
+		if err := loginsHandler.Start(); err != nil {
+			logger.Error("logins handler returned an error", "error", err)
+		}
+	}()
+
+	go func() {
+		if err := timelineHandler.Start(); err != nil {
+			logger.Error("timeline handler returned an error", "error", err)
+		}
+	}()
+
+	go func() {
+		if err := registrationHandler.Start(); err != nil {
+			logger.Error("registration handler returned an error", "error", err)
 		}
 	}()
 
@@ -99,7 +234,40 @@ func main() {
 		logger.Error("event handler shutdown returned an error", "error", err)
 	}
 
+	if err := loginsHandler.Stop(5 * time.Second); err != nil {
+		logger.Error("logins handler shutdown returned an error", "error", err)
+	}
+
+	if err := timelineHandler.Stop(5 * time.Second); err != nil {
+		logger.Error("timeline handler shutdown returned an error", "error", err)
+	}
+
+	if err := searchHandler.Stop(5 * time.Second); err != nil {
+		logger.Error("search handler shutdown returned an error", "error", err)
+	}
+
 	if err := reservationHandler.Stop(5 * time.Second); err != nil {
 		logger.Error("reservation handler shutdown returned an error", "error", err)
 	}
+
+	if err := registrationHandler.Stop(5 * time.Second); err != nil {
+		logger.Error("registration handler shutdown returned an error", "error", err)
+	}
+}
+
+/*
+Create the reservation store selected by the RESERVATION_STORE environment variable.
+
+Reservations are kept inside Redis by default and "sql" keeps them inside MariaDB.
+The in-memory store only works with a single process, so it's left to the tests.
+*/
+func newReservationStore(ctx context.Context, logger *slog.Logger, connectToRedis func() *redis.Client, sqlClient *sql.DB) (reservation.ReservationStore, error) {
+	switch store := os.Getenv("RESERVATION_STORE"); store {
+	case "", "redis":
+		return reservation.NewRedisStore(connectToRedis()), nil
+	case "sql":
+		return reservation.NewSqlStore(ctx, logger, sqlClient, time.Minute), nil
+	default:
+		return nil, fmt.Errorf("unknown reservation store: %s", store)
+	}
 }
@@ -0,0 +1,10 @@
+-- Checkpoints of the projections storing their read model inside MariaDB
+CREATE TABLE IF NOT EXISTS checkpoints(
+    name VARCHAR(255),
+    commit_position BIGINT UNSIGNED NOT NULL,
+    prepare_position BIGINT UNSIGNED NOT NULL,
+    version INT NOT NULL DEFAULT 0,
+    CONSTRAINT PRIMARY KEY (name)
+);
+-- Version of the projection which stored the checkpoint, a different version rebuilds the read model
+ALTER TABLE checkpoints ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 0;
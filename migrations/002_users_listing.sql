@@ -0,0 +1,6 @@
+-- Email domain the user listing is filtered by, and the indexes of its sort orders (named like the ones of base.sql)
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS email_domain VARCHAR(255) AS (SUBSTRING_INDEX(email, '@', -1)) STORED,
+    ADD INDEX IF NOT EXISTS login_count (login_count, username),
+    ADD INDEX IF NOT EXISTS version (version, username),
+    ADD INDEX IF NOT EXISTS email_domain (email_domain, username);
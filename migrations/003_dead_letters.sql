@@ -0,0 +1,12 @@
+-- Events which the batched users projection skipped after failing to apply them
+CREATE TABLE IF NOT EXISTS dead_letters(
+    projection VARCHAR(255),
+    stream_id VARCHAR(255),
+    event_number BIGINT UNSIGNED NOT NULL,
+    event_type VARCHAR(255) NOT NULL,
+    commit_position BIGINT UNSIGNED NOT NULL,
+    prepare_position BIGINT UNSIGNED NOT NULL,
+    error TEXT NOT NULL,
+    failed_at DATETIME(6) NOT NULL,
+    CONSTRAINT PRIMARY KEY (projection, stream_id, event_number)
+);
@@ -0,0 +1,33 @@
+-- Read models of the logins and timeline projections
+CREATE TABLE IF NOT EXISTS user_logins_daily(
+    username VARCHAR(255),
+    day DATE NOT NULL,
+    count INT NOT NULL DEFAULT 0,
+    CONSTRAINT PRIMARY KEY (username, day),
+    INDEX (day)
+);
+CREATE TABLE IF NOT EXISTS user_login_stats(
+    username VARCHAR(255),
+    first_login DATETIME(6) NOT NULL,
+    last_login DATETIME(6) NOT NULL,
+    version BIGINT NOT NULL,
+    CONSTRAINT PRIMARY KEY (username),
+    INDEX (last_login)
+);
+CREATE TABLE IF NOT EXISTS user_timeline(
+    username VARCHAR(255),
+    event_number BIGINT UNSIGNED NOT NULL,
+    event_type VARCHAR(255) NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    summary VARCHAR(1024) NOT NULL,
+    metadata TEXT NOT NULL,
+    CONSTRAINT PRIMARY KEY (username, event_number)
+);
+-- Reservations of the SQL reservation store, the keys are case sensitive
+CREATE TABLE IF NOT EXISTS reservations(
+    reservation_key VARCHAR(512) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin,
+    token VARCHAR(255) NOT NULL,
+    expires_at DATETIME(6) NULL,
+    CONSTRAINT PRIMARY KEY (reservation_key),
+    INDEX (expires_at)
+);
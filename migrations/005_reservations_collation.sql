@@ -0,0 +1,2 @@
+-- Reservation keys are case sensitive, the keys of the tables created before were compared case insensitively
+ALTER TABLE reservations MODIFY reservation_key VARCHAR(512) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,335 @@
+package projections
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/aggregates"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+)
+
+// Name under which the users projection stores its checkpoint
+const UsersCheckpoint string = "users"
+
+const usersProjectionVersion int = 1
+
+// Number of flushes an event can fail in before it's recorded as a dead letter and skipped
+const maxEventAttempts int = 3
+
+type BatchOptions struct {
+	// Maximum number of events in a batch, batching is disabled when it's zero
+	Size int
+	// Maximum time an event waits inside a batch before it's flushed
+	Interval time.Duration
+}
+
+type batchedDbProjection struct {
+	ctx       context.Context
+	logger    *slog.Logger
+	sqlClient *sql.DB
+	opts      BatchOptions
+	committed *db.ProjectionCheckpoint
+
+	mu              sync.Mutex
+	batch           []esdb.RecordedEvent
+	checkpoint      esdb.Position
+	savedCheckpoint esdb.Position
+	// Failed flushes of the events which are retried, by their position
+	attempts map[esdb.Position]int
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+/*
+Create a database projection which accumulates events and applies them,
+together with the checkpoint, inside a single MariaDB transaction.
+
+The batch is flushed when it reaches the size limit, when the interval
+elapses and when the projection is closed. The committed checkpoint (can be nil)
+is advanced after every flush, unless some of the events failed to apply.
+An event failing in maxEventAttempts flushes is recorded in the dead_letters table and skipped.
+*/
+func NewBatchedDatabaseProjection(ctx context.Context, logger *slog.Logger, sqlClient *sql.DB, opts BatchOptions, committed *db.ProjectionCheckpoint) CheckpointedProjection {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+
+	p := &batchedDbProjection{
+		ctx:       ctx,
+		logger:    logger,
+		sqlClient: sqlClient,
+		opts:      opts,
+		committed: committed,
+		attempts:  map[esdb.Position]int{},
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	go p.run()
+
+	return p
+}
+
+func (p *batchedDbProjection) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if err := p.Flush(); err != nil {
+				p.logger.Error("flushing the batched database projection returned an error", "error", err)
+			}
+		}
+	}
+}
+
+func (p *batchedDbProjection) HandleEvent(event esdb.RecordedEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.batch = append(p.batch, event)
+
+	if len(p.batch) >= p.opts.Size {
+		return p.flush(p.ctx)
+	}
+
+	return nil
+}
+
+func (p *batchedDbProjection) Version() int {
+	return usersProjectionVersion
+}
+
+func (p *batchedDbProjection) Checkpoint() (esdb.AllPosition, int, error) {
+	return db.GetCheckpoint(p.ctx, p.sqlClient, UsersCheckpoint)
+}
+
+func (p *batchedDbProjection) Reset() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := db.ResetProjection(p.ctx, p.sqlClient, UsersCheckpoint, "users"); err != nil {
+		return err
+	}
+
+	p.batch = nil
+	p.checkpoint = esdb.Position{}
+	p.savedCheckpoint = esdb.Position{}
+	p.attempts = map[esdb.Position]int{}
+
+	return nil
+}
+
+func (p *batchedDbProjection) SetCheckpoint(position esdb.Position) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.checkpoint = position
+}
+
+func (p *batchedDbProjection) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.flush(p.ctx)
+}
+
+func (p *batchedDbProjection) Close() error {
+	var err error
+
+	p.closeOnce.Do(func() {
+		close(p.stop)
+		<-p.done
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		err = p.flush(context.WithoutCancel(p.ctx))
+	})
+
+	return err
+}
+
+func (p *batchedDbProjection) flush(ctx context.Context) error {
+	if len(p.batch) == 0 && p.checkpoint == p.savedCheckpoint {
+		return nil
+	}
+
+	batch := p.batch
+	checkpoint := p.checkpoint
+	p.batch = nil
+
+	err := p.inTransaction(ctx, func(tx *sql.Tx) error {
+		if err := applyBatch(ctx, tx, batch); err != nil {
+			return err
+		}
+		return db.SaveCheckpoint(ctx, tx, UsersCheckpoint, checkpoint, usersProjectionVersion)
+	})
+	if err == nil {
+		p.savedCheckpoint = checkpoint
+		p.committed.Advance(checkpoint)
+		return nil
+	}
+
+	// One bad event shouldn't prevent the rest of the batch from being applied,
+	// so we fallback to applying the events one by one.
+	errs := []error{fmt.Errorf("failed to apply the batch of %d events, applying them one by one: %w", len(batch), err)}
+
+	var failed []esdb.RecordedEvent
+	for _, event := range batch {
+		err := p.inTransaction(ctx, func(tx *sql.Tx) error {
+			return applyBatch(ctx, tx, []esdb.RecordedEvent{event})
+		})
+		if err == nil {
+			delete(p.attempts, event.Position)
+			continue
+		}
+
+		if p.skip(ctx, event, err) {
+			continue
+		}
+
+		errs = append(errs, fmt.Errorf("failed to apply event %d of stream %s: %w", event.EventNumber, event.StreamID, err))
+		failed = append(failed, event)
+	}
+
+	// The checkpoint must not pass the failed events, they are retried with the next flush
+	if len(failed) > 0 {
+		p.batch = append(failed, p.batch...)
+		return errors.Join(errs...)
+	}
+
+	if err := db.SaveCheckpoint(ctx, p.sqlClient, UsersCheckpoint, checkpoint, usersProjectionVersion); err != nil {
+		errs = append(errs, err)
+	} else {
+		p.savedCheckpoint = checkpoint
+		p.committed.Advance(checkpoint)
+	}
+
+	return errors.Join(errs...)
+}
+
+/*
+Records the failed event as a dead letter and reports whether it can be skipped,
+which it can once it failed in maxEventAttempts flushes and its dead letter is saved.
+*/
+func (p *batchedDbProjection) skip(ctx context.Context, event esdb.RecordedEvent, cause error) bool {
+	p.attempts[event.Position]++
+	if p.attempts[event.Position] < maxEventAttempts {
+		return false
+	}
+
+	if err := db.SaveDeadLetter(ctx, p.sqlClient, UsersCheckpoint, event, cause); err != nil {
+		p.logger.Error("failed to record the dead letter, the event is retried", "error", err)
+		return false
+	}
+
+	p.logger.Error("skipping the event which failed to apply",
+		"streamId", event.StreamID,
+		"eventNumber", event.EventNumber,
+		"attempts", p.attempts[event.Position],
+		"error", cause,
+	)
+	delete(p.attempts, event.Position)
+
+	return true
+}
+
+func (p *batchedDbProjection) inTransaction(ctx context.Context, f func(*sql.Tx) error) error {
+	tx, err := p.sqlClient.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin a transaction: %w", err)
+	}
+
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit the transaction: %w", err)
+	}
+
+	return nil
+}
+
+/*
+Apply the events to the users read model.
+
+Events which were already applied are skipped, so replaying a batch is safe.
+*/
+func applyBatch(ctx context.Context, q db.Querier, batch []esdb.RecordedEvent) error {
+	var usernames []string
+	isLoaded := map[string]bool{}
+	eventUsernames := make([]string, len(batch))
+
+	for i, re := range batch {
+		var event struct {
+			Username string `json:"username"`
+		}
+		if err := json.Unmarshal(re.Data, &event); err != nil {
+			return fmt.Errorf("failed to unmarshal event: %w", err)
+		}
+
+		eventUsernames[i] = event.Username
+		if !isLoaded[event.Username] {
+			isLoaded[event.Username] = true
+			usernames = append(usernames, event.Username)
+		}
+	}
+
+	users, err := db.GetUsersByUsername(ctx, q, usernames)
+	if err != nil {
+		return err
+	}
+
+	var changed []string
+	isChanged := map[string]bool{}
+
+	for i, re := range batch {
+		username := eventUsernames[i]
+		user, exists := users[username]
+
+		if exists && re.EventNumber <= user.Version {
+			continue
+		}
+
+		if !exists && re.EventType != string(events.CreateUser) {
+			return fmt.Errorf("user %s does not exist", username)
+		}
+
+		updated, err := user.Apply(re)
+		if err != nil {
+			return err
+		}
+
+		users[username] = updated
+
+		if !isChanged[username] {
+			isChanged[username] = true
+			changed = append(changed, username)
+		}
+	}
+
+	changedUsers := make([]aggregates.User, len(changed))
+	for i, username := range changed {
+		changedUsers[i] = users[username]
+	}
+
+	return db.UpsertUsers(ctx, q, changedUsers)
+}
@@ -0,0 +1,296 @@
+package projections_test
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/aggregates"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+	"github.com/MatejaMaric/esdb-playground/projections"
+	"github.com/MatejaMaric/esdb-playground/utils"
+	"github.com/go-test/deep"
+)
+
+func fakeUserHistory(users, logins int) []esdb.RecordedEvent {
+	var res []esdb.RecordedEvent
+
+	for u := 0; u < users; u++ {
+		username := fmt.Sprintf("user%d", u)
+
+		fes := []utils.FakeEvent{{
+			Type: events.CreateUser,
+			Data: events.CreateUserEvent{Username: username, Email: username + "@test.com"},
+		}}
+		for l := 0; l < logins; l++ {
+			fes = append(fes, utils.FakeEvent{Type: events.LoginUser, Data: events.LoginUserEvent{Username: username}})
+		}
+
+		res = append(res, utils.FakeRecordedEvents(events.UserEventsStream.ForUser(username), fes)...)
+	}
+
+	for i := range res {
+		res[i].Position = esdb.Position{Commit: uint64(i + 1), Prepare: uint64(i + 1)}
+	}
+
+	return res
+}
+
+func truncateProjection(t testing.TB) {
+	if _, err := TestSqlClient.Exec("TRUNCATE TABLE users; TRUNCATE TABLE checkpoints;"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatchedDatabaseProjection(t *testing.T) {
+	ctx := context.Background()
+	truncateProjection(t)
+
+	history := fakeUserHistory(3, 4)
+
+	var p projections.CheckpointedProjection
+
+	// The second pass simulates a replay after a crash, it must not change the read model
+	for pass := 0; pass < 2; pass++ {
+		p = projections.NewBatchedDatabaseProjection(ctx, slog.Default(), TestSqlClient, projections.BatchOptions{Size: 5, Interval: time.Hour}, nil)
+
+		for _, event := range history {
+			if err := p.HandleEvent(event); err != nil {
+				t.Fatal(err)
+			}
+			p.SetCheckpoint(event.Position)
+		}
+
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users, err := db.GetAllUsers(ctx, TestSqlClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedUsers := []aggregates.User{
+		{Username: "user0", Email: "user0@test.com", LoginCount: 4, Version: 4},
+		{Username: "user1", Email: "user1@test.com", LoginCount: 4, Version: 4},
+		{Username: "user2", Email: "user2@test.com", LoginCount: 4, Version: 4},
+	}
+
+	if diff := deep.Equal(expectedUsers, users); diff != nil {
+		t.Fatalf("unexpected users:\n%v\n", strings.Join(diff, "\n"))
+	}
+
+	checkpoint, version, err := db.GetCheckpoint(ctx, TestSqlClient, projections.UsersCheckpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != p.Version() {
+		t.Fatalf("unexpected checkpoint version %d, wanted %d", version, p.Version())
+	}
+
+	if diff := deep.Equal(esdb.AllPosition(history[len(history)-1].Position), checkpoint); diff != nil {
+		t.Fatalf("unexpected checkpoint:\n%v\n", strings.Join(diff, "\n"))
+	}
+}
+
+func TestDatabaseProjectionReplay(t *testing.T) {
+	ctx := context.Background()
+	truncateProjection(t)
+
+	history := fakeUserHistory(2, 3)
+
+	p := projections.NewDatabaseProjection(ctx, TestSqlClient, nil)
+
+	// The second pass simulates a rebuild, it must not change the read model
+	for pass := 0; pass < 2; pass++ {
+		for _, event := range history {
+			if err := p.HandleEvent(event); err != nil {
+				t.Fatal(err)
+			}
+			p.SetCheckpoint(event.Position)
+		}
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := db.GetAllUsers(ctx, TestSqlClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedUsers := []aggregates.User{
+		{Username: "user0", Email: "user0@test.com", LoginCount: 3, Version: 3},
+		{Username: "user1", Email: "user1@test.com", LoginCount: 3, Version: 3},
+	}
+
+	if diff := deep.Equal(expectedUsers, users); diff != nil {
+		t.Fatalf("unexpected users:\n%v\n", strings.Join(diff, "\n"))
+	}
+
+	checkpoint, version, err := db.GetCheckpoint(ctx, TestSqlClient, projections.UsersCheckpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != p.Version() {
+		t.Fatalf("unexpected checkpoint version %d, wanted %d", version, p.Version())
+	}
+
+	if diff := deep.Equal(esdb.AllPosition(history[len(history)-1].Position), checkpoint); diff != nil {
+		t.Fatalf("unexpected checkpoint:\n%v\n", strings.Join(diff, "\n"))
+	}
+}
+
+func BenchmarkDatabaseProjectionReplay(b *testing.B) {
+	ctx := context.Background()
+	history := fakeUserHistory(100, 9)
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		truncateProjection(b)
+		p := projections.NewDatabaseProjection(ctx, TestSqlClient, nil)
+		b.StartTimer()
+
+		for _, event := range history {
+			if err := p.HandleEvent(event); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkBatchedDatabaseProjectionReplay(b *testing.B) {
+	ctx := context.Background()
+	history := fakeUserHistory(100, 9)
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		truncateProjection(b)
+		p := projections.NewBatchedDatabaseProjection(ctx, slog.Default(), TestSqlClient, projections.BatchOptions{Size: 256, Interval: time.Hour}, nil)
+		b.StartTimer()
+
+		for _, event := range history {
+			if err := p.HandleEvent(event); err != nil {
+				b.Fatal(err)
+			}
+			p.SetCheckpoint(event.Position)
+		}
+
+		if err := p.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestBatchedDatabaseProjectionKeepsCheckpointBeforeFailedEvents(t *testing.T) {
+	ctx := context.Background()
+	truncateProjection(t)
+
+	committed := db.NewProjectionCheckpoint()
+	p := projections.NewBatchedDatabaseProjection(ctx, slog.Default(), TestSqlClient, projections.BatchOptions{Size: 5, Interval: time.Hour}, committed)
+
+	// A login of a user which doesn't exist can't be applied
+	ghost := utils.FakeRecordedEvents(events.UserEventsStream.ForUser("ghost"), []utils.FakeEvent{
+		{Type: events.LoginUser, Data: events.LoginUserEvent{Username: "ghost"}},
+	})[0]
+	ghost.EventNumber = 1
+	ghost.Position = esdb.Position{Commit: 1, Prepare: 1}
+
+	if err := p.HandleEvent(ghost); err != nil {
+		t.Fatal(err)
+	}
+	p.SetCheckpoint(ghost.Position)
+
+	if err := p.Close(); err == nil {
+		t.Fatal("expected the flush of the failed event to return an error")
+	}
+
+	checkpoint, _, err := db.GetCheckpoint(ctx, TestSqlClient, projections.UsersCheckpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, isStart := checkpoint.(esdb.Start); !isStart {
+		t.Fatalf("the checkpoint moved past the failed event to %v", checkpoint)
+	}
+
+	if position := committed.Position(); position != (esdb.Position{}) {
+		t.Fatalf("the committed checkpoint moved past the failed event to %v", position)
+	}
+}
+
+func TestBatchedDatabaseProjectionSkipsDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	truncateProjection(t)
+	if _, err := TestSqlClient.Exec("TRUNCATE TABLE dead_letters"); err != nil {
+		t.Fatal(err)
+	}
+
+	committed := db.NewProjectionCheckpoint()
+	p := projections.NewBatchedDatabaseProjection(ctx, slog.Default(), TestSqlClient, projections.BatchOptions{Size: 5, Interval: time.Hour}, committed)
+	flusher := p.(interface{ Flush() error })
+
+	// A login of a user which doesn't exist can't be applied, the user created after it can
+	reArr := utils.FakeRecordedEvents(events.UserEventsStream.ForUser("ghost"), []utils.FakeEvent{
+		{Type: events.LoginUser, Data: events.LoginUserEvent{Username: "ghost"}},
+	})
+	reArr = append(reArr, utils.FakeRecordedEvents(events.UserEventsStream.ForUser("alive"), []utils.FakeEvent{
+		{Type: events.CreateUser, Data: events.CreateUserEvent{Username: "alive", Email: "alive@test.com"}},
+	})...)
+	reArr[0].EventNumber = 1
+	for i := range reArr {
+		reArr[i].Position = esdb.Position{Commit: uint64(i + 1), Prepare: uint64(i + 1)}
+		if err := p.HandleEvent(reArr[i]); err != nil {
+			t.Fatal(err)
+		}
+		p.SetCheckpoint(reArr[i].Position)
+	}
+
+	// The failed event is retried by the next flushes, until it's skipped
+	for attempt := 1; attempt < 3; attempt++ {
+		if err := flusher.Flush(); err == nil {
+			t.Fatalf("expected flush %d to fail", attempt)
+		}
+		if position := committed.Position(); position != (esdb.Position{}) {
+			t.Fatalf("the committed checkpoint moved past the failed event to %v", position)
+		}
+	}
+
+	// The error of the batch is still returned, even though its events are applied or skipped
+	flusher.Flush()
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	last := reArr[len(reArr)-1].Position
+	checkpoint, _, err := db.GetCheckpoint(ctx, TestSqlClient, projections.UsersCheckpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint != last || committed.Position() != last {
+		t.Fatalf("the checkpoint %v didn't move past the skipped event", checkpoint)
+	}
+
+	var streamID string
+	var eventNumber uint64
+	err = TestSqlClient.QueryRowContext(ctx, "SELECT stream_id, event_number FROM dead_letters WHERE projection = ?", projections.UsersCheckpoint).Scan(&streamID, &eventNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamID != reArr[0].StreamID || eventNumber != reArr[0].EventNumber {
+		t.Fatalf("unexpected dead letter of event %d of stream %s", eventNumber, streamID)
+	}
+
+	if _, err := db.GetUser(ctx, TestSqlClient, "alive"); err != nil {
+		t.Fatal(err)
+	}
+}
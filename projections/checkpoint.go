@@ -0,0 +1,125 @@
+package projections
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+)
+
+/*
+Checkpoint stored inside MariaDB, shared by the projections which apply every event in its own transaction.
+
+Embedding it implements every CheckpointedProjection method except HandleEvent.
+*/
+type sqlCheckpoint struct {
+	ctx       context.Context
+	sqlClient *sql.DB
+	name      string
+	version   int
+	tables    []string
+	committed *db.ProjectionCheckpoint
+
+	mu              sync.Mutex
+	checkpoint      esdb.Position
+	savedCheckpoint esdb.Position
+}
+
+// The tables are the ones holding the projection's read model
+func newSqlCheckpoint(ctx context.Context, sqlClient *sql.DB, name string, version int, tables []string, committed *db.ProjectionCheckpoint) sqlCheckpoint {
+	return sqlCheckpoint{
+		ctx:       ctx,
+		sqlClient: sqlClient,
+		name:      name,
+		version:   version,
+		tables:    tables,
+		committed: committed,
+	}
+}
+
+/*
+Runs the function inside a transaction.
+
+The checkpoint isn't stored with the changes, the transactions of the workers would all update its row.
+The position of the event is stored once every previous event is handled as well, see SetCheckpoint,
+the events after the stored checkpoint are replayed if the process stops before it's stored.
+*/
+func (c *sqlCheckpoint) inTransaction(f func(*sql.Tx) error) error {
+	tx, err := c.sqlClient.BeginTx(c.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := f(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit the transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (c *sqlCheckpoint) Version() int {
+	return c.version
+}
+
+func (c *sqlCheckpoint) Checkpoint() (esdb.AllPosition, int, error) {
+	return db.GetCheckpoint(c.ctx, c.sqlClient, c.name)
+}
+
+func (c *sqlCheckpoint) Reset() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := db.ResetProjection(c.ctx, c.sqlClient, c.name, c.tables...); err != nil {
+		return err
+	}
+
+	c.checkpoint = esdb.Position{}
+	c.savedCheckpoint = esdb.Position{}
+
+	return nil
+}
+
+/*
+The changes of the events up to the position are already committed, so readers can see them right away.
+
+The position is stored as well, a failed save is retried with the next position or by Close, which returns its error.
+*/
+func (c *sqlCheckpoint) SetCheckpoint(position esdb.Position) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checkpoint = position
+	c.committed.Advance(position)
+
+	c.save(c.ctx)
+}
+
+func (c *sqlCheckpoint) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.save(context.WithoutCancel(c.ctx))
+}
+
+// Stores the checkpoint unless it's already stored, the caller holds the mutex
+func (c *sqlCheckpoint) save(ctx context.Context) error {
+	if c.checkpoint == c.savedCheckpoint {
+		return nil
+	}
+
+	if err := db.SaveCheckpoint(ctx, c.sqlClient, c.name, c.checkpoint, c.version); err != nil {
+		return err
+	}
+
+	c.savedCheckpoint = c.checkpoint
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package projections_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+	"github.com/MatejaMaric/esdb-playground/projections"
+	"github.com/MatejaMaric/esdb-playground/utils"
+)
+
+func TestProjectionReset(t *testing.T) {
+	ctx := context.Background()
+
+	reArr := utils.FakeRecordedEvents(events.UserEventsStream.ForUser("reset"), []utils.FakeEvent{
+		{Type: events.CreateUser, Data: events.CreateUserEvent{Username: "reset", Email: "reset@test.com"}},
+	})
+
+	p := projections.NewTimelineProjection(ctx, TestSqlClient, nil)
+	p.SetCheckpoint(esdb.Position{Commit: 1, Prepare: 1})
+
+	if err := p.HandleEvent(reArr[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	from, version, err := p.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != (esdb.Position{Commit: 1, Prepare: 1}) || version != p.Version() {
+		t.Fatalf("unexpected checkpoint %v with version %d", from, version)
+	}
+
+	if err := p.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	if from, _, err := p.Checkpoint(); err != nil || from != (esdb.Start{}) {
+		t.Fatalf("checkpoint should be removed after a reset, got %v (error: %v)", from, err)
+	}
+
+	entries, err := db.GetTimeline(ctx, TestSqlClient, "reset", nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("read model should be empty after a reset, got %d entries", len(entries))
+	}
+}
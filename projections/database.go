@@ -13,14 +13,18 @@ import (
 )
 
 type dbProjection struct {
-	ctx       context.Context
-	sqlClient *sql.DB
+	sqlCheckpoint
 }
 
-func NewDatabaseProjection(ctx context.Context, sqlClient *sql.DB) Projection {
+/*
+Create a database projection which applies every event inside its own transaction, see sqlCheckpoint.inTransaction.
+
+It shares the read model, the checkpoint and the version with the batched database projection.
+The committed checkpoint (can be nil) is advanced once the changes of an event are committed.
+*/
+func NewDatabaseProjection(ctx context.Context, sqlClient *sql.DB, committed *db.ProjectionCheckpoint) CheckpointedProjection {
 	return &dbProjection{
-		ctx:       ctx,
-		sqlClient: sqlClient,
+		sqlCheckpoint: newSqlCheckpoint(ctx, sqlClient, UsersCheckpoint, usersProjectionVersion, []string{"users"}, committed),
 	}
 }
 
@@ -41,11 +45,12 @@ func (p *dbProjection) handleCreateUserEvent(re esdb.RecordedEvent) error {
 		return err
 	}
 
-	if _, err := db.InsertUser(p.ctx, p.sqlClient, user); err != nil {
-		return fmt.Errorf("failed to insert user: %w", err)
-	}
-
-	return nil
+	return p.inTransaction(func(tx *sql.Tx) error {
+		if _, err := db.InsertUser(p.ctx, tx, user); err != nil {
+			return fmt.Errorf("failed to insert user: %w", err)
+		}
+		return nil
+	})
 }
 
 func (p *dbProjection) handleLoginUserEvent(re esdb.RecordedEvent) error {
@@ -54,24 +59,31 @@ func (p *dbProjection) handleLoginUserEvent(re esdb.RecordedEvent) error {
 		return fmt.Errorf("failed to unmarshal event: %w", err)
 	}
 
-	user, err := db.GetUser(p.ctx, p.sqlClient, event.Username)
-	if err != nil {
-		return err
-	}
+	return p.inTransaction(func(tx *sql.Tx) error {
+		user, err := db.GetUser(p.ctx, tx, event.Username)
+		if err != nil {
+			return err
+		}
 
-	user, err = user.ApplyLoginUser(re)
-	if err != nil {
-		return err
-	}
+		// The event was already applied, subscriptions deliver the events at least once
+		if re.EventNumber <= user.Version {
+			return nil
+		}
 
-	affectedUsers, err := db.UpdateUser(p.ctx, p.sqlClient, user)
-	if err != nil {
-		return fmt.Errorf("error updating the user %s: %w", user.Username, err)
-	}
+		user, err = user.ApplyLoginUser(re)
+		if err != nil {
+			return err
+		}
 
-	if affectedUsers != 1 {
-		return fmt.Errorf("unexpected number of affected users: %d", affectedUsers)
-	}
+		affectedUsers, err := db.UpdateUser(p.ctx, tx, user)
+		if err != nil {
+			return fmt.Errorf("error updating the user %s: %w", user.Username, err)
+		}
+
+		if affectedUsers != 1 {
+			return fmt.Errorf("unexpected number of affected users: %d", affectedUsers)
+		}
 
-	return nil
+		return nil
+	})
 }
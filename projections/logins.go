@@ -0,0 +1,54 @@
+package projections
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+)
+
+// Name under which the logins projection stores its checkpoint
+const LoginsCheckpoint string = "user_logins"
+
+const loginsProjectionVersion int = 1
+
+type loginsProjection struct {
+	sqlCheckpoint
+}
+
+/*
+Create a projection which counts user logins per day and tracks the first
+and the last login of every user, using the time the events were recorded.
+
+The committed checkpoint (can be nil) is advanced once the changes of an event are committed.
+*/
+func NewLoginsProjection(ctx context.Context, sqlClient *sql.DB, committed *db.ProjectionCheckpoint) CheckpointedProjection {
+	return &loginsProjection{
+		sqlCheckpoint: newSqlCheckpoint(ctx, sqlClient, LoginsCheckpoint, loginsProjectionVersion, []string{"user_logins_daily", "user_login_stats"}, committed),
+	}
+}
+
+func (p *loginsProjection) HandleEvent(event esdb.RecordedEvent) error {
+	switch event.EventType {
+	case string(events.LoginUser):
+		return p.handleLoginUserEvent(event)
+	default:
+		return nil
+	}
+}
+
+func (p *loginsProjection) handleLoginUserEvent(re esdb.RecordedEvent) error {
+	var event events.LoginUserEvent
+	if err := json.Unmarshal(re.Data, &event); err != nil {
+		return fmt.Errorf("failed to unmarshal event: %w", err)
+	}
+
+	return p.inTransaction(func(tx *sql.Tx) error {
+		_, err := db.RecordLogin(p.ctx, tx, event.Username, re.EventNumber, re.CreatedDate)
+		return err
+	})
+}
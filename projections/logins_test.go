@@ -0,0 +1,97 @@
+package projections_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+	"github.com/MatejaMaric/esdb-playground/projections"
+	"github.com/MatejaMaric/esdb-playground/utils"
+	"github.com/go-test/deep"
+)
+
+func TestLoginsProjection(t *testing.T) {
+	ctx := context.Background()
+
+	reArr := utils.FakeRecordedEvents(events.UserEventsStream.ForUser("logins"), []utils.FakeEvent{
+		{Type: events.CreateUser, Data: events.CreateUserEvent{Username: "logins", Email: "logins@test.com"}},
+		{Type: events.LoginUser, Data: events.LoginUserEvent{Username: "logins"}},
+		{Type: events.LoginUser, Data: events.LoginUserEvent{Username: "logins"}},
+		{Type: events.LoginUser, Data: events.LoginUserEvent{Username: "logins"}},
+	})
+
+	day1 := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	reArr[1].CreatedDate = day1
+	reArr[2].CreatedDate = day1.Add(time.Hour)
+	reArr[3].CreatedDate = day2
+
+	p := projections.NewLoginsProjection(ctx, TestSqlClient, nil)
+
+	// Every event is handled twice, the second time it must be skipped
+	for _, re := range append(reArr, reArr...) {
+		if err := p.HandleEvent(re); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logins, err := db.GetUserLogins(ctx, TestSqlClient, "logins", day1, day2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedLogins := []db.DailyLogins{
+		{Day: day1.Truncate(24 * time.Hour), Logins: 2},
+		{Day: day2.Truncate(24 * time.Hour), Logins: 1},
+	}
+
+	if diff := deep.Equal(expectedLogins, logins); diff != nil {
+		t.Fatalf("unexpected logins:\n%v\n", strings.Join(diff, "\n"))
+	}
+}
+
+func TestLoginsProjectionCommitsTheLatestWrite(t *testing.T) {
+	ctx := context.Background()
+
+	reArr := utils.FakeRecordedEvents(events.UserEventsStream.ForUser("latest"), []utils.FakeEvent{
+		{Type: events.CreateUser, Data: events.CreateUserEvent{Username: "latest", Email: "latest@test.com"}},
+		{Type: events.LoginUser, Data: events.LoginUserEvent{Username: "latest"}},
+	})
+
+	day := time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC)
+	for i := range reArr {
+		reArr[i].CreatedDate = day
+		reArr[i].Position = esdb.Position{Commit: uint64(100 + i), Prepare: uint64(100 + i)}
+	}
+
+	committed := db.NewProjectionCheckpoint()
+	p := projections.NewLoginsProjection(ctx, TestSqlClient, committed)
+
+	// The partitioned handler sets the checkpoint once the event is handled
+	for _, re := range reArr {
+		if err := p.HandleEvent(re); err != nil {
+			t.Fatal(err)
+		}
+		p.SetCheckpoint(re.Position)
+	}
+
+	// A read with the consistency token of the last write must not wait for another event
+	waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := committed.Wait(waitCtx, reArr[1].Position.Commit); err != nil {
+		t.Fatalf("the committed checkpoint doesn't cover the latest write: %v", err)
+	}
+
+	logins, err := db.GetUserLogins(ctx, TestSqlClient, "latest", day, day)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := deep.Equal([]db.DailyLogins{{Day: day.Truncate(24 * time.Hour), Logins: 1}}, logins); diff != nil {
+		t.Fatalf("unexpected logins:\n%v\n", strings.Join(diff, "\n"))
+	}
+}
@@ -5,3 +5,18 @@ import "github.com/EventStore/EventStore-Client-Go/v3/esdb"
 type Projection interface {
 	HandleEvent(esdb.RecordedEvent) error
 }
+
+// Projection which stores the position of the last event it handled
+type CheckpointedProjection interface {
+	Projection
+	// Version of the projection's logic, it should be bumped whenever the produced read model changes
+	Version() int
+	// Returns the position from which the projection should continue handling events, and the version which stored it
+	Checkpoint() (esdb.AllPosition, int, error)
+	// Marks every event up to and including the position as handled
+	SetCheckpoint(esdb.Position)
+	// Removes the read model and the checkpoint, so it can be rebuilt from the beginning
+	Reset() error
+	// Flushes the pending changes and stops the projection
+	Close() error
+}
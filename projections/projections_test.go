@@ -0,0 +1,52 @@
+package projections_test
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/MatejaMaric/esdb-playground/tests"
+	"github.com/ory/dockertest/v3"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	TestSqlClient   *sql.DB
+	TestRedisClient *redis.Client
+)
+
+func TestMain(m *testing.M) {
+	pool := tests.SetupDockertestPool()
+
+	var resourceMariaDB, resourceRedis *dockertest.Resource
+
+	eg := &errgroup.Group{}
+
+	eg.Go(func() error {
+		var err error
+		TestSqlClient, resourceMariaDB, err = tests.SpawnTestMariaDB(pool)
+		if err != nil {
+			return err
+		}
+		return tests.CreateSchema(TestSqlClient, "../initdb.d/base.sql")
+	})
+
+	eg.Go(func() error {
+		var err error
+		TestRedisClient, resourceRedis, err = tests.SpawnTestRedis(pool)
+		return err
+	})
+
+	if err := eg.Wait(); err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+
+	// You can't defer this because os.Exit doesn't care for defer
+	tests.PurgeResources(pool, resourceMariaDB, resourceRedis)
+
+	os.Exit(code)
+}
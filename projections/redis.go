@@ -0,0 +1,93 @@
+package projections
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+	"github.com/redis/go-redis/v9"
+)
+
+type redisProjection struct {
+	ctx         context.Context
+	esdbClient  *esdb.Client
+	redisClient *redis.Client
+}
+
+/*
+Create a projection which keeps every user aggregate as a Redis hash.
+
+When the stored user is missing or behind the handled event, the user is
+aggregated from its stream instead.
+*/
+func NewRedisProjection(ctx context.Context, esdbClient *esdb.Client, redisClient *redis.Client) Projection {
+	return &redisProjection{
+		ctx:         ctx,
+		esdbClient:  esdbClient,
+		redisClient: redisClient,
+	}
+}
+
+func (p *redisProjection) HandleEvent(re esdb.RecordedEvent) error {
+	var event struct {
+		Username string `json:"username"`
+	}
+	if err := json.Unmarshal(re.Data, &event); err != nil {
+		return fmt.Errorf("failed to unmarshal event: %w", err)
+	}
+
+	user, found, err := db.GetUserFromRedis(p.ctx, p.redisClient, event.Username)
+	if err != nil {
+		return err
+	}
+
+	if found && re.EventNumber <= user.Version {
+		return nil
+	}
+
+	if (!found && re.EventType != string(events.CreateUser)) || (found && re.EventNumber != user.Version+1) {
+		user, err = db.NewUserFromStream(p.ctx, p.esdbClient, event.Username)
+	} else {
+		user, err = user.Apply(re)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = db.SaveUserToRedis(p.ctx, p.redisClient, user)
+	return err
+}
+
+type VersionMismatch struct {
+	Username      string  `json:"username"`
+	RedisVersion  *uint64 `json:"redis_version"`
+	StreamVersion uint64  `json:"stream_version"`
+}
+
+// Compares the versions of the users stored inside Redis with the revisions of their streams
+func CheckRedisConsistency(ctx context.Context, esdbClient *esdb.Client, redisClient *redis.Client, usernames []string) ([]VersionMismatch, error) {
+	mismatches := []VersionMismatch{}
+
+	for _, username := range usernames {
+		streamVersion, err := db.GetStreamRevision(ctx, esdbClient, events.UserEventsStream.ForUser(username))
+		if err != nil {
+			return nil, err
+		}
+
+		user, found, err := db.GetUserFromRedis(ctx, redisClient, username)
+		if err != nil {
+			return nil, err
+		}
+
+		if !found {
+			mismatches = append(mismatches, VersionMismatch{Username: username, StreamVersion: streamVersion})
+		} else if user.Version != streamVersion {
+			mismatches = append(mismatches, VersionMismatch{Username: username, RedisVersion: &user.Version, StreamVersion: streamVersion})
+		}
+	}
+
+	return mismatches, nil
+}
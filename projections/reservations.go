@@ -0,0 +1,131 @@
+package projections
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/reservation"
+	"github.com/redis/go-redis/v9"
+)
+
+// Name under which the reservation projection stores its checkpoint
+const ReservationsCheckpoint string = "reservations"
+
+const reservationsProjectionVersion int = 1
+
+type reservationProjection struct {
+	ctx         context.Context
+	logger      *slog.Logger
+	redisClient *redis.Client
+	reserver    *reservation.Reserver
+	committed   *db.ProjectionCheckpoint
+
+	mu              sync.Mutex
+	checkpoint      esdb.Position
+	savedCheckpoint esdb.Position
+}
+
+/*
+Create a projection which applies the reservation events to the reservation store of the reserver.
+
+The checkpoint is stored inside Redis every time it advances, so the store only catches up
+on the events written since the last run. The keys of the legacy reservations, stored under the raw email, are deleted.
+The committed checkpoint (can be nil) is advanced after every stored checkpoint.
+*/
+func NewReservationProjection(ctx context.Context, logger *slog.Logger, redisClient *redis.Client, reserver *reservation.Reserver, committed *db.ProjectionCheckpoint) CheckpointedProjection {
+	return &reservationProjection{
+		ctx:         ctx,
+		logger:      logger,
+		redisClient: redisClient,
+		reserver:    reserver,
+		committed:   committed,
+	}
+}
+
+func (p *reservationProjection) HandleEvent(event esdb.RecordedEvent) error {
+	if _, err := p.reserver.Apply(p.ctx, event); err != nil {
+		return err
+	}
+
+	if key, ok := reservation.LegacyKey(event); ok {
+		if err := p.redisClient.Del(p.ctx, key).Err(); err != nil {
+			return fmt.Errorf("failed to delete the legacy reservation key: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (p *reservationProjection) saveCheckpoint(ctx context.Context, checkpoint esdb.Position) error {
+	if err := db.SaveRedisCheckpoint(ctx, p.redisClient, ReservationsCheckpoint, checkpoint, reservationsProjectionVersion); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.savedCheckpoint = checkpoint
+	p.mu.Unlock()
+
+	p.committed.Advance(checkpoint)
+
+	return nil
+}
+
+func (p *reservationProjection) Version() int {
+	return reservationsProjectionVersion
+}
+
+func (p *reservationProjection) Checkpoint() (esdb.AllPosition, int, error) {
+	return db.GetRedisCheckpoint(p.ctx, p.redisClient, ReservationsCheckpoint)
+}
+
+/*
+Only the checkpoint is removed, the reservations are left inside the store.
+
+Applying the events only persists and deletes the keys inside the store, so replaying them from the start
+brings the store up to date, while removing the keys would drop the leases of the registrations in progress.
+*/
+func (p *reservationProjection) Reset() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := db.DeleteRedisCheckpoint(p.ctx, p.redisClient, ReservationsCheckpoint); err != nil {
+		return err
+	}
+
+	p.checkpoint = esdb.Position{}
+	p.savedCheckpoint = esdb.Position{}
+
+	return nil
+}
+
+/*
+The events up to the position are applied, so the position is stored right away.
+
+If storing it fails, the events are applied again after a restart, unless a later checkpoint is stored before that.
+*/
+func (p *reservationProjection) SetCheckpoint(position esdb.Position) {
+	p.mu.Lock()
+	p.checkpoint = position
+	p.mu.Unlock()
+
+	if err := p.saveCheckpoint(p.ctx, position); err != nil {
+		p.logger.Error("failed to store the reservation projection checkpoint", "error", err)
+	}
+}
+
+func (p *reservationProjection) Close() error {
+	p.mu.Lock()
+	checkpoint := p.checkpoint
+	saved := checkpoint == p.savedCheckpoint
+	p.mu.Unlock()
+
+	if saved {
+		return nil
+	}
+
+	return p.saveCheckpoint(context.WithoutCancel(p.ctx), checkpoint)
+}
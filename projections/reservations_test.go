@@ -0,0 +1,106 @@
+package projections_test
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+	"github.com/MatejaMaric/esdb-playground/projections"
+	"github.com/MatejaMaric/esdb-playground/reservation"
+	"github.com/MatejaMaric/esdb-playground/utils"
+	"github.com/go-test/deep"
+)
+
+func TestReservationProjection(t *testing.T) {
+	ctx := context.Background()
+
+	kept, err := reservation.NewReservation(reservation.UsernameNamespace, "kept", "kept-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	released, err := reservation.NewReservation(reservation.UsernameNamespace, "released", "released-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leased, err := reservation.NewReservation(reservation.UsernameNamespace, "leased", "leased-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reArr := utils.FakeRecordedEvents(reservation.UsernameNamespace.Stream(), []utils.FakeEvent{
+		{Type: events.ReservationPersisted, Data: kept},
+		{Type: events.ReservationPersisted, Data: released},
+		{Type: events.Reserve, Data: leased},
+		{Type: events.ReleaseReservation, Data: released},
+	})
+	for i := range reArr {
+		reArr[i].Position = esdb.Position{Commit: uint64(100 + i), Prepare: uint64(100 + i)}
+	}
+
+	store := reservation.NewMemoryStore()
+	reserver := reservation.NewReserver(nil, store, reservation.ReserverOptions{})
+	committed := db.NewProjectionCheckpoint()
+
+	p := projections.NewReservationProjection(ctx, slog.Default(), TestRedisClient, reserver, committed)
+	if err := p.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaying the events after a reset must end with the same store
+	for i := 0; i < 2; i++ {
+		for _, re := range reArr {
+			if err := p.HandleEvent(re); err != nil {
+				t.Fatal(err)
+			}
+			p.SetCheckpoint(re.Position)
+		}
+
+		tokens, err := store.All(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := deep.Equal(map[string]string{kept.Key: "persisted"}, tokens); diff != nil {
+			t.Fatalf("unexpected store after %d runs: %v", i+1, diff)
+		}
+	}
+
+	last := reArr[len(reArr)-1].Position
+
+	// The stored checkpoint is the one of the last applied event
+	checkpoint, version, err := p.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint != last || version != p.Version() {
+		t.Fatalf("unexpected checkpoint %v of version %d", checkpoint, version)
+	}
+	if position := committed.Position(); position != last {
+		t.Fatalf("unexpected committed checkpoint %v", position)
+	}
+
+	// The partitioned handler doesn't advance the checkpoint past an event which wasn't applied
+	broken := utils.FakeRecordedEvents(reservation.UsernameNamespace.Stream(), []utils.FakeEvent{
+		{Type: events.ReservationPersisted, Data: "not a reservation"},
+	})[0]
+	broken.Position = esdb.Position{Commit: 200, Prepare: 200}
+
+	if err := p.HandleEvent(broken); err == nil {
+		t.Fatal("expected the event which can't be applied to return an error")
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint, _, err = p.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint != last {
+		t.Fatalf("the checkpoint moved past the failed event to %v", checkpoint)
+	}
+}
@@ -0,0 +1,298 @@
+package projections
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+)
+
+// Name under which the search projection is tracked
+const SearchCheckpoint string = "user_search"
+
+const searchProjectionVersion int = 1
+
+type SearchMatch string
+
+const (
+	// Matches users with a username, email or a part of them starting with the query
+	PrefixMatch SearchMatch = "prefix"
+	// Matches users with a username or email containing the query
+	SubstringMatch SearchMatch = "substring"
+	// Combines the prefix and substring matches, ranking the better matches first
+	RankedMatch SearchMatch = "ranked"
+)
+
+type SearchResult struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Score    int    `json:"score"`
+}
+
+type searchDocument struct {
+	username string
+	email    string
+	tokens   []string
+}
+
+/*
+SearchIndex is an in-memory inverted index of usernames and emails.
+
+Tokens are lowercase parts of the username and the email, split on every
+character which isn't a letter or a digit, together with the whole username and email.
+*/
+type SearchIndex struct {
+	mu        sync.RWMutex
+	documents map[string]searchDocument
+	postings  map[string]map[string]struct{}
+	// Sorted list of all the tokens inside postings, used for prefix lookups
+	tokens []string
+}
+
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		documents: map[string]searchDocument{},
+		postings:  map[string]map[string]struct{}{},
+	}
+}
+
+func tokenize(username, email string) []string {
+	username = strings.ToLower(username)
+	email = strings.ToLower(email)
+
+	isSeparator := func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}
+
+	seen := map[string]bool{}
+	var tokens []string
+	add := func(token string) {
+		if token != "" && !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+
+	add(username)
+	add(email)
+	if local, domain, ok := strings.Cut(email, "@"); ok {
+		add(local)
+		add(domain)
+	}
+	for _, token := range strings.FieldsFunc(username, isSeparator) {
+		add(token)
+	}
+	for _, token := range strings.FieldsFunc(email, isSeparator) {
+		add(token)
+	}
+
+	return tokens
+}
+
+// Adds the user to the index or replaces the indexed email of the user
+func (si *SearchIndex) Upsert(username, email string) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+
+	si.remove(username)
+
+	doc := searchDocument{
+		username: username,
+		email:    email,
+		tokens:   tokenize(username, email),
+	}
+	si.documents[username] = doc
+
+	for _, token := range doc.tokens {
+		usernames, ok := si.postings[token]
+		if !ok {
+			usernames = map[string]struct{}{}
+			si.postings[token] = usernames
+
+			i := sort.SearchStrings(si.tokens, token)
+			si.tokens = append(si.tokens, "")
+			copy(si.tokens[i+1:], si.tokens[i:])
+			si.tokens[i] = token
+		}
+		usernames[username] = struct{}{}
+	}
+}
+
+// Removes every user from the index
+func (si *SearchIndex) Clear() {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+
+	si.documents = map[string]searchDocument{}
+	si.postings = map[string]map[string]struct{}{}
+	si.tokens = nil
+}
+
+func (si *SearchIndex) Remove(username string) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+
+	si.remove(username)
+}
+
+func (si *SearchIndex) remove(username string) {
+	doc, ok := si.documents[username]
+	if !ok {
+		return
+	}
+
+	delete(si.documents, username)
+
+	for _, token := range doc.tokens {
+		usernames := si.postings[token]
+		delete(usernames, username)
+
+		if len(usernames) == 0 {
+			delete(si.postings, token)
+
+			i := sort.SearchStrings(si.tokens, token)
+			si.tokens = append(si.tokens[:i], si.tokens[i+1:]...)
+		}
+	}
+}
+
+// Returns at most limit users matching the query, the best matches first
+func (si *SearchIndex) Search(query string, match SearchMatch, limit int) []SearchResult {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return []SearchResult{}
+	}
+
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+
+	scores := map[string]int{}
+	addScore := func(username string, score int) {
+		if score > scores[username] {
+			scores[username] = score
+		}
+	}
+
+	if match == PrefixMatch || match == RankedMatch {
+		for i := sort.SearchStrings(si.tokens, query); i < len(si.tokens) && strings.HasPrefix(si.tokens[i], query); i++ {
+			token := si.tokens[i]
+			for username := range si.postings[token] {
+				doc := si.documents[username]
+				lowerUsername := strings.ToLower(doc.username)
+				lowerEmail := strings.ToLower(doc.email)
+
+				switch {
+				case token == query && (lowerUsername == query || lowerEmail == query):
+					addScore(username, 100)
+				case token == query:
+					addScore(username, 60)
+				case token == lowerUsername:
+					addScore(username, 50)
+				case token == lowerEmail:
+					addScore(username, 40)
+				default:
+					addScore(username, 30)
+				}
+			}
+		}
+	}
+
+	if match == SubstringMatch || match == RankedMatch {
+		for username, doc := range si.documents {
+			if strings.Contains(strings.ToLower(doc.username), query) {
+				addScore(username, 20)
+			} else if strings.Contains(strings.ToLower(doc.email), query) {
+				addScore(username, 10)
+			}
+		}
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for username, score := range scores {
+		doc := si.documents[username]
+		results = append(results, SearchResult{Username: doc.username, Email: doc.email, Score: score})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Username < results[j].Username
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results
+}
+
+type searchProjection struct {
+	index     *SearchIndex
+	committed *db.ProjectionCheckpoint
+}
+
+/*
+Create a projection which keeps the search index in sync with the user events.
+
+The index lives in memory, so the projection always starts from the beginning.
+The committed checkpoint (can be nil) is advanced together with the checkpoint.
+*/
+func NewSearchProjection(index *SearchIndex, committed *db.ProjectionCheckpoint) CheckpointedProjection {
+	return &searchProjection{
+		index:     index,
+		committed: committed,
+	}
+}
+
+func (p *searchProjection) HandleEvent(event esdb.RecordedEvent) error {
+	switch event.EventType {
+	case string(events.CreateUser):
+		var e events.CreateUserEvent
+		if err := json.Unmarshal(event.Data, &e); err != nil {
+			return fmt.Errorf("failed to unmarshal event: %w", err)
+		}
+		p.index.Upsert(e.Username, e.Email)
+	case string(events.ChangeUserEmail):
+		var e events.ChangeUserEmailEvent
+		if err := json.Unmarshal(event.Data, &e); err != nil {
+			return fmt.Errorf("failed to unmarshal event: %w", err)
+		}
+		p.index.Upsert(e.Username, e.Email)
+	case string(events.DeleteUser):
+		var e events.DeleteUserEvent
+		if err := json.Unmarshal(event.Data, &e); err != nil {
+			return fmt.Errorf("failed to unmarshal event: %w", err)
+		}
+		p.index.Remove(e.Username)
+	}
+
+	return nil
+}
+
+func (p *searchProjection) Version() int {
+	return searchProjectionVersion
+}
+
+func (p *searchProjection) Checkpoint() (esdb.AllPosition, int, error) {
+	return esdb.Start{}, searchProjectionVersion, nil
+}
+
+func (p *searchProjection) Reset() error {
+	p.index.Clear()
+	return nil
+}
+
+func (p *searchProjection) SetCheckpoint(position esdb.Position) {
+	p.committed.Advance(position)
+}
+
+func (p *searchProjection) Close() error {
+	return nil
+}
@@ -0,0 +1,67 @@
+package projections_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/MatejaMaric/esdb-playground/events"
+	"github.com/MatejaMaric/esdb-playground/projections"
+	"github.com/MatejaMaric/esdb-playground/utils"
+	"github.com/go-test/deep"
+)
+
+func searchUsernames(results []projections.SearchResult) []string {
+	usernames := []string{}
+	for _, result := range results {
+		usernames = append(usernames, result.Username)
+	}
+	return usernames
+}
+
+func TestSearchProjection(t *testing.T) {
+	index := projections.NewSearchIndex()
+	p := projections.NewSearchProjection(index, nil)
+
+	reArr := append(
+		utils.FakeRecordedEvents(events.UserEventsStream.ForUser("john"), []utils.FakeEvent{
+			{Type: events.CreateUser, Data: events.CreateUserEvent{Username: "john", Email: "john.doe@example.com"}},
+			{Type: events.ChangeUserEmail, Data: events.ChangeUserEmailEvent{Username: "john", Email: "jd@work.org"}},
+		}),
+		utils.FakeRecordedEvents(events.UserEventsStream.ForUser("johnny"), []utils.FakeEvent{
+			{Type: events.CreateUser, Data: events.CreateUserEvent{Username: "johnny", Email: "johnny@example.com"}},
+		})...,
+	)
+	reArr = append(reArr, utils.FakeRecordedEvents(events.UserEventsStream.ForUser("ajohn"), []utils.FakeEvent{
+		{Type: events.CreateUser, Data: events.CreateUserEvent{Username: "ajohn", Email: "a@example.com"}},
+		{Type: events.DeleteUser, Data: events.DeleteUserEvent{Username: "ajohn"}},
+	})...)
+	reArr = append(reArr, utils.FakeRecordedEvents(events.UserEventsStream.ForUser("maryjohnson"), []utils.FakeEvent{
+		{Type: events.CreateUser, Data: events.CreateUserEvent{Username: "maryjohnson", Email: "mary@example.com"}},
+	})...)
+
+	for _, re := range reArr {
+		if err := p.HandleEvent(re); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		query    string
+		match    projections.SearchMatch
+		expected []string
+	}{
+		{"john", projections.RankedMatch, []string{"john", "johnny", "maryjohnson"}},
+		{"john", projections.PrefixMatch, []string{"john", "johnny"}},
+		{"ohn", projections.SubstringMatch, []string{"john", "johnny", "maryjohnson"}},
+		{"example", projections.PrefixMatch, []string{"johnny", "maryjohnson"}},
+		{"doe", projections.RankedMatch, []string{}},
+		{"work.org", projections.RankedMatch, []string{"john"}},
+	}
+
+	for _, c := range cases {
+		got := searchUsernames(index.Search(c.query, c.match, 10))
+		if diff := deep.Equal(c.expected, got); diff != nil {
+			t.Errorf("unexpected results for %s match of %q:\n%v\n", c.match, c.query, strings.Join(diff, "\n"))
+		}
+	}
+}
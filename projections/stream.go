@@ -7,6 +7,7 @@ import (
 
 	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
 	"github.com/MatejaMaric/esdb-playground/aggregates"
+	"github.com/MatejaMaric/esdb-playground/db"
 	"github.com/MatejaMaric/esdb-playground/events"
 )
 
@@ -51,8 +52,9 @@ func (p *streamProjection) handleCreateUserEvent(re esdb.RecordedEvent) error {
 
 	aopts := esdb.AppendToStreamOptions{ExpectedRevision: esdb.NoStream{}}
 
+	// The state stream already exists when the event is replayed, e.g. while the read models are rebuilt
 	_, err = p.esdbClient.AppendToStream(p.ctx, streamName, aopts, stateEvent)
-	if err != nil {
+	if err != nil && !db.IsErrorCode(err, esdb.ErrorCodeWrongExpectedVersion) {
 		return fmt.Errorf("failed to append to stream: %w", err)
 	}
 
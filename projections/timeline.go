@@ -0,0 +1,119 @@
+package projections
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+)
+
+// Name under which the timeline projection stores its checkpoint
+const TimelineCheckpoint string = "user_timeline"
+
+const timelineProjectionVersion int = 1
+
+type timelineMetadata struct {
+	EventID         string          `json:"event_id"`
+	CommitPosition  uint64          `json:"commit_position"`
+	PreparePosition uint64          `json:"prepare_position"`
+	ContentType     string          `json:"content_type"`
+	UserMetadata    json.RawMessage `json:"user_metadata,omitempty"`
+}
+
+type timelineProjection struct {
+	sqlCheckpoint
+}
+
+/*
+Create a projection which flattens every user event into a human readable timeline.
+
+The committed checkpoint (can be nil) is advanced once the changes of an event are committed.
+*/
+func NewTimelineProjection(ctx context.Context, sqlClient *sql.DB, committed *db.ProjectionCheckpoint) CheckpointedProjection {
+	return &timelineProjection{
+		sqlCheckpoint: newSqlCheckpoint(ctx, sqlClient, TimelineCheckpoint, timelineProjectionVersion, []string{"user_timeline"}, committed),
+	}
+}
+
+func (p *timelineProjection) HandleEvent(re esdb.RecordedEvent) error {
+	entry, err := NewTimelineEntry(re)
+	if err != nil {
+		return err
+	}
+
+	return p.inTransaction(func(tx *sql.Tx) error {
+		return db.InsertTimelineEntry(p.ctx, tx, entry)
+	})
+}
+
+// Flattens the user event into a timeline entry
+func NewTimelineEntry(re esdb.RecordedEvent) (db.TimelineEntry, error) {
+	username, ok := events.UserEventsStream.User(re.StreamID)
+	if !ok {
+		return db.TimelineEntry{}, fmt.Errorf("stream %s is not a user stream", re.StreamID)
+	}
+
+	summary, err := summarize(re)
+	if err != nil {
+		return db.TimelineEntry{}, err
+	}
+
+	metadata := timelineMetadata{
+		EventID:         re.EventID.String(),
+		CommitPosition:  re.Position.Commit,
+		PreparePosition: re.Position.Prepare,
+		ContentType:     re.ContentType,
+	}
+	if len(re.UserMetadata) > 0 && json.Valid(re.UserMetadata) {
+		metadata.UserMetadata = re.UserMetadata
+	}
+
+	metadataJson, err := json.Marshal(metadata)
+	if err != nil {
+		return db.TimelineEntry{}, fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+
+	return db.TimelineEntry{
+		Username:    username,
+		EventNumber: re.EventNumber,
+		EventType:   re.EventType,
+		CreatedAt:   re.CreatedDate,
+		Summary:     summary,
+		Metadata:    metadataJson,
+	}, nil
+}
+
+func summarize(re esdb.RecordedEvent) (string, error) {
+	switch re.EventType {
+	case string(events.CreateUser):
+		var event events.CreateUserEvent
+		if err := json.Unmarshal(re.Data, &event); err != nil {
+			return "", fmt.Errorf("failed to unmarshal event: %w", err)
+		}
+		return fmt.Sprintf("User %s registered with email %s", event.Username, event.Email), nil
+	case string(events.LoginUser):
+		var event events.LoginUserEvent
+		if err := json.Unmarshal(re.Data, &event); err != nil {
+			return "", fmt.Errorf("failed to unmarshal event: %w", err)
+		}
+		return fmt.Sprintf("User %s logged in", event.Username), nil
+	case string(events.ChangeUserEmail):
+		var event events.ChangeUserEmailEvent
+		if err := json.Unmarshal(re.Data, &event); err != nil {
+			return "", fmt.Errorf("failed to unmarshal event: %w", err)
+		}
+		return fmt.Sprintf("User %s changed their email to %s", event.Username, event.Email), nil
+	case string(events.DeleteUser):
+		var event events.DeleteUserEvent
+		if err := json.Unmarshal(re.Data, &event); err != nil {
+			return "", fmt.Errorf("failed to unmarshal event: %w", err)
+		}
+		return fmt.Sprintf("User %s was deleted", event.Username), nil
+	default:
+		return fmt.Sprintf("%s event recorded", re.EventType), nil
+	}
+}
@@ -0,0 +1,52 @@
+package projections_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+	"github.com/MatejaMaric/esdb-playground/projections"
+	"github.com/MatejaMaric/esdb-playground/utils"
+	"github.com/go-test/deep"
+)
+
+func TestTimelineProjection(t *testing.T) {
+	ctx := context.Background()
+
+	reArr := utils.FakeRecordedEvents(events.UserEventsStream.ForUser("timeline"), []utils.FakeEvent{
+		{Type: events.CreateUser, Data: events.CreateUserEvent{Username: "timeline", Email: "timeline@test.com"}},
+		{Type: events.LoginUser, Data: events.LoginUserEvent{Username: "timeline"}},
+		{Type: events.LoginUser, Data: events.LoginUserEvent{Username: "timeline"}},
+	})
+
+	p := projections.NewTimelineProjection(ctx, TestSqlClient, nil)
+
+	// Handling the events twice must not duplicate the entries
+	for _, re := range append(reArr, reArr...) {
+		if err := p.HandleEvent(re); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := uint64(0)
+	entries, err := db.GetTimeline(ctx, TestSqlClient, "timeline", &first, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var summaries []string
+	for _, entry := range entries {
+		summaries = append(summaries, entry.Summary)
+	}
+
+	expectedSummaries := []string{
+		"User timeline logged in",
+		"User timeline logged in",
+	}
+
+	if diff := deep.Equal(expectedSummaries, summaries); diff != nil {
+		t.Fatalf("unexpected timeline:\n%v\n", strings.Join(diff, "\n"))
+	}
+}
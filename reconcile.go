@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"os"
+
+	"github.com/MatejaMaric/esdb-playground/reservation"
+)
+
+/*
+The reconcile command cross-checks the reservations and prints the report as JSON.
+
+With backfill set, the email and the username of every user are reserved before cross-checking.
+
+Usage: esdb-playground reconcile [-backfill] [-fix]
+*/
+func runReconcile(ctx context.Context, logger *slog.Logger, reserver *reservation.Reserver, sqlClient *sql.DB, args []string) int {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	fix := flags.Bool("fix", false, "emit corrective events and fix the reservation store")
+	backfill := flags.Bool("backfill", false, "reserve the values of the existing users first")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *backfill {
+		users, err := reserver.Backfill(ctx, sqlClient)
+		if err != nil {
+			logger.Error("failed to reserve the values of the existing users", "error", err)
+			return 1
+		}
+		logger.Info("reserved the values of the existing users", "users", users)
+	}
+
+	report, err := reserver.Reconcile(ctx, sqlClient, reservation.ReconcileOptions{Fix: *fix})
+	if err != nil {
+		logger.Error("failed to reconcile the reservations", "error", err)
+		return 1
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		logger.Error("failed to encode the report", "error", err)
+		return 1
+	}
+
+	for _, finding := range report.Findings {
+		if finding.FixError != "" {
+			return 1
+		}
+	}
+
+	return 0
+}
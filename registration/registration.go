@@ -0,0 +1,415 @@
+package registration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+	"github.com/MatejaMaric/esdb-playground/reservation"
+	"github.com/MatejaMaric/esdb-playground/saga"
+	"github.com/gofrs/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Time the registration has for each of its steps before it times out
+const DefaultTimeout time.Duration = 30 * time.Second
+
+// Name under which the registration saga stores its checkpoint and tracks its instances
+const ManagerName string = "registrations"
+
+type Step string
+
+const (
+	// Both values are reserved, the user has to be created before the deadline
+	Reserved Step = "reserved"
+	// The user was created, the reservations have to be confirmed before the deadline
+	UserCreated Step = "user-created"
+	Confirmed   Step = "confirmed"
+	// The registration failed and its reservations were released
+	Compensated Step = "compensated"
+)
+
+// State of a registration, folded from its stream
+type Registration struct {
+	ID                  string                  `json:"id"`
+	Step                Step                    `json:"step"`
+	Username            string                  `json:"username"`
+	Email               string                  `json:"email"`
+	EmailReservation    reservation.Reservation `json:"email_reservation"`
+	UsernameReservation reservation.Reservation `json:"username_reservation"`
+	Deadline            time.Time               `json:"deadline"`
+	// Why the registration was compensated
+	Reason string `json:"reason,omitempty"`
+}
+
+type StartedEvent struct {
+	ID                  string                  `json:"id"`
+	Username            string                  `json:"username"`
+	Email               string                  `json:"email"`
+	EmailReservation    reservation.Reservation `json:"email_reservation"`
+	UsernameReservation reservation.Reservation `json:"username_reservation"`
+	Deadline            time.Time               `json:"deadline"`
+}
+
+type UserCreatedEvent struct {
+	ID       string    `json:"id"`
+	Deadline time.Time `json:"deadline"`
+}
+
+type ConfirmedEvent struct {
+	ID string `json:"id"`
+}
+
+type CompensatedEvent struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+func userKey(username string) string {
+	return "user:" + username
+}
+
+type registrationSaga struct {
+	logger     *slog.Logger
+	esdbClient *esdb.Client
+	reserver   *reservation.Reserver
+	timeout    time.Duration
+}
+
+func (s *registrationSaga) StreamType() events.Stream {
+	return events.RegistrationStream
+}
+
+func (s *registrationSaga) Subscriptions() []events.Stream {
+	return []events.Stream{events.UserEventsStream, events.ReservationKeyStream}
+}
+
+func (s *registrationSaga) Apply(reg Registration, event esdb.RecordedEvent) (Registration, error) {
+	switch event.EventType {
+	case string(events.RegistrationStarted):
+		var started StartedEvent
+		if err := json.Unmarshal(event.Data, &started); err != nil {
+			return reg, fmt.Errorf("failed to unmarshal event: %w", err)
+		}
+
+		return Registration{
+			ID:                  started.ID,
+			Step:                Reserved,
+			Username:            started.Username,
+			Email:               started.Email,
+			EmailReservation:    started.EmailReservation,
+			UsernameReservation: started.UsernameReservation,
+			Deadline:            started.Deadline,
+		}, nil
+	case string(events.RegistrationUserCreated):
+		var userCreated UserCreatedEvent
+		if err := json.Unmarshal(event.Data, &userCreated); err != nil {
+			return reg, fmt.Errorf("failed to unmarshal event: %w", err)
+		}
+
+		reg.Step = UserCreated
+		reg.Deadline = userCreated.Deadline
+	case string(events.RegistrationConfirmed):
+		reg.Step = Confirmed
+		reg.Deadline = time.Time{}
+	case string(events.RegistrationCompensated):
+		var compensated CompensatedEvent
+		if err := json.Unmarshal(event.Data, &compensated); err != nil {
+			return reg, fmt.Errorf("failed to unmarshal event: %w", err)
+		}
+
+		reg.Step = Compensated
+		reg.Deadline = time.Time{}
+		reg.Reason = compensated.Reason
+	}
+
+	return reg, nil
+}
+
+func (s *registrationSaga) Keys(reg Registration) []string {
+	return []string{userKey(reg.Username), reg.EmailReservation.Key, reg.UsernameReservation.Key}
+}
+
+func (s *registrationSaga) Correlate(event esdb.RecordedEvent) ([]string, error) {
+	switch event.EventType {
+	case string(events.CreateUser):
+		var created events.CreateUserEvent
+		if err := json.Unmarshal(event.Data, &created); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal event: %w", err)
+		}
+
+		return []string{userKey(created.Username)}, nil
+	case string(events.ReservationExpired):
+		res, err := reservation.FromEvent(event)
+		if err != nil {
+			return nil, err
+		}
+
+		return []string{res.Key}, nil
+	default:
+		return nil, nil
+	}
+}
+
+func (s *registrationSaga) Handle(ctx context.Context, instance saga.Instance[Registration], event esdb.RecordedEvent) ([]esdb.EventData, error) {
+	reg := instance.State
+
+	switch event.EventType {
+	case string(events.CreateUser):
+		if reg.Step != Reserved {
+			return nil, nil
+		}
+
+		return s.userCreated(reg)
+	case string(events.ReservationExpired):
+		if reg.Step != Reserved {
+			return nil, nil
+		}
+
+		res, err := reservation.FromEvent(event)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.AccessToken != reg.EmailReservation.AccessToken && res.AccessToken != reg.UsernameReservation.AccessToken {
+			return nil, nil
+		}
+
+		reason := fmt.Sprintf("reservation of %s %s was lost before the user was created", res.Namespace, res.Value)
+		return s.compensate(ctx, reg, reason)
+	case string(events.RegistrationUserCreated):
+		if reg.Step != UserCreated {
+			return nil, nil
+		}
+
+		return s.confirm(ctx, reg)
+	case string(events.RegistrationCompensated):
+		// The user could have been created after the timeout looked for it, see Registrations.UserCreated
+		return nil, s.holdCreatedUser(ctx, reg)
+	default:
+		return nil, nil
+	}
+}
+
+func (s *registrationSaga) Deadline(reg Registration) (time.Time, bool) {
+	switch reg.Step {
+	case Reserved, UserCreated:
+		return reg.Deadline, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func (s *registrationSaga) Timeout(ctx context.Context, instance saga.Instance[Registration]) ([]esdb.EventData, error) {
+	reg := instance.State
+
+	switch reg.Step {
+	case Reserved:
+		// The user event could have been written without the saga handling it yet
+		created, err := s.isUserCreated(ctx, reg)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			return s.userCreated(reg)
+		}
+
+		return s.compensate(ctx, reg, "the user wasn't created in time")
+	case UserCreated:
+		return s.confirm(ctx, reg)
+	default:
+		return nil, nil
+	}
+}
+
+// Reports whether the user of the registration exists, a user with the same username but a different email isn't its user
+func (s *registrationSaga) isUserCreated(ctx context.Context, reg Registration) (bool, error) {
+	user, err := db.NewUserFromStream(ctx, s.esdbClient, reg.Username)
+	if db.IsErrorCode(err, esdb.ErrorCodeResourceNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return user.Email == reg.Email, nil
+}
+
+/*
+Reserve the values of the compensated registration again if its user was created after all.
+
+The user is appended without checking the registration, so its append can race the compensation of the timeout.
+It's checked after the compensation is written and after the user is appended, so one of the checks sees both.
+*/
+func (s *registrationSaga) holdCreatedUser(ctx context.Context, reg Registration) error {
+	created, err := s.isUserCreated(ctx, reg)
+	if err != nil || !created {
+		return err
+	}
+
+	for _, res := range []reservation.Reservation{reg.EmailReservation, reg.UsernameReservation} {
+		err := s.reserver.Hold(ctx, res)
+		if errors.Is(err, reservation.ErrReservationExists) {
+			s.conflict(reg, res)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to reserve %s %s of the created user again: %w", res.Namespace, res.Value, err)
+		}
+	}
+
+	return nil
+}
+
+// The value of the created user was reserved by somebody else in the meantime, retrying the event won't change that
+func (s *registrationSaga) conflict(reg Registration, res reservation.Reservation) {
+	s.logger.Error("the value of the created user is reserved by somebody else", "registration", reg.ID, "username", reg.Username, "namespace", res.Namespace, "value", res.Value)
+}
+
+func (s *registrationSaga) userCreated(reg Registration) ([]esdb.EventData, error) {
+	event, err := events.Create(events.RegistrationUserCreated, UserCreatedEvent{ID: reg.ID, Deadline: time.Now().Add(s.timeout)})
+	if err != nil {
+		return nil, err
+	}
+
+	return []esdb.EventData{event}, nil
+}
+
+// The user exists, so its values have to stay reserved even if the reservations were lost in the meantime
+func (s *registrationSaga) confirm(ctx context.Context, reg Registration) ([]esdb.EventData, error) {
+	for _, res := range []reservation.Reservation{reg.EmailReservation, reg.UsernameReservation} {
+		err := s.reserver.Persist(ctx, res)
+		if errors.Is(err, reservation.ErrReservationExists) {
+			s.conflict(reg, res)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to persist the reservation of %s %s: %w", res.Namespace, res.Value, err)
+		}
+	}
+
+	event, err := events.Create(events.RegistrationConfirmed, ConfirmedEvent{ID: reg.ID})
+	if err != nil {
+		return nil, err
+	}
+
+	return []esdb.EventData{event}, nil
+}
+
+func (s *registrationSaga) compensate(ctx context.Context, reg Registration, reason string) ([]esdb.EventData, error) {
+	for _, res := range []reservation.Reservation{reg.EmailReservation, reg.UsernameReservation} {
+		// A lost reservation has nothing left to release
+		if err := s.reserver.Release(ctx, res); err != nil && !reservation.IsLost(err) {
+			return nil, fmt.Errorf("failed to release the reservation of %s %s: %w", res.Namespace, res.Value, err)
+		}
+	}
+
+	event, err := events.Create(events.RegistrationCompensated, CompensatedEvent{ID: reg.ID, Reason: reason})
+	if err != nil {
+		return nil, err
+	}
+
+	return []esdb.EventData{event}, nil
+}
+
+/*
+Registrations runs the registration saga.
+
+A registration starts once both values are reserved and is confirmed once the user is created.
+If the user isn't created in time, or the lease of one of the reservations expires before it is,
+the registration is compensated by releasing both reservations.
+*/
+type Registrations struct {
+	saga    *registrationSaga
+	manager *saga.Manager[Registration]
+}
+
+// The timeout is DefaultTimeout when it's zero
+func NewRegistrations(logger *slog.Logger, esdbClient *esdb.Client, redisClient *redis.Client, reserver *reservation.Reserver, timeout time.Duration) *Registrations {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	s := &registrationSaga{
+		logger:     logger,
+		esdbClient: esdbClient,
+		reserver:   reserver,
+		timeout:    timeout,
+	}
+
+	return &Registrations{
+		saga:    s,
+		manager: saga.NewManager(ManagerName, logger, esdbClient, redisClient, saga.Saga[Registration](s)),
+	}
+}
+
+// Run the saga until the context is done, the tracker can be nil
+func (r *Registrations) Run(ctx context.Context, tracker *db.SubscriptionTracker, interval time.Duration) error {
+	return r.manager.Run(ctx, tracker, interval)
+}
+
+// Start the registration of the user whose values are reserved by the reservations
+func (r *Registrations) Start(ctx context.Context, user events.CreateUserEvent, emailReservation, usernameReservation reservation.Reservation) (Registration, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return Registration{}, fmt.Errorf("failed creating an uuid: %w", err)
+	}
+
+	started := StartedEvent{
+		ID:                  id.String(),
+		Username:            user.Username,
+		Email:               user.Email,
+		EmailReservation:    emailReservation,
+		UsernameReservation: usernameReservation,
+		Deadline:            time.Now().Add(r.saga.timeout),
+	}
+
+	event, err := events.Create(events.RegistrationStarted, started)
+	if err != nil {
+		return Registration{}, err
+	}
+
+	instance := saga.Instance[Registration]{ID: started.ID, Revision: esdb.NoStream{}}
+	if err := r.manager.Append(ctx, instance, event); err != nil {
+		return Registration{}, err
+	}
+
+	return r.saga.Apply(Registration{}, esdb.RecordedEvent{EventType: event.EventType, Data: event.Data})
+}
+
+// Compensate the registration if the user wasn't created yet
+func (r *Registrations) Compensate(ctx context.Context, id string, reason string) error {
+	return r.manager.React(ctx, id, func(instance saga.Instance[Registration]) ([]esdb.EventData, error) {
+		if instance.State.Step != Reserved {
+			return nil, nil
+		}
+
+		return r.saga.compensate(ctx, instance.State, reason)
+	})
+}
+
+// Called once the user of the registration is appended, keeps its values reserved if the registration was compensated in the meantime
+func (r *Registrations) UserCreated(ctx context.Context, id string) error {
+	reg, ok, err := r.Get(ctx, id)
+	if err != nil || !ok || reg.Step != Compensated {
+		return err
+	}
+
+	return r.saga.holdCreatedUser(ctx, reg)
+}
+
+// Returns the registration, false if it doesn't exist
+func (r *Registrations) Get(ctx context.Context, id string) (Registration, bool, error) {
+	instance, err := r.manager.Load(ctx, id)
+	if err != nil {
+		return Registration{}, false, err
+	}
+
+	return instance.State, instance.Exists(), nil
+}
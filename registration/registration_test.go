@@ -0,0 +1,189 @@
+package registration_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+	"github.com/MatejaMaric/esdb-playground/registration"
+	"github.com/MatejaMaric/esdb-playground/reservation"
+	"github.com/MatejaMaric/esdb-playground/tests"
+	"github.com/ory/dockertest/v3"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	TestEsdbClient  *esdb.Client
+	TestRedisClient *redis.Client
+)
+
+func TestMain(m *testing.M) {
+	pool := tests.SetupDockertestPool()
+
+	var resourceRedis, resourceEventStoreDB *dockertest.Resource
+
+	eg := &errgroup.Group{}
+
+	eg.Go(func() error {
+		var err error
+		TestRedisClient, resourceRedis, err = tests.SpawnTestRedis(pool)
+		return err
+	})
+
+	eg.Go(func() error {
+		var err error
+		TestEsdbClient, resourceEventStoreDB, err = tests.SpawnTestEventStoreDB(pool)
+		return err
+	})
+
+	if err := eg.Wait(); err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+
+	// You can't defer this because os.Exit doesn't care for defer
+	tests.PurgeResources(pool, resourceRedis, resourceEventStoreDB)
+
+	os.Exit(code)
+}
+
+func waitForStep(t *testing.T, registrations *registration.Registrations, id string, step registration.Step) {
+	t.Helper()
+
+	for i := 0; i < 50; i++ {
+		reg, ok, err := registrations.Get(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok && reg.Step == step {
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Fatalf("registration %s didn't reach the %s step", id, step)
+}
+
+func TestRegistrationSaga(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	reserver := reservation.NewReserver(TestEsdbClient, reservation.NewMemoryStore(), reservation.ReserverOptions{})
+	registrations := registration.NewRegistrations(logger, TestEsdbClient, TestRedisClient, reserver, 500*time.Millisecond)
+
+	go registrations.Run(ctx, nil, 100*time.Millisecond)
+
+	start := func(user events.CreateUserEvent) registration.Registration {
+		t.Helper()
+
+		emailReservation, err := reserver.Reserve(ctx, reservation.EmailNamespace, user.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		usernameReservation, err := reserver.Reserve(ctx, reservation.UsernameNamespace, user.Username)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reg, err := registrations.Start(ctx, user, emailReservation, usernameReservation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reg.Step != registration.Reserved {
+			t.Fatalf("expected a reserved registration, got %s", reg.Step)
+		}
+
+		return reg
+	}
+
+	t.Run("confirmed", func(t *testing.T) {
+		user := events.CreateUserEvent{Username: "saga", Email: "saga@test.com"}
+		reg := start(user)
+
+		if _, err := db.AppendCreateUserEvent(ctx, TestEsdbClient, user, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		waitForStep(t, registrations, reg.ID, registration.Confirmed)
+
+		status, err := reserver.Status(ctx, reservation.UsernameNamespace, user.Username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status == reservation.Available {
+			t.Fatal("the username of a confirmed registration should stay reserved")
+		}
+	})
+
+	t.Run("timed out", func(t *testing.T) {
+		user := events.CreateUserEvent{Username: "abandoned", Email: "abandoned@test.com"}
+		reg := start(user)
+
+		waitForStep(t, registrations, reg.ID, registration.Compensated)
+
+		for ns, value := range map[reservation.Namespace]string{reservation.EmailNamespace: user.Email, reservation.UsernameNamespace: user.Username} {
+			status, err := reserver.Status(ctx, ns, value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != reservation.Available {
+				t.Fatalf("%s of a compensated registration should be released, got %s", ns, status)
+			}
+		}
+	})
+
+	t.Run("created after the timeout", func(t *testing.T) {
+		user := events.CreateUserEvent{Username: "late", Email: "late@test.com"}
+		reg := start(user)
+
+		waitForStep(t, registrations, reg.ID, registration.Compensated)
+
+		if _, err := db.AppendCreateUserEvent(ctx, TestEsdbClient, user, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := registrations.UserCreated(ctx, reg.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		for ns, value := range map[reservation.Namespace]string{reservation.EmailNamespace: user.Email, reservation.UsernameNamespace: user.Username} {
+			status, err := reserver.Status(ctx, ns, value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != reservation.Persisted {
+				t.Fatalf("%s of the user created after the compensation should be reserved again, got %s", ns, status)
+			}
+		}
+	})
+
+	t.Run("compensated", func(t *testing.T) {
+		user := events.CreateUserEvent{Username: "failed", Email: "failed@test.com"}
+		reg := start(user)
+
+		if err := registrations.Compensate(ctx, reg.ID, "failed to create the user"); err != nil {
+			t.Fatal(err)
+		}
+
+		compensated, ok, err := registrations.Get(ctx, reg.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || compensated.Step != registration.Compensated || compensated.Reason != "failed to create the user" {
+			t.Fatalf("unexpected registration: %+v", compensated)
+		}
+	})
+}
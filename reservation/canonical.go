@@ -0,0 +1,151 @@
+package reservation
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+var ErrInvalidValue = errors.New("invalid value")
+
+// Canonicalizer returns the canonical form of a value, values with the same canonical form can't be reserved twice
+type Canonicalizer func(value string) (string, error)
+
+// Returns a canonicalizer applying the steps in order
+func Pipeline(steps ...Canonicalizer) Canonicalizer {
+	return func(value string) (string, error) {
+		var err error
+		for _, step := range steps {
+			if value, err = step(value); err != nil {
+				return "", err
+			}
+		}
+		return value, nil
+	}
+}
+
+func TrimSpace(value string) (string, error) {
+	return strings.TrimSpace(value), nil
+}
+
+// Applies the NFKC normalization, so the visually equal values have the same code points
+func NormalizeUnicode(value string) (string, error) {
+	return norm.NFKC.String(value), nil
+}
+
+// Applies the Unicode case folding
+func FoldCase(value string) (string, error) {
+	return cases.Fold().String(value), nil
+}
+
+// Converts the domain of the email into its ASCII (punycode) form
+func EmailDomainToASCII(email string) (string, error) {
+	local, domain, err := splitEmail(email)
+	if err != nil {
+		return "", err
+	}
+
+	domain, err = idna.Lookup.ToASCII(strings.TrimSuffix(domain, "."))
+	if err != nil {
+		return "", fmt.Errorf("%w: email domain %s: %w", ErrInvalidValue, domain, err)
+	}
+
+	return local + "@" + domain, nil
+}
+
+// Rules of an email provider, which deliver multiple addresses into the same mailbox
+type ProviderRule struct {
+	// Domain all the domains of the provider are replaced with
+	Domain string
+	// Remove the dots from the local part
+	IgnoreDots bool
+	// Remove everything after the first plus sign of the local part
+	StripPlusTag bool
+}
+
+var ProviderRules = map[string]ProviderRule{
+	"gmail.com":      {Domain: "gmail.com", IgnoreDots: true, StripPlusTag: true},
+	"googlemail.com": {Domain: "gmail.com", IgnoreDots: true, StripPlusTag: true},
+	"outlook.com":    {Domain: "outlook.com", StripPlusTag: true},
+	"hotmail.com":    {Domain: "hotmail.com", StripPlusTag: true},
+	"icloud.com":     {Domain: "icloud.com", StripPlusTag: true},
+	"fastmail.com":   {Domain: "fastmail.com", StripPlusTag: true},
+}
+
+// Applies the ProviderRules, it expects a case folded email with an ASCII domain
+func EmailProviderRules(email string) (string, error) {
+	local, domain, err := splitEmail(email)
+	if err != nil {
+		return "", err
+	}
+
+	rule, ok := ProviderRules[domain]
+	if !ok {
+		return email, nil
+	}
+
+	if rule.StripPlusTag {
+		local, _, _ = strings.Cut(local, "+")
+	}
+	if rule.IgnoreDots {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+	if local == "" {
+		return "", fmt.Errorf("%w: email %s", ErrInvalidValue, email)
+	}
+
+	return local + "@" + rule.Domain, nil
+}
+
+func splitEmail(email string) (string, string, error) {
+	i := strings.LastIndex(email, "@")
+	if i <= 0 || i == len(email)-1 {
+		return "", "", fmt.Errorf("%w: email %s", ErrInvalidValue, email)
+	}
+
+	return email[:i], email[i+1:], nil
+}
+
+var (
+	DefaultEmailCanonicalizer = Pipeline(TrimSpace, NormalizeUnicode, FoldCase, EmailDomainToASCII)
+	// Also applies the email provider rules, so the addresses of the same mailbox can't be reserved twice
+	ProviderEmailCanonicalizer = Pipeline(DefaultEmailCanonicalizer, EmailProviderRules)
+)
+
+var (
+	canonicalizersMu sync.RWMutex
+	canonicalizers   = map[Namespace]Canonicalizer{
+		EmailNamespace: DefaultEmailCanonicalizer,
+	}
+)
+
+/*
+Set the canonicalizer of the namespace.
+
+The keys of the reservations are derived from the canonical form, so it should be set once on startup.
+Reservation events are canonicalized again when they're read, which keeps the keys consistent after a change.
+*/
+func SetCanonicalizer(ns Namespace, canonicalizer Canonicalizer) {
+	canonicalizersMu.Lock()
+	defer canonicalizersMu.Unlock()
+
+	canonicalizers[ns] = canonicalizer
+}
+
+// Returns the canonical form of the value inside the namespace, values of namespaces without a canonicalizer are left as they are
+func (ns Namespace) Canonical(value string) (string, error) {
+	canonicalizersMu.RLock()
+	canonicalizer, ok := canonicalizers[ns]
+	canonicalizersMu.RUnlock()
+
+	if !ok {
+		return value, nil
+	}
+
+	return canonicalizer(value)
+}
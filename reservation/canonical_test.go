@@ -0,0 +1,51 @@
+package reservation_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/MatejaMaric/esdb-playground/reservation"
+)
+
+func TestEmailCanonicalizers(t *testing.T) {
+	tests := []struct {
+		email     string
+		canonical string
+		provider  string
+	}{
+		{email: "foo@example.com", canonical: "foo@example.com", provider: "foo@example.com"},
+		{email: " Foo@Example.COM ", canonical: "foo@example.com", provider: "foo@example.com"},
+		{email: "STRASSE@example.com", canonical: "strasse@example.com", provider: "strasse@example.com"},
+		{email: "Straße@example.com", canonical: "strasse@example.com", provider: "strasse@example.com"},
+		{email: "ｆｏｏ@example.com", canonical: "foo@example.com", provider: "foo@example.com"},
+		{email: "foo@Bücher.example.", canonical: "foo@xn--bcher-kva.example", provider: "foo@xn--bcher-kva.example"},
+		{email: "F.o.o+news@GMail.com", canonical: "f.o.o+news@gmail.com", provider: "foo@gmail.com"},
+		{email: "foo.bar@googlemail.com", canonical: "foo.bar@googlemail.com", provider: "foobar@gmail.com"},
+		{email: "foo.bar+tag@outlook.com", canonical: "foo.bar+tag@outlook.com", provider: "foo.bar@outlook.com"},
+		{email: "foo+tag@example.com", canonical: "foo+tag@example.com", provider: "foo+tag@example.com"},
+	}
+
+	for _, test := range tests {
+		canonical, err := reservation.DefaultEmailCanonicalizer(test.email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if canonical != test.canonical {
+			t.Errorf("expected %s to be canonicalized to %s, got %s", test.email, test.canonical, canonical)
+		}
+
+		provider, err := reservation.ProviderEmailCanonicalizer(test.email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if provider != test.provider {
+			t.Errorf("expected %s to be canonicalized with provider rules to %s, got %s", test.email, test.provider, provider)
+		}
+	}
+
+	for _, email := range []string{"", "foo", "@example.com", "foo@", "+tag@gmail.com"} {
+		if _, err := reservation.ProviderEmailCanonicalizer(email); !errors.Is(err, reservation.ErrInvalidValue) {
+			t.Errorf("expected ErrInvalidValue for %q, got %v", email, err)
+		}
+	}
+}
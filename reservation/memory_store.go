@@ -0,0 +1,138 @@
+package reservation
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	token string
+	// Zero for persisted reservations
+	expiresAt time.Time
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	now     func() time.Time
+}
+
+// Create a reservation store keeping the reservations in memory, meant for tests
+func NewMemoryStore() ReservationStore {
+	return &memoryStore{
+		entries: map[string]memoryEntry{},
+		now:     time.Now,
+	}
+}
+
+// Returns the entry of the key, removing it if it expired
+func (s *memoryStore) get(key string) (memoryEntry, bool) {
+	entry, ok := s.entries[key]
+	if ok && entry.expired(s.now()) {
+		delete(s.entries, key)
+		return memoryEntry{}, false
+	}
+
+	return entry, ok
+}
+
+func (s *memoryStore) Reserve(ctx context.Context, key, token string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.get(key); ok {
+		return ErrReservationExists
+	}
+
+	s.entries[key] = memoryEntry{token: token, expiresAt: s.now().Add(ttl)}
+
+	return nil
+}
+
+func (s *memoryStore) Renew(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.get(key)
+	if !ok || entry.token != token {
+		return false, nil
+	}
+
+	s.entries[key] = memoryEntry{token: token, expiresAt: s.now().Add(ttl)}
+
+	return true, nil
+}
+
+func (s *memoryStore) Persist(ctx context.Context, key, token string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.get(key)
+	if !ok || entry.token != token {
+		return false, nil
+	}
+
+	s.entries[key] = memoryEntry{token: persistedToken}
+
+	return true, nil
+}
+
+func (s *memoryStore) Release(ctx context.Context, key, token string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.get(key)
+	if !ok || entry.token != token || entry.token == persistedToken {
+		return false, nil
+	}
+
+	delete(s.entries, key)
+
+	return true, nil
+}
+
+func (s *memoryStore) Restore(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = memoryEntry{token: persistedToken}
+
+	return nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+
+	return nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.get(key)
+
+	return entry.token, ok, nil
+}
+
+func (s *memoryStore) All(ctx context.Context) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := map[string]string{}
+	for key := range s.entries {
+		if entry, ok := s.get(key); ok {
+			tokens[key] = entry.token
+		}
+	}
+
+	return tokens, nil
+}
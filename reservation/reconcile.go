@@ -0,0 +1,214 @@
+package reservation
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MatejaMaric/esdb-playground/db"
+)
+
+/*
+Reservations younger than the grace period are skipped when looking for reservations without a user or missing from the store,
+the registration which made them could still be in progress, or the users read model and the store could be lagging behind.
+*/
+const ReconcileGracePeriod time.Duration = time.Minute
+
+type ReconcileOptions struct {
+	// Emit corrective events and fix the reservation store
+	Fix bool
+	// ReconcileGracePeriod when it's zero
+	GracePeriod time.Duration
+}
+
+type Discrepancy string
+
+const (
+	// Persisted inside the store, but not reserved inside the reservation streams
+	OrphanedReservation Discrepancy = "orphaned_reservation"
+	// Reserved inside the reservation streams, but not persisted inside the store
+	MissingFromStore Discrepancy = "missing_from_store"
+	// Reserved inside the reservation streams, but no user holds the value
+	ReservationWithoutUser Discrepancy = "reservation_without_user"
+	// The user holds a value which isn't reserved inside the reservation streams
+	UserWithoutReservation Discrepancy = "user_without_reservation"
+)
+
+type Finding struct {
+	Discrepancy Discrepancy `json:"discrepancy"`
+	Namespace   Namespace   `json:"namespace"`
+	Value       string      `json:"value"`
+	Username    string      `json:"username,omitempty"`
+	Fixed       bool        `json:"fixed"`
+	FixError    string      `json:"fix_error,omitempty"`
+}
+
+type ReconcileReport struct {
+	CheckedAt    time.Time `json:"checked_at"`
+	Reservations int       `json:"reservations"`
+	StoreKeys    int       `json:"store_keys"`
+	Users        int       `json:"users"`
+	Findings     []Finding `json:"findings"`
+}
+
+/*
+Cross-check the reservation store, the reservation streams and the users read model.
+
+The reservation streams are the source of truth for the reservations, and the users read model
+for the values which should be reserved. With fix set, the findings are fixed by:
+  - deleting orphaned reservations from the store,
+  - persisting missing reservations inside the store,
+  - writing release events for reservations without a user and deleting them from the store,
+  - writing persisted reservation events for users without a reservation.
+
+Only the email and username namespaces are checked against the users.
+*/
+func (r *Reserver) Reconcile(ctx context.Context, sqlClient *sql.DB, opts ReconcileOptions) (ReconcileReport, error) {
+	if opts.GracePeriod <= 0 {
+		opts.GracePeriod = ReconcileGracePeriod
+	}
+
+	report := ReconcileReport{CheckedAt: time.Now(), Findings: []Finding{}}
+	store := r.store
+
+	keys, states, err := readStreams(ctx, r.esdbClient, r.opts.Mode)
+	if err != nil {
+		return report, fmt.Errorf("failed to read the reservation streams: %w", err)
+	}
+
+	storeTokens, err := store.All(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	users, err := db.GetAllUsers(ctx, sqlClient)
+	if err != nil {
+		return report, err
+	}
+
+	report.StoreKeys = len(storeTokens)
+	report.Users = len(users)
+
+	isHeld := map[string]bool{}
+	for _, user := range users {
+		isHeld[heldReservation(EmailNamespace, user.Email).Key] = true
+		isHeld[heldReservation(UsernameNamespace, user.Username).Key] = true
+	}
+
+	addFinding := func(finding Finding, fixFunc func() error) {
+		if opts.Fix {
+			if err := fixFunc(); err != nil {
+				finding.FixError = err.Error()
+			} else {
+				finding.Fixed = true
+			}
+		}
+		report.Findings = append(report.Findings, finding)
+	}
+
+	for _, key := range keys {
+		state := states[key]
+		res := state.reservation
+
+		if !state.held() {
+			continue
+		}
+
+		report.Reservations++
+
+		if time.Since(state.event.CreatedDate) <= opts.GracePeriod {
+			continue
+		}
+
+		if storeTokens[key] != persistedToken {
+			addFinding(Finding{Discrepancy: MissingFromStore, Namespace: res.Namespace, Value: res.Value}, func() error {
+				return store.Restore(ctx, key)
+			})
+		}
+
+		checkHeld := res.Namespace == EmailNamespace || res.Namespace == UsernameNamespace
+		if checkHeld && !isHeld[key] {
+			addFinding(Finding{Discrepancy: ReservationWithoutUser, Namespace: res.Namespace, Value: res.Value}, func() error {
+				return r.revoke(ctx, res)
+			})
+		}
+	}
+
+	storeKeys := make([]string, 0, len(storeTokens))
+	for key := range storeTokens {
+		storeKeys = append(storeKeys, key)
+	}
+	sort.Strings(storeKeys)
+
+	for _, key := range storeKeys {
+		if storeTokens[key] != persistedToken {
+			// Reservations which weren't persisted yet expire on their own
+			continue
+		}
+
+		if state, ok := states[key]; ok && state.held() {
+			continue
+		}
+
+		ns, nsValue, ok := parseKey(key)
+		if !ok {
+			continue
+		}
+
+		// Values held by users are reserved again below, so there's nothing to delete
+		if isHeld[key] {
+			continue
+		}
+
+		addFinding(Finding{Discrepancy: OrphanedReservation, Namespace: ns, Value: nsValue}, func() error {
+			return store.Delete(ctx, key)
+		})
+	}
+
+	for _, user := range users {
+		held := []Reservation{
+			heldReservation(EmailNamespace, user.Email),
+			heldReservation(UsernameNamespace, user.Username),
+		}
+
+		for _, res := range held {
+			if state, ok := states[res.Key]; ok && state.held() {
+				continue
+			}
+
+			addFinding(Finding{Discrepancy: UserWithoutReservation, Namespace: res.Namespace, Value: res.Value, Username: user.Username}, func() error {
+				return r.restore(ctx, res)
+			})
+		}
+	}
+
+	return report, nil
+}
+
+// Returns the reservation of a value held by a user, the value itself is used if it can't be canonicalized
+func heldReservation(ns Namespace, value string) Reservation {
+	canonical, err := ns.Canonical(value)
+	if err != nil {
+		canonical = value
+	}
+
+	return Reservation{Namespace: ns, Value: value, Canonical: canonical, Key: ns.Key(canonical)}
+}
+
+// Returns the namespace and the value of a key created by Namespace.Key
+func parseKey(key string) (Namespace, string, bool) {
+	parts := strings.SplitN(key, ":", 3)
+	if len(parts) != 3 || parts[0]+":" != keyPrefix {
+		return "", "", false
+	}
+
+	ns, err := ParseNamespace(parts[1])
+	if err != nil {
+		return "", "", false
+	}
+
+	return ns, parts[2], true
+}
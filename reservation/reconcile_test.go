@@ -0,0 +1,117 @@
+package reservation_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/MatejaMaric/esdb-playground/aggregates"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/reservation"
+	"github.com/go-test/deep"
+)
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+
+	store := reservation.NewMemoryStore()
+	reserver := reservation.NewReserver(TestEsdbClient, store, reservation.ReserverOptions{})
+
+	// Persisted inside the store only
+	orphaned := "+381600000101"
+	if err := store.Restore(ctx, reservation.PhoneNamespace.Key(orphaned)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Saved to the stream only
+	missing, err := reservation.NewReservation(reservation.PhoneNamespace, "+381600000102", "missing-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reservation.SavePersisted(ctx, TestEsdbClient, missing); err != nil {
+		t.Fatal(err)
+	}
+
+	withoutUser, err := reservation.NewReservation(reservation.EmailNamespace, "nobody@reconcile.com", "without-user-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reservation.SavePersisted(ctx, TestEsdbClient, withoutUser); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Restore(ctx, withoutUser.Key); err != nil {
+		t.Fatal(err)
+	}
+
+	user := aggregates.User{Username: "reconciled", Email: "reconciled@reconcile.com"}
+	if _, err := db.InsertUser(ctx, TestSqlClient, user); err != nil {
+		t.Fatal(err)
+	}
+
+	checked := map[string]bool{orphaned: true, missing.Value: true, withoutUser.Value: true, user.Email: true, user.Username: true}
+
+	reconcile := func(opts reservation.ReconcileOptions) []reservation.Finding {
+		t.Helper()
+
+		report, err := reserver.Reconcile(ctx, TestSqlClient, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The streams and the users are shared with the other tests
+		findings := []reservation.Finding{}
+		for _, finding := range report.Findings {
+			if checked[finding.Value] {
+				findings = append(findings, finding)
+			}
+		}
+
+		return findings
+	}
+
+	userFindings := []reservation.Finding{
+		{Discrepancy: reservation.UserWithoutReservation, Namespace: reservation.EmailNamespace, Value: user.Email, Username: user.Username},
+		{Discrepancy: reservation.UserWithoutReservation, Namespace: reservation.UsernameNamespace, Value: user.Username, Username: user.Username},
+	}
+
+	// The reservations from the streams are younger than the grace period
+	expected := append([]reservation.Finding{
+		{Discrepancy: reservation.OrphanedReservation, Namespace: reservation.PhoneNamespace, Value: orphaned},
+	}, userFindings...)
+
+	if diff := deep.Equal(expected, reconcile(reservation.ReconcileOptions{})); diff != nil {
+		t.Fatalf("unexpected findings within the grace period: %v", diff)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	expected = append([]reservation.Finding{
+		{Discrepancy: reservation.MissingFromStore, Namespace: reservation.PhoneNamespace, Value: missing.Value},
+		{Discrepancy: reservation.ReservationWithoutUser, Namespace: reservation.EmailNamespace, Value: withoutUser.Value},
+	}, expected...)
+
+	opts := reservation.ReconcileOptions{GracePeriod: time.Millisecond}
+	if diff := deep.Equal(expected, reconcile(opts)); diff != nil {
+		t.Fatalf("unexpected findings: %v", diff)
+	}
+
+	opts.Fix = true
+	for i := range expected {
+		expected[i].Fixed = true
+	}
+	if diff := deep.Equal(expected, reconcile(opts)); diff != nil {
+		t.Fatalf("unexpected fixed findings: %v", diff)
+	}
+
+	if diff := deep.Equal([]reservation.Finding{}, reconcile(opts)); diff != nil {
+		t.Fatalf("findings left after the fix: %v", diff)
+	}
+
+	status, err := reserver.Status(ctx, withoutUser.Namespace, withoutUser.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != reservation.Available {
+		t.Fatalf("the reservation without a user should be released, got %s", status)
+	}
+}
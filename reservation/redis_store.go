@@ -0,0 +1,131 @@
+package reservation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var persistScript = redis.NewScript(`if redis.call('GET',KEYS[1]) == ARGV[1]
+then
+    return redis.call('SET',KEYS[1],'persisted')
+else
+    return 0
+end`)
+
+var renewScript = redis.NewScript(`if redis.call('GET',KEYS[1]) == ARGV[1]
+then
+    return redis.call('PEXPIRE',KEYS[1],ARGV[2])
+else
+    return 0
+end`)
+
+var releaseScript = redis.NewScript(`if redis.call('GET',KEYS[1]) == ARGV[1] and ARGV[1] ~= 'persisted'
+then
+    return redis.call('DEL',KEYS[1])
+else
+    return 0
+end`)
+
+type redisStore struct {
+	redisClient *redis.Client
+}
+
+// Create a reservation store keeping the reservations inside Redis, expiring them with the Redis TTL
+func NewRedisStore(redisClient *redis.Client) ReservationStore {
+	return &redisStore{redisClient: redisClient}
+}
+
+func (s *redisStore) Reserve(ctx context.Context, key, token string, ttl time.Duration) error {
+	ok, err := s.redisClient.SetNX(ctx, key, token, ttl).Result()
+	if err != nil {
+		return fmt.Errorf("failed to reserve in Redis: %w", err)
+	}
+	if !ok {
+		return ErrReservationExists
+	}
+
+	return nil
+}
+
+func (s *redisStore) Renew(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	renewed, err := renewScript.Run(ctx, s.redisClient, []string{key}, token, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to renew the reservation: %w", err)
+	}
+
+	return renewed == 1, nil
+}
+
+func (s *redisStore) Persist(ctx context.Context, key, token string) (bool, error) {
+	res, err := persistScript.Run(ctx, s.redisClient, []string{key}, token).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to persist the reservation: %w", err)
+	}
+
+	// SET returns OK, the script returns 0 when the token doesn't match
+	return res == "OK", nil
+}
+
+func (s *redisStore) Release(ctx context.Context, key, token string) (bool, error) {
+	released, err := releaseScript.Run(ctx, s.redisClient, []string{key}, token).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to release the reservation: %w", err)
+	}
+
+	return released == 1, nil
+}
+
+func (s *redisStore) Restore(ctx context.Context, key string) error {
+	if err := s.redisClient.Set(ctx, key, persistedToken, 0).Err(); err != nil {
+		return fmt.Errorf("failed to restore the reservation: %w", err)
+	}
+
+	return nil
+}
+
+func (s *redisStore) Delete(ctx context.Context, key string) error {
+	if err := s.redisClient.Del(ctx, key).Err(); err != nil {
+		return fmt.Errorf("failed to delete the reservation: %w", err)
+	}
+
+	return nil
+}
+
+func (s *redisStore) Get(ctx context.Context, key string) (string, bool, error) {
+	token, err := s.redisClient.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get the reservation: %w", err)
+	}
+
+	return token, true, nil
+}
+
+func (s *redisStore) All(ctx context.Context) (map[string]string, error) {
+	tokens := map[string]string{}
+
+	iter := s.redisClient.Scan(ctx, 0, keyPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+
+		token, ok, err := s.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			tokens[key] = token
+		}
+	}
+
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan the reservations: %w", err)
+	}
+
+	return tokens, nil
+}
@@ -11,87 +11,320 @@ import (
 	"github.com/MatejaMaric/esdb-playground/db"
 	"github.com/MatejaMaric/esdb-playground/events"
 	"github.com/gofrs/uuid"
-	"github.com/redis/go-redis/v9"
 )
 
-const Timeout time.Duration = 3 * time.Second
+// Lease of a reservation which wasn't persisted yet, unless the Reserver is configured otherwise
+const DefaultLease time.Duration = 3 * time.Second
 
-var ErrReservationExists = errors.New("reservation already exists for the key")
+const persistedToken string = "persisted"
+
+// Prefix of all the reservation keys
+const keyPrefix string = "reservation:"
+
+var (
+	ErrReservationExists    = errors.New("reservation already exists for the key")
+	ErrLeaseExpired         = errors.New("the lease of the reservation expired")
+	ErrAccessDenied         = errors.New("the reservation is held with a different access token")
+	ErrReservationPersisted = errors.New("the reservation is persisted")
+	ErrUnknownNamespace     = errors.New("unknown reservation namespace")
+)
+
+// Reports whether the error means the reservation isn't held with its access token anymore
+func IsLost(err error) bool {
+	return errors.Is(err, ErrLeaseExpired) || errors.Is(err, ErrAccessDenied) || errors.Is(err, ErrReservationPersisted)
+}
+
+// Namespace of unique values, the same value can be reserved once per namespace
+type Namespace string
+
+const (
+	EmailNamespace    Namespace = "email"
+	UsernameNamespace Namespace = "username"
+	PhoneNamespace    Namespace = "phone"
+)
+
+var Namespaces = []Namespace{EmailNamespace, UsernameNamespace, PhoneNamespace}
+
+func ParseNamespace(name string) (Namespace, error) {
+	for _, ns := range Namespaces {
+		if string(ns) == name {
+			return ns, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrUnknownNamespace, name)
+}
+
+// Redis key holding the reservation of the value
+func (ns Namespace) Key(value string) string {
+	return fmt.Sprintf("%s%s:%s", keyPrefix, ns, value)
+}
+
+// Stream holding the reservation events of the namespace
+func (ns Namespace) Stream() string {
+	return fmt.Sprintf("%s-%s", events.ReservationStream, ns)
+}
 
 type Reservation struct {
+	Namespace Namespace
+	// Value as it was entered
+	Value string
+	// Canonical form of the value, the key is derived from it
+	Canonical   string
 	Key         string
 	AccessToken string
 }
 
+type Status string
+
+const (
+	Available Status = "available"
+	// Reserved, but the reservation can still expire
+	Reserved  Status = "reserved"
+	Persisted Status = "persisted"
+)
+
 /*
-Create a reservation and store it inside Redis with a three second TTL
+Returns the reservation of the value inside the namespace held with the access token,
+it's used by the holders of existing reservations. Returns ErrInvalidValue if the value can't be canonicalized.
 */
-func CreateReservation(ctx context.Context, redisClient *redis.Client, value string) (Reservation, error) {
+func NewReservation(ns Namespace, value, accessToken string) (Reservation, error) {
+	canonical, err := ns.Canonical(value)
+	if err != nil {
+		return Reservation{}, err
+	}
+
+	return Reservation{
+		Namespace:   ns,
+		Value:       value,
+		Canonical:   canonical,
+		Key:         ns.Key(canonical),
+		AccessToken: accessToken,
+	}, nil
+}
+
+/*
+Create a reservation of the value inside the namespace and store it inside the store for the duration of the lease.
+
+The canonical form of the value is reserved, returns ErrInvalidValue if the value can't be canonicalized.
+*/
+func CreateReservation(ctx context.Context, store ReservationStore, ns Namespace, value string, lease time.Duration) (Reservation, error) {
 	token, err := uuid.NewV4()
 	if err != nil {
 		return Reservation{}, fmt.Errorf("failed creating an uuid: %w", err)
 	}
 
-	ok, err := redisClient.SetNX(ctx, value, token.String(), Timeout).Result()
+	reservation, err := NewReservation(ns, value, token.String())
 	if err != nil {
-		return Reservation{}, fmt.Errorf("failed to reserve in Redis: %w", err)
+		return Reservation{}, err
 	}
-	if !ok {
-		return Reservation{}, ErrReservationExists
+
+	if err := store.Reserve(ctx, reservation.Key, reservation.AccessToken, lease); err != nil {
+		return Reservation{}, err
 	}
 
-	return Reservation{
-		Key:         value,
-		AccessToken: token.String(),
-	}, nil
+	return reservation, nil
 }
 
 /*
-Write a reservation into EventStoreDB reservation stream.
+Write a reservation into the EventStoreDB reservation stream of its namespace.
 
-After the reservation was written, subscription to reservation stream should call the PresistReservation function.
+The reservation stays a lease until its persistence is written, see SavePersisted.
 */
 func SaveReservation(ctx context.Context, esdbClient *esdb.Client, reservation Reservation) (*esdb.WriteResult, error) {
-	return db.AppendEvent(ctx, esdbClient, string(events.ReservationStream), events.ReserveEmail, reservation, esdb.Any{})
+	return db.AppendEvent(ctx, esdbClient, reservation.Namespace.Stream(), events.Reserve, reservation, esdb.Any{})
 }
 
 /*
-Set reservation to never expire inside Redis.
+Write the persistence of a reservation into the EventStoreDB reservation stream of its namespace.
+
+After it was written, the subscription to the reservation streams persists the reservation inside the store.
 */
-func PersistReservation(ctx context.Context, redisClient *redis.Client, reservation Reservation) (Reservation, error) {
-	const redisLuaScript string = `if redis.call('GET',KEYS[1]) == ARGV[1]
-then
-    return redis.call('SET',KEYS[1],'persisted')
-else
-    return 0
-end`
+func SavePersisted(ctx context.Context, esdbClient *esdb.Client, reservation Reservation) (*esdb.WriteResult, error) {
+	return db.AppendEvent(ctx, esdbClient, reservation.Namespace.Stream(), events.ReservationPersisted, reservation, esdb.Any{})
+}
+
+// Write the expiration of a lease, whose value wasn't in use yet, into the EventStoreDB reservation stream of its namespace
+func SaveExpiration(ctx context.Context, esdbClient *esdb.Client, reservation Reservation) (*esdb.WriteResult, error) {
+	return db.AppendEvent(ctx, esdbClient, reservation.Namespace.Stream(), events.ReservationExpired, reservation, esdb.Any{})
+}
 
-	res := redisClient.Eval(ctx, redisLuaScript, []string{reservation.Key}, reservation.AccessToken)
-	if err := res.Err(); err != nil {
-		return Reservation{}, fmt.Errorf("failed to persist the reservation: %w", err)
+/*
+Set reservation to never expire inside the store.
+*/
+func PersistReservation(ctx context.Context, store ReservationStore, reservation Reservation) (Reservation, error) {
+	if _, err := store.Persist(ctx, reservation.Key, reservation.AccessToken); err != nil {
+		return Reservation{}, err
 	}
 
-	return Reservation{
-		Key:         reservation.Key,
-		AccessToken: "persisted",
-	}, nil
+	reservation.AccessToken = persistedToken
+
+	return reservation, nil
+}
+
+/*
+Write the release of a reservation into the EventStoreDB reservation stream of its namespace.
+
+The release must be written before the reservation is released inside the store,
+otherwise a new reservation of the same value could end up before the release inside the stream.
+*/
+func SaveRelease(ctx context.Context, esdbClient *esdb.Client, reservation Reservation) (*esdb.WriteResult, error) {
+	return db.AppendEvent(ctx, esdbClient, reservation.Namespace.Stream(), events.ReleaseReservation, reservation, esdb.Any{})
+}
+
+/*
+Remove the reservation from the store.
+
+The reservation is only removed while it holds the access token of the reservation, so a release
+never removes a newer reservation of the same value, nor a persisted one. Returns false if nothing was removed.
+*/
+func ReleaseReservation(ctx context.Context, store ReservationStore, reservation Reservation) (bool, error) {
+	return store.Release(ctx, reservation.Key, reservation.AccessToken)
 }
 
-func RepopulateRedis(ctx context.Context, esdbClient *esdb.Client, redisClient *redis.Client) error {
+// Returns the status of the value's reservation inside the namespace
+func GetStatus(ctx context.Context, store ReservationStore, ns Namespace, value string) (Status, error) {
+	canonical, err := ns.Canonical(value)
+	if err != nil {
+		return "", err
+	}
+
+	token, ok, err := store.Get(ctx, ns.Key(canonical))
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return Available, nil
+	}
+
+	if token == persistedToken {
+		return Persisted, nil
+	}
+
+	return Reserved, nil
+}
+
+/*
+Decode a reservation event.
+
+Events from the time before namespaces existed hold only the raw email as the key,
+they are decoded as reservations inside the email namespace. The key is derived from
+the value again, so it always matches the current canonicalization of the namespace.
+*/
+func FromEvent(event esdb.RecordedEvent) (Reservation, error) {
+	var reservation Reservation
+	if err := json.Unmarshal(event.Data, &reservation); err != nil {
+		return reservation, fmt.Errorf("failed to unmarshal the reservation: %w", err)
+	}
+
+	if reservation.Namespace == "" {
+		reservation.Namespace = EmailNamespace
+		reservation.Value = reservation.Key
+		reservation.Key = EmailNamespace.Key(reservation.Value)
+	}
+
+	if canonical, err := reservation.Namespace.Canonical(reservation.Value); err == nil {
+		reservation.Canonical = canonical
+		reservation.Key = reservation.Namespace.Key(canonical)
+	}
+
+	return reservation, nil
+}
+
+/*
+Returns the key of a reservation event written before namespaces existed.
+
+Those reservations were stored under the raw email, while their values are now reserved under the namespaced key,
+so the raw key is left behind once the event is applied again.
+*/
+func LegacyKey(event esdb.RecordedEvent) (string, bool) {
+	if event.StreamID != string(events.ReservationStream) {
+		return "", false
+	}
+
+	var legacy struct {
+		Namespace Namespace
+		Key       string
+	}
+	if err := json.Unmarshal(event.Data, &legacy); err != nil || legacy.Namespace != "" || legacy.Key == "" {
+		return "", false
+	}
+
+	return legacy.Key, true
+}
+
+// The last reservation event of a reservation key
+type streamState struct {
+	reservation Reservation
+	event       esdb.RecordedEvent
+}
+
+/*
+Reports whether the reservation doesn't expire.
+
+Reservations are leases until they're persisted, only the legacy email reservations were persisted right away.
+*/
+func (s streamState) held() bool {
+	switch s.event.EventType {
+	case string(events.ReservationPersisted), string(events.ReserveEmail):
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+Read the reservation streams of all the namespaces (and the legacy reservation stream)
+and return the last event of every reservation key, together with the keys in the order they first appeared.
+
+In the StreamMode the key streams are read as well.
+*/
+func readStreams(ctx context.Context, esdbClient *esdb.Client, mode Mode) ([]string, map[string]streamState, error) {
+	var keys []string
+	states := map[string]streamState{}
+
 	handler := func(event esdb.RecordedEvent) error {
-		var reservation Reservation
-		if err := json.Unmarshal(event.Data, &reservation); err != nil {
-			return fmt.Errorf("failed to unmarshal the reservation: %w", err)
+		reservation, err := FromEvent(event)
+		if err != nil {
+			return err
 		}
 
-		_, err := PersistReservation(ctx, redisClient, reservation)
-		return err
-	}
+		state, ok := states[reservation.Key]
+		if !ok {
+			keys = append(keys, reservation.Key)
+		}
+
+		// Releases and expirations only end the reservation they were written for
+		isEnd := event.EventType == string(events.ReleaseReservation) || event.EventType == string(events.ReservationExpired)
+		if isEnd && ok && state.reservation.AccessToken != reservation.AccessToken {
+			return nil
+		}
+
+		states[reservation.Key] = streamState{reservation: reservation, event: event}
 
-	err := db.HandleReadStream(ctx, esdbClient, string(events.ReservationStream), handler)
-	if esdbErr, isNil := esdb.FromError(err); !isNil && esdbErr.Code() == esdb.ErrorCodeResourceNotFound {
 		return nil
 	}
 
-	return err
+	streams := []string{string(events.ReservationStream)}
+	for _, ns := range Namespaces {
+		streams = append(streams, ns.Stream())
+	}
+
+	for _, stream := range streams {
+		err := db.HandleReadStream(ctx, esdbClient, stream, handler)
+		if db.IsErrorCode(err, esdb.ErrorCodeResourceNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if mode == StreamMode {
+		if err := db.HandleReadAllOfType(ctx, esdbClient, events.ReservationKeyStream, handler); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return keys, states, nil
 }
@@ -2,14 +2,21 @@ package reservation_test
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"log"
 	"os"
 	"testing"
 	"time"
 
 	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/aggregates"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
 	"github.com/MatejaMaric/esdb-playground/reservation"
 	"github.com/MatejaMaric/esdb-playground/tests"
+	"github.com/go-test/deep"
 	"github.com/ory/dockertest/v3"
 	"github.com/redis/go-redis/v9"
 	"golang.org/x/sync/errgroup"
@@ -18,13 +25,15 @@ import (
 var (
 	TestEsdbClient  *esdb.Client
 	TestRedisClient *redis.Client
+	TestSqlClient   *sql.DB
+	TestStore       reservation.ReservationStore
 	TestReservation reservation.Reservation
 )
 
 func TestMain(m *testing.M) {
 	pool := tests.SetupDockertestPool()
 
-	var resourceRedis, resourceEventStoreDB *dockertest.Resource
+	var resourceRedis, resourceEventStoreDB, resourceMariaDB *dockertest.Resource
 
 	eg := &errgroup.Group{}
 
@@ -40,14 +49,25 @@ func TestMain(m *testing.M) {
 		return err
 	})
 
+	eg.Go(func() error {
+		var err error
+		TestSqlClient, resourceMariaDB, err = tests.SpawnTestMariaDB(pool)
+		if err != nil {
+			return err
+		}
+		return tests.CreateSchema(TestSqlClient, "../initdb.d/base.sql")
+	})
+
 	if err := eg.Wait(); err != nil {
 		log.Fatal(err)
 	}
 
+	TestStore = reservation.NewRedisStore(TestRedisClient)
+
 	code := m.Run()
 
 	// You can't defer this because os.Exit doesn't care for defer
-	tests.PurgeResources(pool, resourceRedis, resourceEventStoreDB)
+	tests.PurgeResources(pool, resourceRedis, resourceEventStoreDB, resourceMariaDB)
 
 	os.Exit(code)
 }
@@ -56,7 +76,7 @@ func TestCreateReservation(t *testing.T) {
 	ctx := context.Background()
 	var err error
 
-	TestReservation, err = reservation.CreateReservation(ctx, TestRedisClient, "unique@email.com")
+	TestReservation, err = reservation.CreateReservation(ctx, TestStore, reservation.EmailNamespace, "unique@email.com", reservation.DefaultLease)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -67,10 +87,15 @@ func TestCreateReservation(t *testing.T) {
 
 	CheckTTL(t, ctx, TestRedisClient, TestReservation.Key)
 
-	_, err = reservation.CreateReservation(ctx, TestRedisClient, "unique@email.com")
+	_, err = reservation.CreateReservation(ctx, TestStore, reservation.EmailNamespace, "unique@email.com", reservation.DefaultLease)
 	if err == nil {
 		t.Fatal("error expected when making a duplicate reservation!")
 	}
+
+	_, err = reservation.CreateReservation(ctx, TestStore, reservation.EmailNamespace, "Unique@Email.com", reservation.DefaultLease)
+	if err == nil {
+		t.Fatal("error expected when making a reservation differing only in case!")
+	}
 }
 
 func TestSaveReservation(t *testing.T) {
@@ -85,7 +110,7 @@ func TestSaveReservation(t *testing.T) {
 func TestPersistReservation(t *testing.T) {
 	ctx := context.Background()
 
-	res, err := reservation.PersistReservation(ctx, TestRedisClient, TestReservation)
+	res, err := reservation.PersistReservation(ctx, TestStore, TestReservation)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -105,6 +130,153 @@ func TestPersistReservation(t *testing.T) {
 	}
 }
 
+func TestNamespaces(t *testing.T) {
+	ctx := context.Background()
+
+	status, err := reservation.GetStatus(ctx, TestStore, reservation.UsernameNamespace, "unique")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != reservation.Available {
+		t.Fatalf("unexpected status: %s", status)
+	}
+
+	usernameReservation, err := reservation.CreateReservation(ctx, TestStore, reservation.UsernameNamespace, "unique", reservation.DefaultLease)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same value is reserved independently in a different namespace
+	if _, err := reservation.CreateReservation(ctx, TestStore, reservation.PhoneNamespace, "unique", reservation.DefaultLease); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := reservation.CreateReservation(ctx, TestStore, reservation.UsernameNamespace, "unique", reservation.DefaultLease); err == nil {
+		t.Fatal("error expected when making a duplicate reservation!")
+	}
+
+	status, err = reservation.GetStatus(ctx, TestStore, reservation.UsernameNamespace, "unique")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != reservation.Reserved {
+		t.Fatalf("unexpected status: %s", status)
+	}
+
+	if _, err := reservation.PersistReservation(ctx, TestStore, usernameReservation); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err = reservation.GetStatus(ctx, TestStore, reservation.UsernameNamespace, "unique")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != reservation.Persisted {
+		t.Fatalf("unexpected status: %s", status)
+	}
+}
+
+func TestReleaseReservation(t *testing.T) {
+	ctx := context.Background()
+
+	res, err := reservation.CreateReservation(ctx, TestStore, reservation.EmailNamespace, "released@email.com", reservation.DefaultLease)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stranger := res
+	stranger.AccessToken = "not-the-token"
+
+	released, err := reservation.ReleaseReservation(ctx, TestStore, stranger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released {
+		t.Fatal("reservation should not be released without its access token")
+	}
+
+	if _, err := reservation.SaveRelease(ctx, TestEsdbClient, res); err != nil {
+		t.Fatal(err)
+	}
+
+	released, err = reservation.ReleaseReservation(ctx, TestStore, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !released {
+		t.Fatal("reservation should be released with its access token")
+	}
+
+	persisted, err := reservation.CreateReservation(ctx, TestStore, reservation.EmailNamespace, "released@email.com", reservation.DefaultLease)
+	if err != nil {
+		t.Fatalf("released value should be available: %v", err)
+	}
+
+	if _, err := reservation.PersistReservation(ctx, TestStore, persisted); err != nil {
+		t.Fatal(err)
+	}
+
+	released, err = reservation.ReleaseReservation(ctx, TestStore, persisted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released {
+		t.Fatal("persisted reservation should only be removed by its release event")
+	}
+
+	data, err := json.Marshal(persisted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reserver := reservation.NewReserver(TestEsdbClient, TestStore, reservation.ReserverOptions{})
+	event := esdb.RecordedEvent{StreamID: reservation.EmailNamespace.Stream(), EventType: string(events.ReleaseReservation), Data: data}
+	if _, err := reserver.Apply(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := reservation.GetStatus(ctx, TestStore, reservation.EmailNamespace, "released@email.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != reservation.Available {
+		t.Fatalf("the release event should delete the persisted reservation, got %s", status)
+	}
+}
+
+func TestFromLegacyEvent(t *testing.T) {
+	event := esdb.RecordedEvent{
+		EventType: string(events.ReserveEmail),
+		Data:      []byte(`{"Key":"legacy@email.com","AccessToken":"token"}`),
+	}
+
+	res, err := reservation.FromEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := reservation.Reservation{
+		Namespace:   reservation.EmailNamespace,
+		Value:       "legacy@email.com",
+		Canonical:   "legacy@email.com",
+		Key:         reservation.EmailNamespace.Key("legacy@email.com"),
+		AccessToken: "token",
+	}
+
+	if diff := deep.Equal(res, expected); diff != nil {
+		t.Fatal(diff)
+	}
+
+	if _, ok := reservation.LegacyKey(event); ok {
+		t.Fatal("only the events of the legacy reservations stream have legacy keys")
+	}
+
+	event.StreamID = string(events.ReservationStream)
+	if key, ok := reservation.LegacyKey(event); !ok || key != "legacy@email.com" {
+		t.Fatalf("unexpected legacy key %q", key)
+	}
+}
+
 func CheckTTL(t *testing.T, ctx context.Context, redisClient *redis.Client, key string) time.Duration {
 	ttlCmd := TestRedisClient.TTL(ctx, key)
 	if err := ttlCmd.Err(); err != nil {
@@ -124,3 +296,356 @@ func CheckTTL(t *testing.T, ctx context.Context, redisClient *redis.Client, key
 
 	return ttl
 }
+
+func TestStreamModeReserver(t *testing.T) {
+	ctx := context.Background()
+
+	reserver := reservation.NewReserver(TestEsdbClient, reservation.NewMemoryStore(), reservation.ReserverOptions{Mode: reservation.StreamMode})
+
+	res, err := reserver.Reserve(ctx, reservation.EmailNamespace, "stream@email.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A reserver with an empty cache still sees the reservation inside its key stream
+	coldReserver := reservation.NewReserver(TestEsdbClient, reservation.NewMemoryStore(), reservation.ReserverOptions{Mode: reservation.StreamMode})
+
+	if _, err := coldReserver.Reserve(ctx, reservation.EmailNamespace, "Stream@Email.com"); !errors.Is(err, reservation.ErrReservationExists) {
+		t.Fatalf("expected ErrReservationExists, got %v", err)
+	}
+
+	checkStatus := func(r *reservation.Reserver, value string, expected reservation.Status) {
+		t.Helper()
+
+		status, err := r.Status(ctx, reservation.EmailNamespace, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != expected {
+			t.Fatalf("expected status %s, got %s", expected, status)
+		}
+	}
+
+	checkStatus(coldReserver, "stream@email.com", reservation.Reserved)
+
+	stranger := res
+	stranger.AccessToken = "not-the-token"
+
+	if err := reserver.Release(ctx, stranger); !errors.Is(err, reservation.ErrAccessDenied) {
+		t.Fatalf("expected ErrAccessDenied, got %v", err)
+	}
+
+	if err := reserver.Release(ctx, res); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = coldReserver.Reserve(ctx, reservation.EmailNamespace, "stream@email.com")
+	if err != nil {
+		t.Fatalf("released value should be available: %v", err)
+	}
+
+	if err := coldReserver.Persist(ctx, res); err != nil {
+		t.Fatal(err)
+	}
+
+	checkStatus(reserver, "stream@email.com", reservation.Persisted)
+
+	if err := reserver.Release(ctx, res); !errors.Is(err, reservation.ErrReservationPersisted) {
+		t.Fatalf("expected ErrReservationPersisted, got %v", err)
+	}
+}
+
+func TestStreamModeLease(t *testing.T) {
+	ctx := context.Background()
+
+	reserver := reservation.NewReserver(TestEsdbClient, reservation.NewMemoryStore(), reservation.ReserverOptions{Mode: reservation.StreamMode, Lease: 500 * time.Millisecond})
+
+	res, err := reserver.Reserve(ctx, reservation.EmailNamespace, "lease@stream.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	// Renewing appends the reservation again, so the lease is counted from the renewal
+	if err := reserver.Renew(ctx, res); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	if _, err := reserver.Reserve(ctx, reservation.EmailNamespace, "lease@stream.com"); !errors.Is(err, reservation.ErrReservationExists) {
+		t.Fatalf("expected ErrReservationExists, got %v", err)
+	}
+
+	time.Sleep(time.Second)
+
+	if err := reserver.Renew(ctx, res); !errors.Is(err, reservation.ErrLeaseExpired) {
+		t.Fatalf("expected ErrLeaseExpired, got %v", err)
+	}
+
+	other, err := reserver.Reserve(ctx, reservation.EmailNamespace, "lease@stream.com")
+	if err != nil {
+		t.Fatalf("the value of an expired lease should be available: %v", err)
+	}
+
+	var recorded []string
+	err = db.HandleReadStream(ctx, TestEsdbClient, reservation.KeyStream(other.Key), func(event esdb.RecordedEvent) error {
+		recorded = append(recorded, event.EventType)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{string(events.Reserve), string(events.Reserve), string(events.ReservationExpired), string(events.Reserve)}
+	if diff := deep.Equal(expected, recorded); diff != nil {
+		t.Fatalf("unexpected key stream events: %v", diff)
+	}
+}
+
+func TestReservationLease(t *testing.T) {
+	ctx := context.Background()
+
+	store := reservation.NewMemoryStore()
+	reserver := reservation.NewReserver(TestEsdbClient, store, reservation.ReserverOptions{Lease: 300 * time.Millisecond})
+
+	res, err := reserver.Reserve(ctx, reservation.PhoneNamespace, "+381601234567")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Renewing keeps the reservation past its original lease
+	for i := 0; i < 3; i++ {
+		time.Sleep(200 * time.Millisecond)
+		if err := reserver.Renew(ctx, res); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(400 * time.Millisecond)
+
+	if err := reserver.Renew(ctx, res); !errors.Is(err, reservation.ErrLeaseExpired) {
+		t.Fatalf("expected ErrLeaseExpired, got %v", err)
+	}
+
+	if err := reserver.Release(ctx, res); !errors.Is(err, reservation.ErrLeaseExpired) {
+		t.Fatalf("expected ErrLeaseExpired, got %v", err)
+	}
+
+	other, err := reserver.Reserve(ctx, reservation.PhoneNamespace, "+381601234567")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The value of the lost lease is in use, but somebody else holds it now
+	if err := reserver.Persist(ctx, res); !errors.Is(err, reservation.ErrReservationExists) {
+		t.Fatalf("expected ErrReservationExists, got %v", err)
+	}
+
+	last, err := db.GetLatestEventOfStream(ctx, TestEsdbClient, reservation.PhoneNamespace.Stream())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.EventType != string(events.ReservationExpired) {
+		t.Fatalf("expected the expiration to be recorded, got %s", last.EventType)
+	}
+
+	if err := reserver.Release(ctx, res); !errors.Is(err, reservation.ErrAccessDenied) {
+		t.Fatalf("expected ErrAccessDenied, got %v", err)
+	}
+
+	status, err := reserver.Status(ctx, reservation.PhoneNamespace, other.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != reservation.Reserved {
+		t.Fatalf("the newer reservation should stay reserved, got %s", status)
+	}
+}
+
+func TestUnrenewedLease(t *testing.T) {
+	ctx := context.Background()
+
+	reserver := reservation.NewReserver(TestEsdbClient, reservation.NewMemoryStore(), reservation.ReserverOptions{Lease: 300 * time.Millisecond})
+
+	res, err := reserver.Reserve(ctx, reservation.PhoneNamespace, "+381607654321")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The subscription applies the saved reservation, which must not persist it
+	last, err := db.GetLatestEventOfStream(ctx, TestEsdbClient, reservation.PhoneNamespace.Stream())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reserver.Apply(ctx, *last); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := reserver.Status(ctx, res.Namespace, res.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != reservation.Reserved {
+		t.Fatalf("expected the lease to be reserved, got %s", status)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+
+	status, err = reserver.Status(ctx, res.Namespace, res.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != reservation.Available {
+		t.Fatalf("the lease should expire without renewals, got %s", status)
+	}
+
+	if err := reserver.Renew(ctx, res); !errors.Is(err, reservation.ErrLeaseExpired) {
+		t.Fatalf("expected ErrLeaseExpired, got %v", err)
+	}
+}
+
+func TestPersistedRelease(t *testing.T) {
+	ctx := context.Background()
+
+	reserver := reservation.NewReserver(TestEsdbClient, reservation.NewMemoryStore(), reservation.ReserverOptions{})
+
+	res, err := reserver.Reserve(ctx, reservation.UsernameNamespace, "persistedrelease")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stranger := res
+	stranger.AccessToken = "not-the-token"
+
+	if err := reserver.Release(ctx, stranger); !errors.Is(err, reservation.ErrAccessDenied) {
+		t.Fatalf("expected ErrAccessDenied, got %v", err)
+	}
+
+	if err := reserver.Persist(ctx, res); err != nil {
+		t.Fatal(err)
+	}
+
+	last, err := db.GetLatestEventOfStream(ctx, TestEsdbClient, reservation.UsernameNamespace.Stream())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.EventType != string(events.ReservationPersisted) {
+		t.Fatalf("expected the persistence to be recorded, got %s", last.EventType)
+	}
+
+	for _, held := range []reservation.Reservation{res, stranger} {
+		if err := reserver.Release(ctx, held); !errors.Is(err, reservation.ErrReservationPersisted) {
+			t.Fatalf("expected ErrReservationPersisted, got %v", err)
+		}
+	}
+
+	status, err := reserver.Status(ctx, res.Namespace, res.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != reservation.Persisted {
+		t.Fatalf("expected the reservation to stay persisted, got %s", status)
+	}
+}
+
+func TestHold(t *testing.T) {
+	ctx := context.Background()
+
+	for _, mode := range []reservation.Mode{reservation.StoreMode, reservation.StreamMode} {
+		t.Run(string(mode), func(t *testing.T) {
+			reserver := reservation.NewReserver(TestEsdbClient, reservation.NewMemoryStore(), reservation.ReserverOptions{Mode: mode})
+
+			checkStatus := func(value string, expected reservation.Status) {
+				t.Helper()
+
+				status, err := reserver.Status(ctx, reservation.UsernameNamespace, value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if status != expected {
+					t.Fatalf("expected status %s, got %s", expected, status)
+				}
+			}
+
+			// The value of a lost reservation is reserved again, it stays held by its access token
+			lost := reservation.Reservation{Namespace: reservation.UsernameNamespace, Value: "held" + string(mode), AccessToken: "lost-token"}
+			lost.Canonical = lost.Value
+			lost.Key = reservation.UsernameNamespace.Key(lost.Canonical)
+
+			for i := 0; i < 2; i++ {
+				if err := reserver.Hold(ctx, lost); err != nil {
+					t.Fatal(err)
+				}
+			}
+			checkStatus(lost.Value, reservation.Persisted)
+
+			stranger := lost
+			stranger.AccessToken = "not-the-token"
+
+			if err := reserver.Hold(ctx, stranger); !errors.Is(err, reservation.ErrReservationExists) {
+				t.Fatalf("expected ErrReservationExists, got %v", err)
+			}
+
+			// The values in use are held by the persisted token, whoever persisted them
+			inUse := stranger
+			inUse.AccessToken = "persisted"
+
+			if err := reserver.Hold(ctx, inUse); err != nil {
+				t.Fatal(err)
+			}
+
+			leased, err := reserver.Reserve(ctx, reservation.UsernameNamespace, "leased"+string(mode))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stranger = leased
+			stranger.AccessToken = "not-the-token"
+
+			if err := reserver.Hold(ctx, stranger); !errors.Is(err, reservation.ErrReservationExists) {
+				t.Fatalf("expected ErrReservationExists, got %v", err)
+			}
+			checkStatus(leased.Value, reservation.Reserved)
+
+			// The lease held with the access token is persisted
+			if err := reserver.Hold(ctx, leased); err != nil {
+				t.Fatal(err)
+			}
+			checkStatus(leased.Value, reservation.Persisted)
+		})
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	ctx := context.Background()
+
+	user := aggregates.User{Username: "backfilled", Email: "Backfilled@Email.com"}
+	if _, err := db.InsertUser(ctx, TestSqlClient, user); err != nil {
+		t.Fatal(err)
+	}
+
+	reserver := reservation.NewReserver(TestEsdbClient, reservation.NewMemoryStore(), reservation.ReserverOptions{})
+
+	// Running it twice must not reserve the values again
+	for i := 0; i < 2; i++ {
+		if _, err := reserver.Backfill(ctx, TestSqlClient); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for ns, value := range map[reservation.Namespace]string{reservation.EmailNamespace: user.Email, reservation.UsernameNamespace: user.Username} {
+		status, err := reserver.Status(ctx, ns, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != reservation.Persisted {
+			t.Fatalf("%s of the user should be persisted, got %s", ns, status)
+		}
+	}
+
+	if _, err := reserver.Reserve(ctx, reservation.UsernameNamespace, "backfilled"); !errors.Is(err, reservation.ErrReservationExists) {
+		t.Fatalf("expected ErrReservationExists, got %v", err)
+	}
+}
@@ -0,0 +1,715 @@
+package reservation
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+	"github.com/gofrs/uuid"
+)
+
+type Mode string
+
+const (
+	/*
+		Values are reserved inside the store, the reservations are saved to the reservation streams of their namespaces.
+		The reservation is a lease inside the store until it's persisted, which is saved to the stream as well.
+	*/
+	StoreMode Mode = "store"
+	/*
+		Every value is reserved by writing to its own stream with the expected revision,
+		so EventStoreDB enforces the uniqueness and the store only caches the persisted reservations.
+		The reservation is a lease until it's persisted, like the reservations of the StoreMode.
+	*/
+	StreamMode Mode = "stream"
+)
+
+func ParseMode(mode string) (Mode, error) {
+	switch Mode(mode) {
+	case StoreMode, StreamMode:
+		return Mode(mode), nil
+	default:
+		return "", fmt.Errorf("unknown reservation mode: %s", mode)
+	}
+}
+
+// Stream holding the reservation events of a single key, used by the StreamMode
+func KeyStream(key string) string {
+	return fmt.Sprintf("%s-%x", events.ReservationKeyStream, sha256.Sum256([]byte(key)))
+}
+
+type ReserverOptions struct {
+	Mode Mode
+	// Lease of the reservations which weren't persisted yet, DefaultLease when it's zero
+	Lease time.Duration
+}
+
+// Reserver runs the reservation lifecycle of the chosen mode
+type Reserver struct {
+	opts       ReserverOptions
+	esdbClient *esdb.Client
+	store      ReservationStore
+}
+
+func NewReserver(esdbClient *esdb.Client, store ReservationStore, opts ReserverOptions) *Reserver {
+	if opts.Mode == "" {
+		opts.Mode = StoreMode
+	}
+	if opts.Lease <= 0 {
+		opts.Lease = DefaultLease
+	}
+
+	return &Reserver{
+		opts:       opts,
+		esdbClient: esdbClient,
+		store:      store,
+	}
+}
+
+func (r *Reserver) Mode() Mode {
+	return r.opts.Mode
+}
+
+func (r *Reserver) Lease() time.Duration {
+	return r.opts.Lease
+}
+
+func (r *Reserver) Store() ReservationStore {
+	return r.store
+}
+
+/*
+Reserve the value inside the namespace and save the reservation.
+
+Returns ErrReservationExists if the value is already reserved and ErrInvalidValue if it can't be canonicalized.
+*/
+func (r *Reserver) Reserve(ctx context.Context, ns Namespace, value string) (Reservation, error) {
+	if r.opts.Mode == StreamMode {
+		return r.reserveStream(ctx, ns, value)
+	}
+
+	res, err := CreateReservation(ctx, r.store, ns, value, r.opts.Lease)
+	if err != nil {
+		return Reservation{}, err
+	}
+
+	if _, err := SaveReservation(ctx, r.esdbClient, res); err != nil {
+		err = fmt.Errorf("appending a reservation event to stream resulted in an error: %w", err)
+		if _, releaseErr := ReleaseReservation(ctx, r.store, res); releaseErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to release the reservation: %w", releaseErr))
+		}
+		return Reservation{}, err
+	}
+
+	return res, nil
+}
+
+func (r *Reserver) reserveStream(ctx context.Context, ns Namespace, value string) (Reservation, error) {
+	token, err := uuid.NewV4()
+	if err != nil {
+		return Reservation{}, fmt.Errorf("failed creating an uuid: %w", err)
+	}
+
+	res, err := NewReservation(ns, value, token.String())
+	if err != nil {
+		return Reservation{}, err
+	}
+
+	if err := r.appendToKeyStream(ctx, res, events.Reserve); err != nil {
+		return Reservation{}, err
+	}
+
+	return res, nil
+}
+
+// Returns the last event of the key stream, nil if the key was never reserved
+func (r *Reserver) lastKeyEvent(ctx context.Context, key string) (*esdb.RecordedEvent, error) {
+	last, err := db.GetLatestEventOfStream(ctx, r.esdbClient, KeyStream(key))
+	if db.IsErrorCode(err, esdb.ErrorCodeResourceNotFound) {
+		return nil, nil
+	}
+
+	return last, err
+}
+
+func (r *Reserver) leaseExpired(event esdb.RecordedEvent) bool {
+	return event.EventType == string(events.Reserve) && time.Since(event.CreatedDate) > r.opts.Lease
+}
+
+// Returns the status of the key whose key stream ends with the event
+func (r *Reserver) keyStatus(last *esdb.RecordedEvent) Status {
+	switch {
+	case last == nil, r.leaseExpired(*last):
+		return Available
+	case last.EventType == string(events.Reserve):
+		return Reserved
+	case last.EventType == string(events.ReservationPersisted):
+		return Persisted
+	default:
+		return Available
+	}
+}
+
+/*
+Append the reservation event to its key stream, returns ErrReservationExists if the key isn't available.
+
+The expiration of the lease which held the key before is recorded together with the reservation.
+A persisted reservation is cached inside the store.
+*/
+func (r *Reserver) appendToKeyStream(ctx context.Context, res Reservation, eventType events.Event) error {
+	last, err := r.lastKeyEvent(ctx, res.Key)
+	if err != nil {
+		return err
+	}
+	if r.keyStatus(last) != Available {
+		return ErrReservationExists
+	}
+
+	var expected esdb.ExpectedRevision = esdb.NoStream{}
+	var toAppend []esdb.EventData
+
+	if last != nil {
+		expected = esdb.Revision(last.EventNumber)
+
+		if r.leaseExpired(*last) {
+			expired, err := FromEvent(*last)
+			if err != nil {
+				return err
+			}
+
+			event, err := events.Create(events.ReservationExpired, expired)
+			if err != nil {
+				return err
+			}
+			toAppend = append(toAppend, event)
+		}
+	}
+
+	event, err := events.Create(eventType, res)
+	if err != nil {
+		return err
+	}
+	toAppend = append(toAppend, event)
+
+	_, err = r.esdbClient.AppendToStream(ctx, KeyStream(res.Key), esdb.AppendToStreamOptions{ExpectedRevision: expected}, toAppend...)
+	if db.IsErrorCode(err, esdb.ErrorCodeWrongExpectedVersion) {
+		return ErrReservationExists
+	}
+	if err != nil {
+		return fmt.Errorf("appending a reservation event to stream resulted in an error: %w", err)
+	}
+
+	if eventType != events.ReservationPersisted {
+		return nil
+	}
+
+	// The subscription to the reservation streams fills the cache as well
+	if err := r.store.Restore(ctx, res.Key); err != nil {
+		return fmt.Errorf("failed to cache the persisted reservation: %w", err)
+	}
+
+	return nil
+}
+
+// Returns nil if the store holds the reservation with its access token
+func (r *Reserver) checkHolder(ctx context.Context, res Reservation) error {
+	token, ok, err := r.store.Get(ctx, res.Key)
+	switch {
+	case err != nil:
+		return err
+	case !ok:
+		return ErrLeaseExpired
+	case token == persistedToken:
+		return ErrReservationPersisted
+	case token != res.AccessToken:
+		return ErrAccessDenied
+	default:
+		return nil
+	}
+}
+
+// Returns nil if the key stream, ending with the event, holds the lease of the reservation with its access token
+func (r *Reserver) checkKeyHolder(last *esdb.RecordedEvent, res Reservation) error {
+	switch r.keyStatus(last) {
+	case Available:
+		return ErrLeaseExpired
+	case Persisted:
+		return ErrReservationPersisted
+	}
+
+	held, err := FromEvent(*last)
+	if err != nil {
+		return err
+	}
+	if held.AccessToken != res.AccessToken {
+		return ErrAccessDenied
+	}
+
+	return nil
+}
+
+/*
+Extend the lease of the reservation, only the holder of its access token can renew it.
+
+Returns ErrLeaseExpired if the reservation isn't held with the token anymore.
+Persisted reservations don't expire, so there's nothing to renew.
+*/
+func (r *Reserver) Renew(ctx context.Context, res Reservation) error {
+	if r.opts.Mode == StreamMode {
+		return r.renewStream(ctx, res)
+	}
+
+	renewed, err := r.store.Renew(ctx, res.Key, res.AccessToken, r.opts.Lease)
+	if err != nil || renewed {
+		return err
+	}
+
+	token, ok, err := r.store.Get(ctx, res.Key)
+	if err != nil {
+		return err
+	}
+	if ok && token == persistedToken {
+		return nil
+	}
+
+	return ErrLeaseExpired
+}
+
+// The lease is renewed by appending the reservation to its key stream again
+func (r *Reserver) renewStream(ctx context.Context, res Reservation) error {
+	last, err := r.lastKeyEvent(ctx, res.Key)
+	if err != nil {
+		return err
+	}
+	if last == nil {
+		return ErrLeaseExpired
+	}
+
+	held, err := FromEvent(*last)
+	if err != nil {
+		return err
+	}
+	if held.AccessToken != res.AccessToken {
+		return ErrLeaseExpired
+	}
+
+	switch r.keyStatus(last) {
+	case Persisted:
+		return nil
+	case Reserved:
+		_, err := db.AppendEvent(ctx, r.esdbClient, KeyStream(res.Key), events.Reserve, res, esdb.Revision(last.EventNumber))
+		if db.IsErrorCode(err, esdb.ErrorCodeWrongExpectedVersion) {
+			return ErrLeaseExpired
+		}
+		if err != nil {
+			return fmt.Errorf("appending a reservation event to stream resulted in an error: %w", err)
+		}
+		return nil
+	default:
+		return ErrLeaseExpired
+	}
+}
+
+/*
+Persist the reservation once its value is in use, so it doesn't expire anymore.
+
+If the lease was lost in the meantime, the value is reserved again unless somebody else holds it, see Hold.
+In the StoreMode the lost lease is recorded with a ReservationExpired event.
+*/
+func (r *Reserver) Persist(ctx context.Context, res Reservation) error {
+	if r.opts.Mode != StreamMode {
+		return r.persistStore(ctx, res)
+	}
+
+	last, err := r.lastKeyEvent(ctx, res.Key)
+	if err != nil {
+		return err
+	}
+
+	// Even an expired lease is still held with the token, as long as nobody reserved the value again
+	if last != nil && last.EventType == string(events.Reserve) {
+		held, err := FromEvent(*last)
+		if err != nil {
+			return err
+		}
+
+		if held.AccessToken == res.AccessToken {
+			_, err := db.AppendEvent(ctx, r.esdbClient, KeyStream(res.Key), events.ReservationPersisted, res, esdb.Revision(last.EventNumber))
+			if err == nil {
+				if err := r.store.Restore(ctx, res.Key); err != nil {
+					return fmt.Errorf("failed to cache the persisted reservation: %w", err)
+				}
+				return nil
+			}
+			if !db.IsErrorCode(err, esdb.ErrorCodeWrongExpectedVersion) {
+				return fmt.Errorf("appending a persisted reservation event to stream resulted in an error: %w", err)
+			}
+		}
+	}
+
+	return r.Hold(ctx, res)
+}
+
+func (r *Reserver) persistStore(ctx context.Context, res Reservation) error {
+	err := r.checkHolder(ctx, res)
+	if errors.Is(err, ErrReservationPersisted) {
+		return nil
+	}
+	if IsLost(err) {
+		if _, err := SaveExpiration(ctx, r.esdbClient, res); err != nil {
+			return fmt.Errorf("appending an expiration event to stream resulted in an error: %w", err)
+		}
+		return r.Hold(ctx, res)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := SavePersisted(ctx, r.esdbClient, res); err != nil {
+		return fmt.Errorf("appending a persisted reservation event to stream resulted in an error: %w", err)
+	}
+
+	// The saved event persists the reservation, even if its lease expired in the meantime
+	return r.store.Restore(ctx, res.Key)
+}
+
+/*
+Release the lease of the reservation, only the holder of its access token can release it.
+
+Returns ErrLeaseExpired if the lease expired, ErrAccessDenied if the value is reserved with a different access token
+and ErrReservationPersisted if the reservation is persisted. The release is only written once the access token is checked,
+before the reservation is released inside the store, see SaveRelease.
+*/
+func (r *Reserver) Release(ctx context.Context, res Reservation) error {
+	if r.opts.Mode == StreamMode {
+		return r.releaseStream(ctx, res)
+	}
+
+	if err := r.checkHolder(ctx, res); err != nil {
+		return err
+	}
+
+	if _, err := SaveRelease(ctx, r.esdbClient, res); err != nil {
+		return fmt.Errorf("appending a release event to stream resulted in an error: %w", err)
+	}
+
+	_, err := ReleaseReservation(ctx, r.store, res)
+	return err
+}
+
+func (r *Reserver) releaseStream(ctx context.Context, res Reservation) error {
+	last, err := r.lastKeyEvent(ctx, res.Key)
+	if err != nil {
+		return err
+	}
+
+	if err := r.checkKeyHolder(last, res); err != nil {
+		return err
+	}
+
+	_, err = db.AppendEvent(ctx, r.esdbClient, KeyStream(res.Key), events.ReleaseReservation, res, esdb.Revision(last.EventNumber))
+	if db.IsErrorCode(err, esdb.ErrorCodeWrongExpectedVersion) {
+		return ErrLeaseExpired
+	}
+	if err != nil {
+		return fmt.Errorf("appending a release event to stream resulted in an error: %w", err)
+	}
+
+	return nil
+}
+
+/*
+Release the reservation regardless of its access token and delete its key from the store, even if it's persisted.
+
+It's only used internally, for reservations whose value isn't held by anybody.
+*/
+func (r *Reserver) revoke(ctx context.Context, res Reservation) error {
+	if r.opts.Mode == StreamMode {
+		last, err := r.lastKeyEvent(ctx, res.Key)
+		if err != nil {
+			return err
+		}
+		if r.keyStatus(last) != Available {
+			_, err = db.AppendEvent(ctx, r.esdbClient, KeyStream(res.Key), events.ReleaseReservation, res, esdb.Revision(last.EventNumber))
+			if err != nil {
+				return fmt.Errorf("appending a release event to stream resulted in an error: %w", err)
+			}
+		}
+	} else if _, err := SaveRelease(ctx, r.esdbClient, res); err != nil {
+		return fmt.Errorf("appending a release event to stream resulted in an error: %w", err)
+	}
+
+	return r.store.Delete(ctx, res.Key)
+}
+
+/*
+Returns the status of the value's reservation inside the namespace.
+
+In the StreamMode a value which isn't persisted inside the store is looked up inside its key stream.
+*/
+func (r *Reserver) Status(ctx context.Context, ns Namespace, value string) (Status, error) {
+	status, err := GetStatus(ctx, r.store, ns, value)
+	if err != nil || status != Available || r.opts.Mode != StreamMode {
+		return status, err
+	}
+
+	canonical, err := ns.Canonical(value)
+	if err != nil {
+		return "", err
+	}
+
+	last, err := r.lastKeyEvent(ctx, ns.Key(canonical))
+	if err != nil {
+		return "", err
+	}
+
+	status = r.keyStatus(last)
+	if status != Persisted {
+		return status, nil
+	}
+
+	if err := r.store.Restore(ctx, ns.Key(canonical)); err != nil {
+		return "", fmt.Errorf("failed to cache the persisted reservation: %w", err)
+	}
+
+	return Persisted, nil
+}
+
+/*
+Apply a reservation event from any of the reservation streams to the store.
+
+Only the persisted reservations are applied, the leases live inside the store (or the key streams) until they expire.
+The legacy email reservations were persisted right away, so they're persisted as well.
+*/
+func (r *Reserver) Apply(ctx context.Context, event esdb.RecordedEvent) (Reservation, error) {
+	res, err := FromEvent(event)
+	if err != nil {
+		return res, err
+	}
+
+	switch event.EventType {
+	case string(events.ReleaseReservation):
+		return res, r.applyRelease(ctx, res)
+	case string(events.ReservationPersisted), string(events.ReserveEmail):
+		return res, r.store.Restore(ctx, res.Key)
+	default:
+		return res, nil
+	}
+}
+
+/*
+Remove the released reservation from the store.
+
+Releases are only written for the holder of the reservation, so a persisted key is deleted as well.
+Applying the release events is the only way a persisted reservation leaves the store.
+*/
+func (r *Reserver) applyRelease(ctx context.Context, res Reservation) error {
+	released, err := ReleaseReservation(ctx, r.store, res)
+	if err != nil || released {
+		return err
+	}
+
+	token, ok, err := r.store.Get(ctx, res.Key)
+	if err != nil {
+		return err
+	}
+	if ok && token == persistedToken {
+		return r.store.Delete(ctx, res.Key)
+	}
+
+	return nil
+}
+
+/*
+Make sure the value stays reserved for the holder of the reservation, writing a new reservation if the reservation was lost.
+
+The lease held with the access token of the reservation is persisted. A persisted reservation is held by the access token
+it was persisted with, while the persisted token holds any persisted reservation, it's used for the values already in use.
+Returns ErrReservationExists if somebody else holds the value.
+*/
+func (r *Reserver) Hold(ctx context.Context, res Reservation) error {
+	if _, err := res.Namespace.Canonical(res.Value); err != nil {
+		return err
+	}
+
+	if r.opts.Mode == StreamMode {
+		return r.holdStream(ctx, res)
+	}
+
+	token, ok, err := r.store.Get(ctx, res.Key)
+	switch {
+	case err != nil:
+		return err
+	case !ok:
+		return r.restore(ctx, res)
+	case token == res.AccessToken:
+		return r.persistStore(ctx, res)
+	case token != persistedToken:
+		return ErrReservationExists
+	case res.AccessToken == persistedToken:
+		return nil
+	}
+
+	holder, err := r.persistedWith(ctx, res)
+	if err != nil {
+		return err
+	}
+	if holder != res.AccessToken {
+		return ErrReservationExists
+	}
+
+	return nil
+}
+
+func (r *Reserver) holdStream(ctx context.Context, res Reservation) error {
+	last, err := r.lastKeyEvent(ctx, res.Key)
+	if err != nil {
+		return err
+	}
+
+	status := r.keyStatus(last)
+	if status == Available {
+		return r.restore(ctx, res)
+	}
+
+	held, err := FromEvent(*last)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case status == Reserved && held.AccessToken == res.AccessToken:
+		return r.Persist(ctx, res)
+	case status == Persisted && (held.AccessToken == res.AccessToken || res.AccessToken == persistedToken):
+		if err := r.store.Restore(ctx, res.Key); err != nil {
+			return fmt.Errorf("failed to cache the persisted reservation: %w", err)
+		}
+		return nil
+	default:
+		return ErrReservationExists
+	}
+}
+
+/*
+Returns the access token the reservation was last persisted with, read from the reservation stream of its namespace.
+
+The store keeps only the persisted token of the persisted reservations, so their holders are looked up inside the stream.
+*/
+func (r *Reserver) persistedWith(ctx context.Context, res Reservation) (string, error) {
+	ropts := esdb.ReadStreamOptions{
+		From:      esdb.End{},
+		Direction: esdb.Backwards,
+	}
+
+	stream, err := r.esdbClient.ReadStream(ctx, res.Namespace.Stream(), ropts, math.MaxUint64)
+	if db.IsErrorCode(err, esdb.ErrorCodeResourceNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read the stream '%s': %w", res.Namespace.Stream(), err)
+	}
+	defer stream.Close()
+
+	for {
+		resolved, err := stream.Recv()
+		if errors.Is(err, io.EOF) || db.IsErrorCode(err, esdb.ErrorCodeResourceNotFound) {
+			return "", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("error while reading events from the stream %s: %w", res.Namespace.Stream(), err)
+		}
+
+		if resolved.Event == nil {
+			return "", fmt.Errorf("event is nil!")
+		}
+
+		switch resolved.Event.EventType {
+		case string(events.ReservationPersisted), string(events.ReserveEmail):
+		default:
+			continue
+		}
+
+		persisted, err := FromEvent(*resolved.Event)
+		if err != nil {
+			return "", err
+		}
+		if persisted.Key == res.Key {
+			return persisted.AccessToken, nil
+		}
+	}
+}
+
+/*
+Write the reservation of a value which is in use, but isn't reserved.
+
+The reservation keeps the access token of its holder, so the holder still holds it afterwards.
+*/
+func (r *Reserver) restore(ctx context.Context, res Reservation) error {
+	if res.AccessToken == "" || res.AccessToken == persistedToken {
+		token, err := uuid.NewV4()
+		if err != nil {
+			return fmt.Errorf("failed creating an uuid: %w", err)
+		}
+		res.AccessToken = token.String()
+	}
+
+	if r.opts.Mode == StreamMode {
+		return r.appendToKeyStream(ctx, res, events.ReservationPersisted)
+	}
+
+	if _, err := SavePersisted(ctx, r.esdbClient, res); err != nil {
+		return fmt.Errorf("appending a persisted reservation event to stream resulted in an error: %w", err)
+	}
+
+	return r.store.Restore(ctx, res.Key)
+}
+
+/*
+Make sure the email and the username of every user are reserved, returns the number of users read.
+
+Users registered before usernames were reserved, or before their email was reserved under
+its namespaced key, get the missing reservations. Values which can't be canonicalized are skipped,
+as well as the values already persisted inside the store.
+*/
+func (r *Reserver) Backfill(ctx context.Context, sqlClient *sql.DB) (int, error) {
+	users, err := db.GetAllUsers(ctx, sqlClient)
+	if err != nil {
+		return 0, err
+	}
+
+	storeTokens, err := r.store.All(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, user := range users {
+		held := []Reservation{
+			heldReservation(EmailNamespace, user.Email),
+			heldReservation(UsernameNamespace, user.Username),
+		}
+
+		for _, res := range held {
+			if storeTokens[res.Key] == persistedToken {
+				continue
+			}
+
+			err := r.Hold(ctx, res)
+			if errors.Is(err, ErrInvalidValue) {
+				continue
+			}
+			if err != nil {
+				return 0, fmt.Errorf("failed to reserve %s %s of user %s: %w", res.Namespace, res.Value, user.Username, err)
+			}
+		}
+	}
+
+	return len(users), nil
+}
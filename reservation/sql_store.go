@@ -0,0 +1,186 @@
+package reservation
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+type sqlStore struct {
+	sqlClient *sql.DB
+}
+
+/*
+Create a reservation store keeping the reservations inside the MariaDB reservations table.
+
+Expired rows are ignored by every query, they are deleted every cleanup interval until the context is done.
+The times are taken from the database, so the clocks of the application servers don't matter.
+*/
+func NewSqlStore(ctx context.Context, logger *slog.Logger, sqlClient *sql.DB, cleanupInterval time.Duration) ReservationStore {
+	s := &sqlStore{sqlClient: sqlClient}
+
+	go func() {
+		ticker := time.NewTicker(cleanupInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				deleted, err := s.cleanup(ctx)
+				if err != nil {
+					logger.Error("failed to clean up expired reservations", "error", err)
+					continue
+				}
+				logger.Debug("expired reservations cleaned up", "deleted", deleted)
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *sqlStore) cleanup(ctx context.Context) (int64, error) {
+	res, err := s.sqlClient.ExecContext(ctx, "DELETE FROM reservations WHERE expires_at <= NOW(6)")
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired reservations: %w", err)
+	}
+
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) Reserve(ctx context.Context, key, token string, ttl time.Duration) error {
+	// An expired row is taken over, a row which is still reserved is left untouched
+	res, err := s.sqlClient.ExecContext(ctx,
+		`INSERT INTO reservations (reservation_key, token, expires_at) VALUES (?, ?, NOW(6) + INTERVAL ? MICROSECOND)
+		ON DUPLICATE KEY UPDATE
+			token = IF(expires_at <= NOW(6), VALUES(token), token),
+			expires_at = IF(expires_at <= NOW(6), VALUES(expires_at), expires_at)`,
+		key, token, ttl.Microseconds(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to reserve in MariaDB: %w", err)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get the affected rows: %w", err)
+	}
+
+	// Zero rows are affected when the duplicate row wasn't changed
+	if affected == 0 {
+		return ErrReservationExists
+	}
+
+	return nil
+}
+
+func (s *sqlStore) Renew(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	res, err := s.sqlClient.ExecContext(ctx,
+		"UPDATE reservations SET expires_at = NOW(6) + INTERVAL ? MICROSECOND WHERE reservation_key = ? AND token = ? AND expires_at > NOW(6)",
+		ttl.Microseconds(), key, token,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to renew the reservation: %w", err)
+	}
+
+	return isAffected(res)
+}
+
+func (s *sqlStore) Persist(ctx context.Context, key, token string) (bool, error) {
+	res, err := s.sqlClient.ExecContext(ctx,
+		"UPDATE reservations SET token = ?, expires_at = NULL WHERE reservation_key = ? AND token = ? AND (expires_at IS NULL OR expires_at > NOW(6))",
+		persistedToken, key, token,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to persist the reservation: %w", err)
+	}
+
+	return isAffected(res)
+}
+
+func (s *sqlStore) Release(ctx context.Context, key, token string) (bool, error) {
+	res, err := s.sqlClient.ExecContext(ctx,
+		"DELETE FROM reservations WHERE reservation_key = ? AND token = ? AND token <> ?",
+		key, token, persistedToken,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to release the reservation: %w", err)
+	}
+
+	return isAffected(res)
+}
+
+func (s *sqlStore) Restore(ctx context.Context, key string) error {
+	_, err := s.sqlClient.ExecContext(ctx,
+		"INSERT INTO reservations (reservation_key, token, expires_at) VALUES (?, ?, NULL) ON DUPLICATE KEY UPDATE token = VALUES(token), expires_at = NULL",
+		key, persistedToken,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to restore the reservation: %w", err)
+	}
+
+	return nil
+}
+
+func (s *sqlStore) Delete(ctx context.Context, key string) error {
+	if _, err := s.sqlClient.ExecContext(ctx, "DELETE FROM reservations WHERE reservation_key = ?", key); err != nil {
+		return fmt.Errorf("failed to delete the reservation: %w", err)
+	}
+
+	return nil
+}
+
+func (s *sqlStore) Get(ctx context.Context, key string) (string, bool, error) {
+	var token string
+
+	row := s.sqlClient.QueryRowContext(ctx,
+		"SELECT token FROM reservations WHERE reservation_key = ? AND (expires_at IS NULL OR expires_at > NOW(6))",
+		key,
+	)
+	err := row.Scan(&token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get the reservation: %w", err)
+	}
+
+	return token, true, nil
+}
+
+func (s *sqlStore) All(ctx context.Context) (map[string]string, error) {
+	rows, err := s.sqlClient.QueryContext(ctx, "SELECT reservation_key, token FROM reservations WHERE expires_at IS NULL OR expires_at > NOW(6)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to select reservations: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := map[string]string{}
+	for rows.Next() {
+		var key, token string
+		if err := rows.Scan(&key, &token); err != nil {
+			return nil, fmt.Errorf("failed to scan the row: %w", err)
+		}
+		tokens[key] = token
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err(): %w", err)
+	}
+
+	return tokens, nil
+}
+
+func isAffected(res sql.Result) (bool, error) {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get the affected rows: %w", err)
+	}
+
+	return affected > 0, nil
+}
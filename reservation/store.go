@@ -0,0 +1,31 @@
+package reservation
+
+import (
+	"context"
+	"time"
+)
+
+/*
+ReservationStore holds the reservation keys together with the access tokens of their reservations.
+
+Keys are reserved with a TTL and never expire once they're persisted, persisted keys hold the persisted token.
+Expired keys must behave as if they don't exist.
+*/
+type ReservationStore interface {
+	// Reserve the key for the TTL, returns ErrReservationExists if the key is already reserved
+	Reserve(ctx context.Context, key, token string, ttl time.Duration) error
+	// Extend the TTL of the key if it's reserved with the token and not persisted, returns false otherwise
+	Renew(ctx context.Context, key, token string, ttl time.Duration) (bool, error)
+	// Set the key to never expire if it's reserved with the token, returns false otherwise
+	Persist(ctx context.Context, key, token string) (bool, error)
+	// Remove the key if it's reserved with the token and not persisted, returns false otherwise
+	Release(ctx context.Context, key, token string) (bool, error)
+	// Persist the key regardless of its current reservation
+	Restore(ctx context.Context, key string) error
+	// Remove the key regardless of its current reservation, the only way a persisted key is removed
+	Delete(ctx context.Context, key string) error
+	// Returns the token the key is reserved with, false if the key isn't reserved
+	Get(ctx context.Context, key string) (string, bool, error)
+	// Returns the tokens of all the reserved keys
+	All(ctx context.Context) (map[string]string, error)
+}
@@ -0,0 +1,154 @@
+package reservation_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/MatejaMaric/esdb-playground/reservation"
+)
+
+func TestReservationStores(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	stores := map[string]reservation.ReservationStore{
+		"memory": reservation.NewMemoryStore(),
+		"redis":  reservation.NewRedisStore(TestRedisClient),
+		"sql":    reservation.NewSqlStore(ctx, logger, TestSqlClient, 100*time.Millisecond),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			testReservationStore(t, ctx, store, name)
+		})
+	}
+}
+
+func testReservationStore(t *testing.T, ctx context.Context, store reservation.ReservationStore, name string) {
+	key := reservation.PhoneNamespace.Key(name + "-reserved")
+	expiringKey := reservation.PhoneNamespace.Key(name + "-expiring")
+	restoredKey := reservation.PhoneNamespace.Key(name + "-restored")
+
+	checkToken := func(key string, expected string, expectedOk bool) {
+		t.Helper()
+
+		token, ok, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != expectedOk || token != expected {
+			t.Fatalf("expected token %q (%t) for %s, got %q (%t)", expected, expectedOk, key, token, ok)
+		}
+	}
+
+	checkResult := func(ok bool, err error, expected bool) {
+		t.Helper()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != expected {
+			t.Fatalf("expected %t, got %t", expected, ok)
+		}
+	}
+
+	if err := store.Reserve(ctx, key, "token", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Reserve(ctx, key, "other-token", time.Minute); !errors.Is(err, reservation.ErrReservationExists) {
+		t.Fatalf("expected ErrReservationExists, got %v", err)
+	}
+
+	checkToken(key, "token", true)
+
+	// Keys differing only in case are different keys
+	upperKey := reservation.PhoneNamespace.Key(name + "-RESERVED")
+	if err := store.Reserve(ctx, upperKey, "upper-token", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	checkToken(upperKey, "upper-token", true)
+	checkToken(key, "token", true)
+
+	ok, err := store.Release(ctx, upperKey, "upper-token")
+	checkResult(ok, err, true)
+
+	ok, err = store.Renew(ctx, key, "other-token", time.Minute)
+	checkResult(ok, err, false)
+
+	ok, err = store.Renew(ctx, key, "token", time.Minute)
+	checkResult(ok, err, true)
+
+	ok, err = store.Persist(ctx, key, "other-token")
+	checkResult(ok, err, false)
+
+	ok, err = store.Release(ctx, key, "other-token")
+	checkResult(ok, err, false)
+
+	ok, err = store.Persist(ctx, key, "token")
+	checkResult(ok, err, true)
+
+	checkToken(key, "persisted", true)
+
+	ok, err = store.Renew(ctx, key, "token", time.Minute)
+	checkResult(ok, err, false)
+
+	// Persisted reservations aren't released with any token, they are only deleted
+	ok, err = store.Release(ctx, key, "other-token")
+	checkResult(ok, err, false)
+
+	ok, err = store.Release(ctx, key, "persisted")
+	checkResult(ok, err, false)
+
+	checkToken(key, "persisted", true)
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	checkToken(key, "", false)
+
+	if err := store.Reserve(ctx, expiringKey, "token", 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+
+	checkToken(expiringKey, "", false)
+
+	ok, err = store.Renew(ctx, expiringKey, "token", time.Minute)
+	checkResult(ok, err, false)
+
+	if err := store.Reserve(ctx, expiringKey, "other-token", time.Minute); err != nil {
+		t.Fatalf("expired reservation should be replaceable: %v", err)
+	}
+
+	if err := store.Restore(ctx, restoredKey); err != nil {
+		t.Fatal(err)
+	}
+
+	checkToken(restoredKey, "persisted", true)
+
+	all, err := store.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all[expiringKey] != "other-token" || all[restoredKey] != "persisted" {
+		t.Fatalf("unexpected reservations: %v", all)
+	}
+	if _, ok := all[key]; ok {
+		t.Fatalf("released reservation returned: %v", all)
+	}
+
+	if err := store.Delete(ctx, restoredKey); err != nil {
+		t.Fatal(err)
+	}
+
+	checkToken(restoredKey, "", false)
+}
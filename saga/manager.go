@@ -0,0 +1,293 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/redis/go-redis/v9"
+)
+
+// Number of times a reaction is retried when the instance stream was changed concurrently
+const maxAttempts int = 3
+
+// Version of the stored checkpoints, the manager doesn't rebuild anything so it never changes
+const checkpointVersion int = 1
+
+// Removes the correlation keys still pointing to the instance together with its deadline
+var untrackScript = redis.NewScript(`for i, key in ipairs(ARGV) do
+    if i > 1 and redis.call('HGET', KEYS[1], key) == ARGV[1] then
+        redis.call('HDEL', KEYS[1], key)
+    end
+end
+return redis.call('ZREM', KEYS[2], ARGV[1])`)
+
+/*
+Manager runs the instances of a saga.
+
+Besides the instance streams, the manager keeps its checkpoint, the deadlines and the correlation keys
+of the active instances inside Redis, so it resumes where it stopped after a restart.
+*/
+type Manager[S any] struct {
+	name        string
+	logger      *slog.Logger
+	esdbClient  *esdb.Client
+	redisClient *redis.Client
+	saga        Saga[S]
+}
+
+func NewManager[S any](name string, logger *slog.Logger, esdbClient *esdb.Client, redisClient *redis.Client, saga Saga[S]) *Manager[S] {
+	return &Manager[S]{
+		name:        name,
+		logger:      logger,
+		esdbClient:  esdbClient,
+		redisClient: redisClient,
+		saga:        saga,
+	}
+}
+
+func (m *Manager[S]) deadlinesKey() string {
+	return fmt.Sprintf("sagas:%s:deadlines", m.name)
+}
+
+func (m *Manager[S]) correlationsKey() string {
+	return fmt.Sprintf("sagas:%s:correlations", m.name)
+}
+
+// Folds the instance stream, the instance doesn't exist if its stream doesn't exist
+func (m *Manager[S]) Load(ctx context.Context, id string) (Instance[S], error) {
+	instance := Instance[S]{ID: id, Revision: esdb.NoStream{}}
+
+	err := db.HandleReadStream(ctx, m.esdbClient, instanceStream(m.saga.StreamType(), id), func(event esdb.RecordedEvent) error {
+		state, err := m.saga.Apply(instance.State, event)
+		if err != nil {
+			return err
+		}
+
+		instance.State = state
+		instance.Revision = esdb.Revision(event.EventNumber)
+
+		return nil
+	})
+	if err != nil && !db.IsErrorCode(err, esdb.ErrorCodeResourceNotFound) {
+		return instance, fmt.Errorf("failed to load the instance %s: %w", id, err)
+	}
+
+	return instance, nil
+}
+
+// Appends the events to the instance stream, expecting the revision the instance was loaded at
+func (m *Manager[S]) Append(ctx context.Context, instance Instance[S], events ...esdb.EventData) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	aopts := esdb.AppendToStreamOptions{
+		ExpectedRevision: instance.Revision,
+	}
+
+	if _, err := m.esdbClient.AppendToStream(ctx, instanceStream(m.saga.StreamType(), instance.ID), aopts, events...); err != nil {
+		return fmt.Errorf("failed to append to the instance %s: %w", instance.ID, err)
+	}
+
+	return nil
+}
+
+// Loads the existing instance and appends the events returned by the reaction, reloading it when the stream was changed concurrently
+func (m *Manager[S]) React(ctx context.Context, id string, reaction func(Instance[S]) ([]esdb.EventData, error)) error {
+	for attempt := 1; ; attempt++ {
+		instance, err := m.Load(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !instance.Exists() {
+			return nil
+		}
+
+		events, err := reaction(instance)
+		if err != nil {
+			return err
+		}
+
+		err = m.Append(ctx, instance, events...)
+		if db.IsErrorCode(err, esdb.ErrorCodeWrongExpectedVersion) && attempt < maxAttempts {
+			continue
+		}
+
+		return err
+	}
+}
+
+// Stores the deadline and the correlation keys of an active instance, or removes them once it's finished
+func (m *Manager[S]) track(ctx context.Context, instance Instance[S]) error {
+	keys := m.saga.Keys(instance.State)
+
+	deadline, active := m.saga.Deadline(instance.State)
+	if !active {
+		args := make([]any, 0, len(keys)+1)
+		args = append(args, instance.ID)
+		for _, key := range keys {
+			args = append(args, key)
+		}
+
+		if err := untrackScript.Run(ctx, m.redisClient, []string{m.correlationsKey(), m.deadlinesKey()}, args...).Err(); err != nil {
+			return fmt.Errorf("failed to untrack the instance %s: %w", instance.ID, err)
+		}
+
+		return nil
+	}
+
+	_, err := m.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, m.deadlinesKey(), redis.Z{Score: float64(deadline.UnixMilli()), Member: instance.ID})
+		for _, key := range keys {
+			pipe.HSet(ctx, m.correlationsKey(), key, instance.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to track the instance %s: %w", instance.ID, err)
+	}
+
+	return nil
+}
+
+func (m *Manager[S]) handleEvent(ctx context.Context, event esdb.RecordedEvent) error {
+	if id, ok := instanceID(m.saga.StreamType(), event.StreamID); ok {
+		instance, err := m.Load(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		if err := m.track(ctx, instance); err != nil {
+			return err
+		}
+
+		return m.React(ctx, id, func(instance Instance[S]) ([]esdb.EventData, error) {
+			return m.saga.Handle(ctx, instance, event)
+		})
+	}
+
+	keys, err := m.saga.Correlate(event)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	ids, err := m.redisClient.HMGet(ctx, m.correlationsKey(), keys...).Result()
+	if err != nil {
+		return fmt.Errorf("failed to get the correlated instances: %w", err)
+	}
+
+	handled := map[string]bool{}
+	for _, value := range ids {
+		id, ok := value.(string)
+		if !ok || handled[id] {
+			continue
+		}
+		handled[id] = true
+
+		err := m.React(ctx, id, func(instance Instance[S]) ([]esdb.EventData, error) {
+			return m.saga.Handle(ctx, instance, event)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Calls the timeout of every instance whose deadline passed
+func (m *Manager[S]) checkDeadlines(ctx context.Context, now time.Time) error {
+	ids, err := m.redisClient.ZRangeByScore(ctx, m.deadlinesKey(), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return fmt.Errorf("failed to get the passed deadlines: %w", err)
+	}
+
+	for _, id := range ids {
+		err := m.React(ctx, id, func(instance Instance[S]) ([]esdb.EventData, error) {
+			deadline, active := m.saga.Deadline(instance.State)
+			if !active {
+				return nil, m.track(ctx, instance)
+			}
+			if now.Before(deadline) {
+				return nil, nil
+			}
+
+			m.logger.Info("saga instance timed out", "saga", m.name, "id", id, "deadline", deadline)
+			return m.saga.Timeout(ctx, instance)
+		})
+		if err != nil {
+			m.logger.Error("saga timeout returned an error", "saga", m.name, "id", id, "error", err)
+		}
+	}
+
+	return nil
+}
+
+/*
+Handle the events of the instance streams and the subscribed streams, continuing from the stored checkpoint,
+and check the deadlines every interval until the context is done. The tracker can be nil.
+
+Events whose handling failed are handled again, the manager stops once the retries run out.
+Instances whose timeout failed are retried on the next check.
+*/
+func (m *Manager[S]) Run(ctx context.Context, tracker *db.SubscriptionTracker, interval time.Duration) error {
+	from, _, err := db.GetRedisCheckpoint(ctx, m.redisClient, m.name)
+	if err != nil {
+		return err
+	}
+	tracker.Resumed(from)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if err := m.checkDeadlines(ctx, now); err != nil {
+					m.logger.Error("checking saga deadlines returned an error", "saga", m.name, "error", err)
+				}
+			}
+		}
+	}()
+
+	prefixes := []string{string(m.saga.StreamType())}
+	for _, streamType := range m.saga.Subscriptions() {
+		prefixes = append(prefixes, string(streamType))
+	}
+
+	opts := esdb.SubscribeToAllOptions{
+		From: from,
+		Filter: &esdb.SubscriptionFilter{
+			Type:     esdb.StreamFilterType,
+			Prefixes: prefixes,
+		},
+	}
+
+	// The checkpoint isn't saved past a failed event, so the subscription is retried from it
+	handler := func(event esdb.RecordedEvent) error {
+		if err := m.handleEvent(ctx, event); err != nil {
+			return fmt.Errorf("saga %s failed to handle event %d of stream %s: %w", m.name, event.EventNumber, event.StreamID, err)
+		}
+
+		if err := db.SaveRedisCheckpoint(ctx, m.redisClient, m.name, event.Position, checkpointVersion); err != nil {
+			return err
+		}
+
+		tracker.Processed(event)
+
+		return nil
+	}
+
+	return db.HandleAllStreamWithRetry(ctx, m.logger, m.esdbClient, opts, handler)
+}
@@ -0,0 +1,238 @@
+package saga_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/db"
+	"github.com/MatejaMaric/esdb-playground/events"
+	"github.com/MatejaMaric/esdb-playground/saga"
+	"github.com/MatejaMaric/esdb-playground/tests"
+	"github.com/ory/dockertest/v3"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	TestEsdbClient  *esdb.Client
+	TestRedisClient *redis.Client
+)
+
+func TestMain(m *testing.M) {
+	pool := tests.SetupDockertestPool()
+
+	var resourceRedis, resourceEventStoreDB *dockertest.Resource
+
+	eg := &errgroup.Group{}
+
+	eg.Go(func() error {
+		var err error
+		TestRedisClient, resourceRedis, err = tests.SpawnTestRedis(pool)
+		return err
+	})
+
+	eg.Go(func() error {
+		var err error
+		TestEsdbClient, resourceEventStoreDB, err = tests.SpawnTestEventStoreDB(pool)
+		return err
+	})
+
+	if err := eg.Wait(); err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+
+	// You can't defer this because os.Exit doesn't care for defer
+	tests.PurgeResources(pool, resourceRedis, resourceEventStoreDB)
+
+	os.Exit(code)
+}
+
+const (
+	counterStream events.Stream = "counter"
+	signalStream  events.Stream = "signal"
+
+	counterStarted  events.Event = "CounterStarted"
+	counterSignaled events.Event = "CounterSignaled"
+	counterTimedOut events.Event = "CounterTimedOut"
+	signal          events.Event = "Signal"
+)
+
+type counter struct {
+	Key      string    `json:"key"`
+	Deadline time.Time `json:"deadline"`
+	Signals  int       `json:"signals"`
+	TimedOut bool      `json:"timed_out"`
+}
+
+type signalEvent struct {
+	Key string `json:"key"`
+}
+
+// Counts the signals of its key until it times out, the handling of the first signal fails
+type counterSaga struct {
+	attempts atomic.Int32
+}
+
+func (s *counterSaga) StreamType() events.Stream {
+	return counterStream
+}
+
+func (s *counterSaga) Subscriptions() []events.Stream {
+	return []events.Stream{signalStream}
+}
+
+func (s *counterSaga) Apply(state counter, event esdb.RecordedEvent) (counter, error) {
+	switch event.EventType {
+	case string(counterStarted):
+		if err := json.Unmarshal(event.Data, &state); err != nil {
+			return state, err
+		}
+	case string(counterSignaled):
+		state.Signals++
+	case string(counterTimedOut):
+		state.TimedOut = true
+	}
+
+	return state, nil
+}
+
+func (s *counterSaga) Keys(state counter) []string {
+	return []string{state.Key}
+}
+
+func (s *counterSaga) Correlate(event esdb.RecordedEvent) ([]string, error) {
+	var signaled signalEvent
+	if err := json.Unmarshal(event.Data, &signaled); err != nil {
+		return nil, err
+	}
+
+	return []string{signaled.Key}, nil
+}
+
+func (s *counterSaga) Handle(ctx context.Context, instance saga.Instance[counter], event esdb.RecordedEvent) ([]esdb.EventData, error) {
+	if event.EventType != string(signal) {
+		return nil, nil
+	}
+
+	if s.attempts.Add(1) == 1 {
+		return nil, errors.New("the first signal fails")
+	}
+
+	signaled, err := events.Create(counterSignaled, struct{}{})
+	return []esdb.EventData{signaled}, err
+}
+
+func (s *counterSaga) Deadline(state counter) (time.Time, bool) {
+	return state.Deadline, !state.TimedOut
+}
+
+func (s *counterSaga) Timeout(ctx context.Context, instance saga.Instance[counter]) ([]esdb.EventData, error) {
+	event, err := events.Create(counterTimedOut, struct{}{})
+	return []esdb.EventData{event}, err
+}
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	counters := &counterSaga{}
+	manager := saga.NewManager("counters", logger, TestEsdbClient, TestRedisClient, saga.Saga[counter](counters))
+
+	run := func() context.CancelFunc {
+		runCtx, cancel := context.WithCancel(ctx)
+		go manager.Run(runCtx, nil, 100*time.Millisecond)
+		return cancel
+	}
+
+	start := func(id string, state counter) {
+		t.Helper()
+
+		event, err := events.Create(counterStarted, state)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := manager.Append(ctx, saga.Instance[counter]{ID: id, Revision: esdb.NoStream{}}, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sendSignal := func(key string) {
+		t.Helper()
+
+		stream := fmt.Sprintf("%s-%s", signalStream, key)
+		if _, err := db.AppendEvent(ctx, TestEsdbClient, stream, signal, signalEvent{Key: key}, esdb.Any{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor := func(id string, done func(counter) bool) counter {
+		t.Helper()
+
+		for i := 0; i < 50; i++ {
+			instance, err := manager.Load(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if done(instance.State) {
+				return instance.State
+			}
+
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		t.Fatalf("instance %s didn't reach the expected state", id)
+		return counter{}
+	}
+
+	stop := run()
+
+	start("signaled", counter{Key: "signaled-key", Deadline: time.Now().Add(time.Hour)})
+	sendSignal("signaled-key")
+
+	// The failed signal is handled again instead of being skipped
+	waitFor("signaled", func(c counter) bool { return c.Signals == 1 })
+	if attempts := counters.attempts.Load(); attempts != 2 {
+		t.Fatalf("expected the signal to be handled twice, got %d", attempts)
+	}
+
+	start("timed-out", counter{Key: "timed-out-key", Deadline: time.Now().Add(200 * time.Millisecond)})
+	waitFor("timed-out", func(c counter) bool { return c.TimedOut })
+
+	// Signals of finished instances aren't routed to them
+	sendSignal("timed-out-key")
+
+	stop()
+	time.Sleep(200 * time.Millisecond)
+
+	// The restarted manager continues from its checkpoint, so the handled signals aren't handled again
+	stop = run()
+	defer stop()
+
+	sendSignal("signaled-key")
+
+	waitFor("signaled", func(c counter) bool { return c.Signals >= 2 })
+	time.Sleep(300 * time.Millisecond)
+
+	state := waitFor("signaled", func(c counter) bool { return true })
+	if state.Signals != 2 {
+		t.Fatalf("expected 2 signals, got %d", state.Signals)
+	}
+
+	timedOut := waitFor("timed-out", func(c counter) bool { return true })
+	if timedOut.Signals != 0 {
+		t.Fatalf("the finished instance shouldn't be signaled, got %d signals", timedOut.Signals)
+	}
+}
@@ -0,0 +1,57 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
+	"github.com/MatejaMaric/esdb-playground/events"
+)
+
+/*
+Saga is a long running process whose state is persisted as its own stream, one stream per instance.
+
+The manager folds the instance stream into the state, routes the events of the instance stream and of the
+subscribed streams to the instance, and appends the events the saga returns to the instance stream.
+Events can be handled more than once, so the saga has to decide what to do from the state it's given.
+*/
+type Saga[S any] interface {
+	// Stream type of the instance streams
+	StreamType() events.Stream
+	// Stream types of the other streams the saga reacts to
+	Subscriptions() []events.Stream
+	// Folds an event of the instance stream into the state
+	Apply(state S, event esdb.RecordedEvent) (S, error)
+	// Correlation keys of an active instance, the events of the subscribed streams with the same keys are routed to it
+	Keys(state S) []string
+	// Correlation keys of an event of the subscribed streams, nil if the saga doesn't react to it
+	Correlate(event esdb.RecordedEvent) ([]string, error)
+	// Reacts to an event of the instance stream or a correlated event, returns the events to append to the instance stream
+	Handle(ctx context.Context, instance Instance[S], event esdb.RecordedEvent) ([]esdb.EventData, error)
+	// Time at which the instance times out, false when the instance is finished
+	Deadline(state S) (time.Time, bool)
+	// Reacts to the passed deadline, returns the events to append to the instance stream
+	Timeout(ctx context.Context, instance Instance[S]) ([]esdb.EventData, error)
+}
+
+type Instance[S any] struct {
+	ID    string
+	State S
+	// Revision of the last event of the instance stream, esdb.NoStream{} for new instances
+	Revision esdb.ExpectedRevision
+}
+
+func (i Instance[S]) Exists() bool {
+	_, isNew := i.Revision.(esdb.NoStream)
+	return !isNew
+}
+
+func instanceStream(streamType events.Stream, id string) string {
+	return fmt.Sprintf("%s-%s", streamType, id)
+}
+
+func instanceID(streamType events.Stream, streamName string) (string, bool) {
+	return strings.CutPrefix(streamName, string(streamType)+"-")
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/EventStore/EventStore-Client-Go/v3/esdb"
 	_ "github.com/go-sql-driver/mysql"
@@ -42,7 +43,7 @@ func SpawnTestMariaDB(pool *dockertest.Pool) (*sql.DB, *dockertest.Resource, err
 	ropts := dockertest.RunOptions{
 		Repository: "mariadb",
 		Tag:        "11.0.3-jammy",
-		Env:        []string{"MYSQL_ROOT_PASSWORD=secret"},
+		Env:        []string{"MYSQL_ROOT_PASSWORD=secret", "MYSQL_DATABASE=projected_models"},
 	}
 
 	resource, err := pool.RunWithOptions(&ropts)
@@ -54,7 +55,7 @@ func SpawnTestMariaDB(pool *dockertest.Pool) (*sql.DB, *dockertest.Resource, err
 
 	retry := func() error {
 		var err error
-		sqlClient, err = sql.Open("mysql", fmt.Sprintf("root:secret@(localhost:%s)/mysql", resource.GetPort("3306/tcp")))
+		sqlClient, err = sql.Open("mysql", fmt.Sprintf("root:secret@(localhost:%s)/projected_models?multiStatements=true&parseTime=true", resource.GetPort("3306/tcp")))
 		if err != nil {
 			return err
 		}
@@ -68,6 +69,20 @@ func SpawnTestMariaDB(pool *dockertest.Pool) (*sql.DB, *dockertest.Resource, err
 	return sqlClient, resource, nil
 }
 
+// Executes the SQL file used to initialize the MariaDB container (initdb.d/base.sql)
+func CreateSchema(sqlClient *sql.DB, path string) error {
+	schema, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read the schema file: %w", err)
+	}
+
+	if _, err := sqlClient.Exec(string(schema)); err != nil {
+		return fmt.Errorf("failed to create the schema: %w", err)
+	}
+
+	return nil
+}
+
 func SpawnTestEventStoreDB(pool *dockertest.Pool) (*esdb.Client, *dockertest.Resource, error) {
 	ropts := dockertest.RunOptions{
 		Repository:   "eventstore/eventstore",